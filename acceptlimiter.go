@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// acceptLimiter limits the rate of accepted connections with a token
+// bucket. Accepts above the rate are delayed, so the connections wait in
+// the listen backlog instead of all being handled at once.
+type acceptLimiter struct {
+	interval time.Duration
+	burst    int
+
+	mu sync.Mutex
+	// tat is the time the bucket is full again.
+	tat time.Time
+}
+
+// newAcceptLimiter returns a limiter allowing rate accepts per second
+// with bursts of up to burst accepts. It returns nil if rate is not
+// positive.
+func newAcceptLimiter(rate float64, burst int) *acceptLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &acceptLimiter{interval: time.Duration(float64(time.Second) / rate), burst: max(burst, 1)}
+}
+
+// reserve takes a token and returns how long to wait until it is
+// available.
+func (l *acceptLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tat.Before(now) {
+		l.tat = now
+	}
+
+	delay := l.tat.Sub(now) - time.Duration(l.burst-1)*l.interval
+	l.tat = l.tat.Add(l.interval)
+
+	return max(delay, 0)
+}
+
+// wait blocks until the next accept is allowed and returns the delay. It
+// returns false if the context is canceled first. It is safe to call on a
+// nil acceptLimiter.
+func (l *acceptLimiter) wait(ctx context.Context) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+
+	delay := l.reserve(time.Now())
+	if delay == 0 {
+		return 0, true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return delay, false
+	case <-timer.C:
+		return delay, true
+	}
+}
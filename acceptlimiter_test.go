@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AcceptLimiterTestSuite struct {
+	suite.Suite
+}
+
+func (s *AcceptLimiterTestSuite) TestReserve() {
+	limiter := newAcceptLimiter(10, 3)
+	now := time.Now()
+
+	// the burst is accepted at once
+	s.Zero(limiter.reserve(now))
+	s.Zero(limiter.reserve(now))
+	s.Zero(limiter.reserve(now))
+
+	// further accepts are spread at the rate
+	s.Equal(100*time.Millisecond, limiter.reserve(now))
+	s.Equal(200*time.Millisecond, limiter.reserve(now))
+
+	// the bucket refills over time
+	later := now.Add(time.Second)
+	s.Zero(limiter.reserve(later))
+}
+
+func (s *AcceptLimiterTestSuite) TestWait() {
+	s.Run("nil limiter", func() {
+		var limiter *acceptLimiter
+
+		delay, ok := limiter.wait(context.Background())
+		s.True(ok)
+		s.Zero(delay)
+	})
+
+	s.Run("disabled", func() {
+		s.Nil(newAcceptLimiter(0, 1))
+	})
+
+	s.Run("canceled", func() {
+		limiter := newAcceptLimiter(1, 1)
+		_, ok := limiter.wait(context.Background())
+		s.True(ok)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		delay, ok := limiter.wait(ctx)
+		s.False(ok)
+		s.Greater(delay, time.Duration(0))
+	})
+}
+
+func TestAcceptLimiter(t *testing.T) {
+	suite.Run(t, new(AcceptLimiterTestSuite))
+}
+
+func BenchmarkAcceptLimiterReserve(b *testing.B) {
+	limiter := newAcceptLimiter(1000, 10)
+	now := time.Now()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		limiter.reserve(now.Add(time.Duration(i) * time.Millisecond))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessLogFile is a log file that can be reopened on SIGUSR1 for external
+// log rotation and optionally rotates itself once it exceeds a size.
+type AccessLogFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewAccessLogFile opens the file at path for appending. If maxSize is
+// greater than zero, the file is rotated once it grows beyond maxSize
+// bytes, keeping maxBackups old files.
+func NewAccessLogFile(path string, maxSize int64, maxBackups int) (*AccessLogFile, error) {
+	a := &AccessLogFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// NewAccessLogger returns a JSON logger writing to the file.
+func NewAccessLogger(file *AccessLogFile) *log.Logger {
+	logger := log.New()
+	logger.SetOutput(file)
+	logger.SetFormatter(&log.JSONFormatter{})
+
+	return logger
+}
+
+// Write implements io.Writer.
+func (a *AccessLogFile) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size+int64(len(p)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			// keep writing to the current file
+			log.WithError(err).Error("Error rotating access log")
+		}
+	}
+
+	n, err := a.file.Write(p)
+	a.size += int64(n)
+
+	return n, err
+}
+
+// Reopen reopens the file, e.g. after it was moved by logrotate. The
+// previous file is kept if the file can not be opened.
+func (a *AccessLogFile) Reopen() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.open()
+}
+
+// WatchSignals reopens the file on SIGUSR1 until the context is canceled.
+func (a *AccessLogFile) WatchSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			if err := a.Reopen(); err != nil {
+				log.WithError(err).Error("Error reopening access log")
+				continue
+			}
+			log.Info("Reopened access log")
+		}
+	}
+}
+
+// open opens the file at path and closes the previous one afterwards. On
+// error the previous file stays in use.
+func (a *AccessLogFile) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = file
+	a.size = info.Size()
+
+	return nil
+}
+
+// rotate shifts path.1 .. path.N-1 to path.2 .. path.N, moves the current
+// file to path.1 and opens a new one. The current file stays open until
+// the new one is opened. The caller must hold the lock.
+func (a *AccessLogFile) rotate() error {
+	for i := a.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+
+	if a.maxBackups > 0 {
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+
+	return a.open()
+}
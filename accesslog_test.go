@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AccessLogTestSuite struct {
+	suite.Suite
+}
+
+func (s *AccessLogTestSuite) TestRotate() {
+	path := filepath.Join(s.T().TempDir(), "access.log")
+
+	file, err := NewAccessLogFile(path, 10, 2)
+	s.Require().NoError(err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err = file.Write([]byte(line))
+		s.NoError(err)
+	}
+
+	current, _ := os.ReadFile(path)
+	backup1, _ := os.ReadFile(path + ".1")
+	backup2, _ := os.ReadFile(path + ".2")
+
+	s.Equal("fourth\n", string(current))
+	s.Equal("third\n", string(backup1))
+	s.Equal("second\n", string(backup2))
+	s.NoFileExists(path + ".3")
+}
+
+func (s *AccessLogTestSuite) TestReopen() {
+	path := filepath.Join(s.T().TempDir(), "access.log")
+
+	file, err := NewAccessLogFile(path, 0, 0)
+	s.Require().NoError(err)
+
+	_, err = file.Write([]byte("before\n"))
+	s.NoError(err)
+
+	// simulate logrotate moving the file away
+	s.Require().NoError(os.Rename(path, path+".old"))
+	s.Require().NoError(file.Reopen())
+
+	_, err = file.Write([]byte("after\n"))
+	s.NoError(err)
+
+	rotated, _ := os.ReadFile(path + ".old")
+	current, _ := os.ReadFile(path)
+
+	s.Equal("before\n", string(rotated))
+	s.Equal("after\n", string(current))
+}
+
+func (s *AccessLogTestSuite) TestReopenFailureKeepsFile() {
+	path := filepath.Join(s.T().TempDir(), "access.log")
+
+	file, err := NewAccessLogFile(path, 0, 0)
+	s.Require().NoError(err)
+
+	// the file can not be opened again at path
+	s.Require().NoError(os.Rename(path, path+".old"))
+	s.Require().NoError(os.Mkdir(path, 0750))
+	s.Error(file.Reopen())
+
+	_, err = file.Write([]byte("after\n"))
+	s.NoError(err)
+
+	previous, _ := os.ReadFile(path + ".old")
+	s.Equal("after\n", string(previous))
+}
+
+func TestAccessLog(t *testing.T) {
+	suite.Run(t, new(AccessLogTestSuite))
+}
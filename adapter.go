@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,14 +22,67 @@ const (
 
 	ResponseNoResult     string = "NO RESULT"
 	ResponsePayloadError string = "PAYLOAD ERROR"
+	ResponseMapDisabled  string = "MAP DISABLED"
+	ResponseOverloaded   string = "OVERLOADED"
+
+	// shedWriteTimeout bounds the time spent answering a shed connection
+	// on the accept loop.
+	shedWriteTimeout = 100 * time.Millisecond
 
 	ErrPayloadError string = "Error getting payload"
 	ErrAPIError     string = "Error fetching data"
+
+	// readBufferSize is the maximum size of a request read from postfix.
+	readBufferSize = 4096
 )
 
+// readBufferPool holds the request buffers reused across connections.
+var readBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, readBufferSize)
+		return &buf
+	},
+}
+
+// lookupSpanNames caches the span names of the maps, so they are not
+// concatenated for every lookup.
+var lookupSpanNames sync.Map
+
+// lookupSpanName returns the name of the span for a lookup of handler.
+func lookupSpanName(handler string) string {
+	if name, ok := lookupSpanNames.Load(handler); ok {
+		return name.(string)
+	}
+
+	name, _ := lookupSpanNames.LoadOrStore(handler, "lookup "+handler)
+	return name.(string)
+}
+
+// responseBufferPool holds the buffers used to encode responses.
+var responseBufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
 // Status is the status code for the response.
 type Status int
 
+// String returns the status code as text without allocating for the
+// known codes.
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "200"
+	case StatusError:
+		return "400"
+	case StatusNoResult:
+		return "500"
+	}
+
+	return strconv.Itoa(int(s))
+}
+
 // Response is the response to a postfix command.
 type Response struct {
 	Status   Status
@@ -35,15 +91,62 @@ type Response struct {
 
 // String returns the response as a string.
 func (r *Response) String() string {
-	return fmt.Sprintf("%d %s\n", r.Status, strings.ReplaceAll(r.Response, " ", "%20"))
+	buf := responseBufferPool.Get().(*bytes.Buffer)
+	defer releaseResponseBuffer(buf)
+
+	r.encode(buf)
+	return buf.String()
+}
+
+// encode appends the wire format of the response to buf.
+func (r *Response) encode(buf *bytes.Buffer) {
+	buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(r.Status), 10))
+	buf.WriteByte(' ')
+	for i := 0; i < len(r.Response); i++ {
+		if r.Response[i] == ' ' {
+			buf.WriteString("%20")
+			continue
+		}
+		buf.WriteByte(r.Response[i])
+	}
+	buf.WriteByte('\n')
+}
+
+// releaseResponseBuffer resets buf and returns it to the pool.
+func releaseResponseBuffer(buf *bytes.Buffer) {
+	buf.Reset()
+	responseBufferPool.Put(buf)
 }
 
 // PostfixAdapter is an adapter for postfix postmap commands.
 // See https://www.postfix.org/postmap.1.html
 type PostfixAdapter struct {
 	client UserliService
+
+	// AccessLog receives one entry per lookup if set.
+	AccessLog *log.Logger
+
+	// DomainLabeler enables per-domain request metrics if set.
+	DomainLabeler *DomainLabeler
+
+	// Chaos injects faults into lookups if set.
+	Chaos *Chaos
+
+	// Recorder receives every lookup if set.
+	Recorder *Recorder
+
+	// AliasExpansionThreshold is the number of destinations of an alias
+	// above which a lookup is logged and counted. It is disabled if 0.
+	AliasExpansionThreshold int
+
+	middlewares []Middleware
+	// lookups caches the wrapped lookup of every map.
+	lookups sync.Map
 }
 
+// lookupFunc resolves a single key for a map and returns the response.
+type lookupFunc func(ctx context.Context, logger *log.Entry, key string) Response
+
 // NewPostfixAdapter creates a new Handler with the given UserliService.
 func NewPostfixAdapter(client UserliService) *PostfixAdapter {
 	return &PostfixAdapter{client: client}
@@ -53,149 +156,325 @@ func NewPostfixAdapter(client UserliService) *PostfixAdapter {
 // It fetches the destinations for the given alias.
 // The response is a comma separated list of destinations.
 func (p *PostfixAdapter) AliasHandler(conn net.Conn) {
+	p.handle(conn, "alias", p.lookupAlias)
+}
+
+// DomainHandler handles the get command for domains.
+// It checks if the domain exists.
+// The response is a single line with the status code.
+func (p *PostfixAdapter) DomainHandler(conn net.Conn) {
+	p.handle(conn, "domain", p.lookupDomain)
+}
+
+// MailboxHandler handles the get command for mailboxes.
+// It checks if the mailbox exists.
+// The response is a single line with the status code.
+func (p *PostfixAdapter) MailboxHandler(conn net.Conn) {
+	p.handle(conn, "mailbox", p.lookupMailbox)
+}
+
+// SendersHandler handles the get command for senders.
+// It fetches the senders for the given email.
+// The response is a comma separated list of senders.
+func (p *PostfixAdapter) SendersHandler(conn net.Conn) {
+	p.handle(conn, "senders", p.lookupSenders)
+}
+
+// RecipientHandler handles the get command for recipients.
+// It checks if the address is a mailbox or an alias, so a single lookup
+// tells whether it accepts mail.
+// The response is a single line with the status code.
+func (p *PostfixAdapter) RecipientHandler(conn net.Conn) {
+	p.handle(conn, "recipient", p.lookupRecipient)
+}
+
+// handle reads a single request from the connection, resolves it with
+// lookup and writes the response.
+func (p *PostfixAdapter) handle(conn net.Conn, handler string, lookup lookupFunc) {
 	now := time.Now()
+	ctx, logger := newRequestContext(handler)
 
-	payload, err := p.payload(conn)
-	if err != nil {
-		log.WithError(err).Error(ErrPayloadError)
-		p.write(conn, Response{Status: StatusError, Response: ResponsePayloadError}, now, "alias")
+	ctx, span := StartSpan(ctx, lookupSpanName(handler), spanKindServer)
+	span.SetAttribute("postfix.map", handler)
+	span.SetAttribute("request_id", RequestIDFromContext(ctx))
+	defer span.End()
+
+	var response Response
+
+	payload, err := p.payload(conn, logger)
+	// probes of the own lookup servers are no lookups of Postfix. A probe
+	// is known once it sent its request.
+	probe := probeConns.contains(conn)
+
+	latency, fault := p.Chaos.inject(handler)
+	time.Sleep(latency)
+	switch fault {
+	case chaosFaultDrop:
+		logger.Debug("Chaos: dropping connection")
 		return
-	}
-	aliases, err := p.client.GetAliases(payload)
-	if err != nil {
-		log.WithError(err).WithField("email", payload).Error(ErrAPIError)
-		p.write(conn, Response{Status: StatusError, Response: "Error fetching aliases"}, now, "alias")
+	case chaosFaultMalformed:
+		logger.Debug("Chaos: writing malformed response")
+		_, _ = conn.Write([]byte(chaosMalformedResponse))
 		return
 	}
 
-	if len(aliases) == 0 {
-		p.write(conn, Response{Status: StatusNoResult, Response: ResponseNoResult}, now, "alias")
+	switch {
+	case err != nil:
+		logger.WithError(err).Error(ErrPayloadError)
+		span.SetError(err)
+		response = Response{Status: StatusError, Response: ResponsePayloadError}
+	case fault == chaosFaultError:
+		response = Response{Status: StatusError, Response: ResponseChaos}
+	default:
+		lookupCtx, stop := watchDisconnect(ctx, conn)
+		response = p.lookup(handler, lookup)(lookupCtx, logger, payload)
+		if stop() {
+			logger.WithField("payload", payload).Debug("Client disconnected, lookup canceled")
+			addCounter(abandonedLookups.WithLabelValues(handler), "abandoned_lookups", 1, map[string]string{"handler": handler})
+			span.SetError(context.Canceled)
+			return
+		}
+		if response.Status == StatusError {
+			span.SetError(errors.New(response.Response))
+		}
+	}
+	span.SetAttribute("postfix.status", response.Status.String())
+
+	duration := p.write(conn, logger, response, now, handler)
+	if !probe {
+		slo.Observe(handler, response, duration)
+	}
+
+	if p.DomainLabeler != nil && payload != "" {
+		domain, status := p.DomainLabeler.Label(payload), statusLabel(response)
+		addCounter(domainRequests.WithLabelValues(handler, domain, status), "domain_requests", 1, map[string]string{"handler": handler, "domain": domain, "status": status})
+	}
+
+	if probe {
 		return
 	}
 
-	p.write(conn, Response{Status: StatusOK, Response: strings.Join(aliases, ",")}, now, "alias")
+	if err == nil {
+		p.Recorder.Record(handler, payload, response.Status, time.Since(now))
+	}
+
+	if p.AccessLog != nil {
+		p.AccessLog.WithFields(log.Fields{
+			"request_id":  RequestIDFromContext(ctx),
+			"map":         handler,
+			"key":         payload,
+			"status":      int(response.Status),
+			"response":    response.Response,
+			"remote_addr": conn.RemoteAddr().String(),
+			"duration_ms": float64(time.Since(now).Microseconds()) / 1000,
+		}).Info("lookup")
+	}
 }
 
-// DomainHandler handles the get command for domains.
-// It checks if the domain exists.
-// The response is a single line with the status code.
-func (p *PostfixAdapter) DomainHandler(conn net.Conn) {
-	now := time.Now()
+// Shed answers a connection of the map handler with a temporary error
+// without reading the request. It is used if no worker is available.
+func (p *PostfixAdapter) Shed(handler string, conn net.Conn) {
+	addCounter(requestsShed.WithLabelValues(handler), "requests_shed", 1, map[string]string{"handler": handler})
 
-	payload, err := p.payload(conn)
-	if err != nil {
-		log.WithError(err).Error("Error getting payload")
-		p.write(conn, Response{Status: StatusError, Response: ResponsePayloadError}, now, "domain")
-		return
+	response := Response{Status: StatusError, Response: ResponseOverloaded}
+	buf := responseBufferPool.Get().(*bytes.Buffer)
+	defer releaseResponseBuffer(buf)
+	response.encode(buf)
+
+	_ = conn.SetWriteDeadline(time.Now().Add(shedWriteTimeout))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		log.WithError(err).WithField("handler", handler).Debug("Error writing overload response")
 	}
+}
 
-	exists, err := p.client.GetDomain(payload)
+func (p *PostfixAdapter) lookupAlias(ctx context.Context, logger *log.Entry, email string) Response {
+	aliases, err := p.client.GetAliases(ctx, email)
 	if err != nil {
-		log.WithError(err).WithField("domain", payload).Error(ErrAPIError)
-		p.write(conn, Response{Status: StatusError, Response: "Error fetching domain"}, now, "domain")
-		return
+		logger.WithError(err).WithField("email", email).Error(ErrAPIError)
+		return Response{Status: StatusError, Response: "Error fetching aliases"}
 	}
 
-	if !exists {
-		p.write(conn, Response{Status: StatusNoResult, Response: ResponseNoResult}, now, "domain")
-		return
+	if len(aliases) == 0 {
+		return Response{Status: StatusNoResult, Response: ResponseNoResult}
 	}
 
-	p.write(conn, Response{Status: StatusOK, Response: "1"}, now, "domain")
-}
+	aliasExpansionSize.Observe(float64(len(aliases)))
+	if p.AliasExpansionThreshold > 0 && len(aliases) > p.AliasExpansionThreshold {
+		logger.WithFields(log.Fields{"email": email, "destinations": len(aliases)}).Warn("Alias expands to more destinations than expected")
+		addCounter(largeAliasExpansions, "large_alias_expansions", 1, nil)
+	}
 
-// MailboxHandler handles the get command for mailboxes.
-// It checks if the mailbox exists.
-// The response is a single line with the status code.
-func (p *PostfixAdapter) MailboxHandler(conn net.Conn) {
-	now := time.Now()
+	return Response{Status: StatusOK, Response: strings.Join(aliases, ",")}
+}
 
-	payload, err := p.payload(conn)
+func (p *PostfixAdapter) lookupDomain(ctx context.Context, logger *log.Entry, domain string) Response {
+	exists, err := p.client.GetDomain(ctx, domain)
 	if err != nil {
-		log.WithError(err).Error(ErrPayloadError)
-		p.write(conn, Response{Status: StatusError, Response: ResponsePayloadError}, now, "mailbox")
-		return
+		logger.WithError(err).WithField("domain", domain).Error(ErrAPIError)
+		return Response{Status: StatusError, Response: "Error fetching domain"}
+	}
+
+	if !exists {
+		return Response{Status: StatusNoResult, Response: ResponseNoResult}
 	}
 
-	exists, err := p.client.GetMailbox(payload)
+	return Response{Status: StatusOK, Response: "1"}
+}
+
+func (p *PostfixAdapter) lookupMailbox(ctx context.Context, logger *log.Entry, email string) Response {
+	exists, err := p.client.GetMailbox(ctx, email)
 	if err != nil {
-		log.WithError(err).WithField("email", payload).Error(ErrAPIError)
-		p.write(conn, Response{Status: StatusError, Response: "Error fetching mailbox"}, now, "mailbox")
-		return
+		logger.WithError(err).WithField("email", email).Error(ErrAPIError)
+		return Response{Status: StatusError, Response: "Error fetching mailbox"}
 	}
 
 	if !exists {
-		p.write(conn, Response{Status: StatusNoResult, Response: ResponseNoResult}, now, "mailbox")
-		return
+		return Response{Status: StatusNoResult, Response: ResponseNoResult}
 	}
 
-	p.write(conn, Response{Status: StatusOK, Response: "1"}, now, "mailbox")
+	return Response{Status: StatusOK, Response: "1"}
 }
 
-// SendersHandler handles the get command for senders.
-// It fetches the senders for the given email.
-// The response is a comma separated list of senders.
-func (p *PostfixAdapter) SendersHandler(conn net.Conn) {
-	now := time.Now()
-
-	payload, err := p.payload(conn)
+func (p *PostfixAdapter) lookupRecipient(ctx context.Context, logger *log.Entry, email string) Response {
+	exists, err := p.client.GetMailbox(ctx, email)
 	if err != nil {
-		log.WithError(err).Error(ErrPayloadError)
-		p.write(conn, Response{Status: StatusError, Response: ResponsePayloadError}, now, "senders")
-		return
+		logger.WithError(err).WithField("email", email).Error(ErrAPIError)
+		return Response{Status: StatusError, Response: "Error fetching mailbox"}
+	}
+
+	if !exists {
+		aliases, err := p.client.GetAliases(ctx, email)
+		if err != nil {
+			logger.WithError(err).WithField("email", email).Error(ErrAPIError)
+			return Response{Status: StatusError, Response: "Error fetching aliases"}
+		}
+
+		if len(aliases) == 0 {
+			return Response{Status: StatusNoResult, Response: ResponseNoResult}
+		}
 	}
 
-	senders, err := p.client.GetSenders(payload)
+	return Response{Status: StatusOK, Response: "1"}
+}
+
+func (p *PostfixAdapter) lookupSenders(ctx context.Context, logger *log.Entry, email string) Response {
+	senders, err := p.client.GetSenders(ctx, email)
 	if err != nil {
-		log.WithError(err).WithField("email", payload).Error(ErrAPIError)
-		p.write(conn, Response{Status: StatusError, Response: "Error fetching senders"}, now, "senders")
-		return
+		logger.WithError(err).WithField("email", email).Error(ErrAPIError)
+		return Response{Status: StatusError, Response: "Error fetching senders"}
 	}
 
 	if len(senders) == 0 {
-		p.write(conn, Response{Status: StatusNoResult, Response: ResponseNoResult}, now, "senders")
-		return
+		return Response{Status: StatusNoResult, Response: ResponseNoResult}
 	}
 
-	p.write(conn, Response{Status: StatusOK, Response: strings.Join(senders, ",")}, now, "senders")
+	return Response{Status: StatusOK, Response: strings.Join(senders, ",")}
 }
 
 // payload reads the data from the connection. It checks for valid
 // commands sent by postfix and returns the payload.
-func (h *PostfixAdapter) payload(conn net.Conn) (string, error) {
-	data := make([]byte, 4096)
-	_, err := conn.Read(data)
+func (h *PostfixAdapter) payload(conn net.Conn, logger *log.Entry) (string, error) {
+	buf := readBufferPool.Get().(*[]byte)
+	defer readBufferPool.Put(buf)
+
+	n, err := conn.Read(*buf)
 	if err != nil {
 		return "", err
 	}
 
-	data = bytes.Trim(data, "\x00")
-	parts := strings.Split(string(data), " ")
-	if len(parts) < 2 || parts[0] != "get" {
+	data := bytes.Trim((*buf)[:n], "\x00")
+	command, rest, found := bytes.Cut(data, []byte(" "))
+	if !found || string(command) != "get" {
 		return "", errors.New("invalid or unsupported command")
 	}
 
-	payload := strings.TrimSuffix(parts[1], "\n")
+	// Only the first word after the command is the key.
+	key, _, _ := bytes.Cut(rest, []byte(" "))
+	payload := string(bytes.TrimSuffix(key, []byte("\n")))
 
-	log.WithFields(log.Fields{"command": parts[0], "payload": payload}).Debug("Received payload")
+	if logger.Logger.IsLevelEnabled(log.DebugLevel) {
+		logger.WithFields(log.Fields{"command": "get", "payload": payload}).Debug("Received payload")
+	}
 
 	return payload, nil
 }
 
-func (h *PostfixAdapter) write(conn net.Conn, response Response, now time.Time, handler string) {
-	var status string
-	switch response.Status {
-	case StatusOK:
-		status = "success"
-	default:
-		status = "error"
+// watchDisconnect returns a context that is canceled as soon as the
+// connection fails, e.g. because the client reset it, so lookups nobody
+// waits for anymore do not keep querying userli. stop ends the watch and reports whether the client
+// disconnected.
+func watchDisconnect(ctx context.Context, conn net.Conn) (context.Context, func() bool) {
+	// read from the socket itself, the timeouts of the server only apply
+	// to the request
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = c.NetConn()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		closed := errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+		if closed {
+			cancel()
+		}
+		return ctx, func() bool {
+			cancel()
+			return closed
+		}
+	}
+
+	done := make(chan struct{})
+	disconnected := false
+
+	go func() {
+		defer close(done)
+
+		// Postfix sends nothing until it has the response, so a read
+		// error means it is gone. The deadline is set by stop, and EOF may
+		// be a client that only closed its sending side and still waits
+		// for the response.
+		var b [1]byte
+		_, err := conn.Read(b[:])
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, io.EOF) {
+			disconnected = true
+			cancel()
+		}
+	}()
+
+	return ctx, func() bool {
+		_ = conn.SetReadDeadline(time.Now())
+		<-done
+		cancel()
+
+		return disconnected
+	}
+}
+
+// statusLabel returns the metric label for the response status.
+func statusLabel(response Response) string {
+	if response.Status == StatusOK {
+		return "success"
 	}
 
-	log.WithFields(log.Fields{"response": response.String(), "handler": handler, "status": status}).Debug("Writing response")
+	return "error"
+}
+
+// write sends the response and returns the duration of the request.
+func (h *PostfixAdapter) write(conn net.Conn, logger *log.Entry, response Response, now time.Time, handler string) time.Duration {
+	status := statusLabel(response)
 
-	_, err := conn.Write([]byte(response.String()))
+	buf := responseBufferPool.Get().(*bytes.Buffer)
+	defer releaseResponseBuffer(buf)
+	response.encode(buf)
+
+	if logger.Logger.IsLevelEnabled(log.DebugLevel) {
+		logger.WithFields(log.Fields{"response": buf.String(), "handler": handler, "status": status}).Debug("Writing response")
+	}
+
+	_, err := conn.Write(buf.Bytes())
 	if err != nil {
-		log.WithError(err).WithFields(log.Fields{"response": response.String(), "handler": handler, "status": status}).Error("Error writing response")
+		logger.WithError(err).WithFields(log.Fields{"response": buf.String(), "handler": handler, "status": status}).Error("Error writing response")
 	}
-	requestDurations.With(prometheus.Labels{"handler": handler, "status": status}).Observe(time.Since(now).Seconds())
+	duration := time.Since(now)
+	observeRequest(handler, status, duration)
+
+	return duration
 }
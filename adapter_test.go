@@ -11,7 +11,11 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -35,9 +39,9 @@ func (s *AdapterTestSuite) AfterTest(_, _ string) {
 
 func (s *AdapterTestSuite) TestAliasHandler() {
 	userli := new(MockUserliService)
-	userli.On("GetAliases", "alias@example.com").Return([]string{"source1@example.com", "source2.example.com"}, nil)
-	userli.On("GetAliases", "noalias@example.com").Return([]string{}, nil)
-	userli.On("GetAliases", "error@example.com").Return([]string{}, errors.New("error"))
+	userli.On("GetAliases", mock.Anything, "alias@example.com").Return([]string{"source1@example.com", "source2.example.com"}, nil)
+	userli.On("GetAliases", mock.Anything, "noalias@example.com").Return([]string{}, nil)
+	userli.On("GetAliases", mock.Anything, "error@example.com").Return([]string{}, errors.New("error"))
 
 	portNumber, _ := rand.Int(rand.Reader, big.NewInt(65535-20000))
 	portNumber.Add(portNumber, big.NewInt(20000))
@@ -45,7 +49,7 @@ func (s *AdapterTestSuite) TestAliasHandler() {
 
 	adapter := NewPostfixAdapter(userli)
 
-	go StartTCPServer(s.ctx, s.wg, listen, adapter.AliasHandler)
+	go StartTCPServer(s.ctx, s.wg, TCPServerConfig{Addrs: []string{listen}, Handler: adapter.AliasHandler})
 
 	// wait until the server is ready
 	for {
@@ -106,9 +110,9 @@ func (s *AdapterTestSuite) TestAliasHandler() {
 
 func (s *AdapterTestSuite) TestDomainHandler() {
 	userli := new(MockUserliService)
-	userli.On("GetDomain", "example.com").Return(true, nil)
-	userli.On("GetDomain", "notfound.com").Return(false, nil)
-	userli.On("GetDomain", "error.com").Return(false, errors.New("error"))
+	userli.On("GetDomain", mock.Anything, "example.com").Return(true, nil)
+	userli.On("GetDomain", mock.Anything, "notfound.com").Return(false, nil)
+	userli.On("GetDomain", mock.Anything, "error.com").Return(false, errors.New("error"))
 
 	portNumber, _ := rand.Int(rand.Reader, big.NewInt(65535-20000))
 	portNumber.Add(portNumber, big.NewInt(20000))
@@ -116,7 +120,7 @@ func (s *AdapterTestSuite) TestDomainHandler() {
 
 	adapter := NewPostfixAdapter(userli)
 
-	go StartTCPServer(s.ctx, s.wg, listen, adapter.DomainHandler)
+	go StartTCPServer(s.ctx, s.wg, TCPServerConfig{Addrs: []string{listen}, Handler: adapter.DomainHandler})
 
 	// wait until the server is ready
 	for {
@@ -178,9 +182,9 @@ func (s *AdapterTestSuite) TestDomainHandler() {
 
 func (s *AdapterTestSuite) TestMailboxHandler() {
 	userli := new(MockUserliService)
-	userli.On("GetMailbox", "user@example.org").Return(true, nil)
-	userli.On("GetMailbox", "nonexisting@example.org").Return(false, nil)
-	userli.On("GetMailbox", "error@example.org").Return(false, errors.New("error"))
+	userli.On("GetMailbox", mock.Anything, "user@example.org").Return(true, nil)
+	userli.On("GetMailbox", mock.Anything, "nonexisting@example.org").Return(false, nil)
+	userli.On("GetMailbox", mock.Anything, "error@example.org").Return(false, errors.New("error"))
 
 	portNumber, _ := rand.Int(rand.Reader, big.NewInt(65535-20000))
 	portNumber.Add(portNumber, big.NewInt(20000))
@@ -188,7 +192,7 @@ func (s *AdapterTestSuite) TestMailboxHandler() {
 
 	adapter := NewPostfixAdapter(userli)
 
-	go StartTCPServer(s.ctx, s.wg, listen, adapter.MailboxHandler)
+	go StartTCPServer(s.ctx, s.wg, TCPServerConfig{Addrs: []string{listen}, Handler: adapter.MailboxHandler})
 
 	// wait until the server is ready
 	for {
@@ -250,10 +254,10 @@ func (s *AdapterTestSuite) TestMailboxHandler() {
 
 func (s *AdapterTestSuite) TestSendersHandler() {
 	userli := new(MockUserliService)
-	userli.On("GetSenders", "user@example.com").Return([]string{"user@example.com"}, nil)
-	userli.On("GetSenders", "alias@example.com").Return([]string{"user1@example.com", "user2@example.com"}, nil)
-	userli.On("GetSenders", "error@example.com").Return([]string{}, errors.New("error"))
-	userli.On("GetSenders", "nonexisting@example.com").Return([]string{}, nil)
+	userli.On("GetSenders", mock.Anything, "user@example.com").Return([]string{"user@example.com"}, nil)
+	userli.On("GetSenders", mock.Anything, "alias@example.com").Return([]string{"user1@example.com", "user2@example.com"}, nil)
+	userli.On("GetSenders", mock.Anything, "error@example.com").Return([]string{}, errors.New("error"))
+	userli.On("GetSenders", mock.Anything, "nonexisting@example.com").Return([]string{}, nil)
 
 	portNumber, _ := rand.Int(rand.Reader, big.NewInt(65535-20000))
 	portNumber.Add(portNumber, big.NewInt(20000))
@@ -261,7 +265,7 @@ func (s *AdapterTestSuite) TestSendersHandler() {
 
 	adapter := NewPostfixAdapter(userli)
 
-	go StartTCPServer(s.ctx, s.wg, listen, adapter.SendersHandler)
+	go StartTCPServer(s.ctx, s.wg, TCPServerConfig{Addrs: []string{listen}, Handler: adapter.SendersHandler})
 
 	// wait until the server is ready
 	for {
@@ -337,6 +341,308 @@ func (s *AdapterTestSuite) TestSendersHandler() {
 	})
 }
 
+func (s *AdapterTestSuite) TestDisabledMap() {
+	userli := new(MockUserliService)
+
+	portNumber, _ := rand.Int(rand.Reader, big.NewInt(65535-20000))
+	portNumber.Add(portNumber, big.NewInt(20000))
+	listen := ":" + portNumber.String()
+
+	adapter := NewPostfixAdapter(userli)
+	adapter.Use(DisableMaps(map[string]bool{"senders": true}))
+
+	go StartTCPServer(s.ctx, s.wg, TCPServerConfig{Addrs: []string{listen}, Handler: adapter.SendersHandler})
+
+	// wait until the server is ready
+	for {
+		conn, err := net.Dial("tcp", listen)
+		if err == nil {
+			conn.Close()
+			break
+		}
+	}
+
+	conn, err := net.Dial("tcp", listen)
+	s.NoError(err)
+
+	_, err = conn.Write([]byte("get user@example.com"))
+	s.NoError(err)
+
+	response := make([]byte, 4096)
+	_, err = conn.Read(response)
+	s.NoError(err)
+
+	s.Equal("500 MAP%20DISABLED\n", string(bytes.Trim(response, "\x00")))
+	userli.AssertNotCalled(s.T(), "GetSenders", mock.Anything, mock.Anything)
+
+	conn.Close()
+}
+
+func (s *AdapterTestSuite) TestRecipientHandler() {
+	userli := new(MockUserliService)
+	userli.On("GetMailbox", mock.Anything, "user@example.com").Return(true, nil)
+	userli.On("GetMailbox", mock.Anything, mock.Anything).Return(false, nil)
+	userli.On("GetAliases", mock.Anything, "alias@example.com").Return([]string{"user@example.com"}, nil)
+	userli.On("GetAliases", mock.Anything, "unknown@example.com").Return([]string{}, nil)
+	userli.On("GetAliases", mock.Anything, "error@example.com").Return([]string{}, errors.New("error"))
+
+	adapter := NewPostfixAdapter(userli)
+
+	for key, expected := range map[string]string{
+		"user@example.com":    "200 1\n",
+		"alias@example.com":   "200 1\n",
+		"unknown@example.com": "500 NO%20RESULT\n",
+		"error@example.com":   "400 Error%20fetching%20aliases\n",
+	} {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			adapter.RecipientHandler(server)
+		}()
+
+		_, err := client.Write([]byte("get " + key + "\n"))
+		s.NoError(err)
+
+		response, err := io.ReadAll(client)
+		s.NoError(err)
+		s.Equal(expected, string(response), key)
+		client.Close()
+	}
+
+	userli.AssertNotCalled(s.T(), "GetAliases", mock.Anything, "user@example.com")
+}
+
+func (s *AdapterTestSuite) TestDisconnectCancelsLookup() {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	userli := new(MockUserliService)
+	userli.On("GetDomain", mock.Anything, "example.com").Run(func(args mock.Arguments) {
+		close(started)
+		<-args.Get(0).(context.Context).Done()
+		close(canceled)
+	}).Return(false, context.Canceled)
+
+	adapter := NewPostfixAdapter(userli)
+	before := testutil.ToFloat64(abandonedLookups.WithLabelValues("domain"))
+
+	client, server := s.tcpPair()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		adapter.DomainHandler(server)
+	}()
+
+	_, err := client.Write([]byte("get example.com\n"))
+	s.NoError(err)
+	<-started
+	// resets the connection
+	s.NoError(client.SetLinger(0))
+	client.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		s.Fail("lookup was not canceled")
+	}
+	<-done
+
+	s.Equal(before+1, testutil.ToFloat64(abandonedLookups.WithLabelValues("domain")))
+}
+
+func (s *AdapterTestSuite) TestHalfClosedClientGetsResponse() {
+	userli := new(MockUserliService)
+	userli.On("GetDomain", mock.Anything, "example.com").Return(true, nil)
+
+	adapter := NewPostfixAdapter(userli)
+
+	client, server := s.tcpPair()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		adapter.DomainHandler(server)
+	}()
+
+	_, err := client.Write([]byte("get example.com\n"))
+	s.NoError(err)
+	s.NoError(client.CloseWrite())
+
+	s.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+	response, err := io.ReadAll(client)
+	s.NoError(err)
+	s.Equal("200 1\n", string(response))
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func (s *AdapterTestSuite) tcpPair() (*net.TCPConn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	s.Require().NoError(err)
+	server, err := listener.Accept()
+	s.Require().NoError(err)
+
+	return client.(*net.TCPConn), server
+}
+
+func (s *AdapterTestSuite) TestAliasExpansionThreshold() {
+	userli := new(MockUserliService)
+	userli.On("GetAliases", mock.Anything, "small@example.com").Return([]string{"a@example.com", "b@example.com"}, nil)
+	userli.On("GetAliases", mock.Anything, "large@example.com").Return([]string{"a@example.com", "b@example.com", "c@example.com"}, nil)
+
+	adapter := NewPostfixAdapter(userli)
+	adapter.AliasExpansionThreshold = 2
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	before := testutil.ToFloat64(largeAliasExpansions)
+
+	s.Equal(StatusOK, adapter.lookupAlias(s.ctx, logger, "small@example.com").Status)
+	s.Equal(before, testutil.ToFloat64(largeAliasExpansions))
+
+	s.Equal(StatusOK, adapter.lookupAlias(s.ctx, logger, "large@example.com").Status)
+	s.Equal(before+1, testutil.ToFloat64(largeAliasExpansions))
+}
+
+func (s *AdapterTestSuite) TestChaos() {
+	userli := new(MockUserliService)
+	adapter := NewPostfixAdapter(userli)
+
+	for _, tc := range []struct {
+		settings ChaosSettings
+		response string
+	}{
+		{ChaosSettings{ErrorRate: 1}, "400 CHAOS\n"},
+		{ChaosSettings{MalformedRate: 1}, "chaos\n"},
+		{ChaosSettings{DropRate: 1}, ""},
+	} {
+		adapter.Chaos = NewChaos(tc.settings)
+
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			adapter.DomainHandler(server)
+		}()
+
+		_, err := client.Write([]byte("get example.com\n"))
+		s.NoError(err)
+
+		response, err := io.ReadAll(client)
+		s.NoError(err)
+		s.Equal(tc.response, string(response))
+		client.Close()
+	}
+
+	userli.AssertNotCalled(s.T(), "GetDomain", mock.Anything, mock.Anything)
+}
+
+func (s *AdapterTestSuite) TestWriteDoesNotAllocate() {
+	adapter := NewPostfixAdapter(new(MockUserliService))
+	conn := &benchConn{}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	response := Response{Status: StatusOK, Response: "source1@example.com,source2@example.com"}
+	now := time.Now()
+
+	s.Zero(testing.AllocsPerRun(100, func() {
+		adapter.write(conn, logger, response, now, "alias")
+	}))
+}
+
+func (s *AdapterTestSuite) TestShedDoesNotAllocate() {
+	adapter := NewPostfixAdapter(new(MockUserliService))
+	conn := &benchConn{}
+
+	s.Zero(testing.AllocsPerRun(100, func() {
+		adapter.Shed("alias", conn)
+	}))
+}
+
+func (s *AdapterTestSuite) TestStatusString() {
+	s.Equal("200", StatusOK.String())
+	s.Equal("400", StatusError.String())
+	s.Equal("500", StatusNoResult.String())
+	s.Equal("421", Status(421).String())
+}
+
 func TestAdapterTestSuite(t *testing.T) {
 	suite.Run(t, new(AdapterTestSuite))
 }
+
+// benchConn is a net.Conn that serves a fixed request and discards writes.
+type benchConn struct {
+	net.Conn
+	request []byte
+}
+
+func (c *benchConn) Read(b []byte) (int, error) { return copy(b, c.request), nil }
+
+func (c *benchConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func (c *benchConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *benchConn) SetReadDeadline(time.Time) error { return nil }
+
+func BenchmarkPayload(b *testing.B) {
+	adapter := NewPostfixAdapter(new(MockUserliService))
+	conn := &benchConn{request: []byte("get user@example.com\n")}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := adapter.payload(conn, logger); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	adapter := NewPostfixAdapter(new(MockUserliService))
+	conn := &benchConn{}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	response := Response{Status: StatusOK, Response: "source1@example.com,source2@example.com"}
+	now := time.Now()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		adapter.write(conn, logger, response, now, "alias")
+	}
+}
+
+func BenchmarkResponseString(b *testing.B) {
+	response := Response{Status: StatusNoResult, Response: ResponseNoResult}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = response.String()
+	}
+}
+
+func BenchmarkHandle(b *testing.B) {
+	adapter := NewPostfixAdapter(NewStaticUserli(&MockUserliFixtures{
+		Aliases: map[string][]string{"alias@example.org": {"source1@example.org", "source2@example.org"}},
+	}))
+	conn := &benchConn{request: []byte("get alias@example.org\n")}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		adapter.handle(conn, "alias", adapter.lookupAlias)
+	}
+}
+
+func BenchmarkHandleMiddlewares(b *testing.B) {
+	adapter := NewPostfixAdapter(NewStaticUserli(&MockUserliFixtures{
+		Aliases: map[string][]string{"alias@example.org": {"source1@example.org", "source2@example.org"}},
+	}))
+	adapter.Use(
+		DisableMaps(map[string]bool{"senders": true}),
+		WildcardDomains([]string{"*.example.net"}),
+		ManagedDomains([]string{"example.org"}),
+		BreakAliasLoops(NewAliasLoops(100)),
+	)
+	conn := &benchConn{request: []byte("get alias@example.org\n")}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		adapter.handle(conn, "alias", adapter.lookupAlias)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConnectionsReport is the response of the connections endpoint.
+type ConnectionsReport struct {
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+// registerAdmin adds the admin endpoints for config, servers, chaos and
+// maintenance to mux, each wrapped with guard for its scope.
+func registerAdmin(mux *http.ServeMux, config *Config, servers []*TCPServer, chaos *Chaos, maintenance *Maintenance, guard func(scope string, handler http.Handler) http.Handler) {
+	if config != nil {
+		mux.Handle("GET /admin/config", guard(adminScopeConfigRead, configHandler(config, chaos)))
+	}
+
+	if len(servers) > 0 {
+		mux.Handle("GET /admin/connections", guard(adminScopeConnectionsRead, connectionsHandler(servers)))
+		mux.Handle("DELETE /admin/connections/{id}", guard(adminScopeConnectionsWrite, closeConnectionHandler(servers)))
+	}
+
+	if chaos != nil {
+		mux.Handle("GET /admin/chaos", guard(adminScopeChaosRead, chaosHandler(chaos)))
+		mux.Handle("PUT /admin/chaos", guard(adminScopeChaosWrite, setChaosHandler(chaos)))
+	}
+
+	if maintenance != nil {
+		mux.Handle("GET /admin/maintenance", guard(adminScopeMaintenanceRead, maintenanceHandler(maintenance)))
+		mux.Handle("PUT /admin/maintenance/{map}", guard(adminScopeMaintenanceWrite, startMaintenanceHandler(maintenance)))
+		mux.Handle("DELETE /admin/maintenance/{map}", guard(adminScopeMaintenanceWrite, stopMaintenanceHandler(maintenance)))
+	}
+}
+
+// configHandler returns the effective configuration with the secrets
+// redacted. The chaos settings changed at runtime replace the configured
+// ones.
+func configHandler(config *Config, chaos *Chaos) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		fields := config.Redacted()
+		if chaos != nil {
+			fields["chaos"] = chaos.Settings()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(fields)
+	}
+}
+
+// connectionsHandler lists the active connections of all servers.
+func connectionsHandler(servers []*TCPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		report := ConnectionsReport{Connections: []ConnectionInfo{}}
+		for _, server := range servers {
+			report.Connections = append(report.Connections, server.Connections()...)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
+
+// closeConnectionHandler closes the connection with the id from the path.
+func closeConnectionHandler(servers []*TCPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+
+		for _, server := range servers {
+			if server.CloseConnection(id) {
+				log.WithFields(log.Fields{"connection": id, "server": server.config.Name, "remote_addr": r.RemoteAddr}).Info("Connection closed by admin")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		http.Error(w, "connection not found", http.StatusNotFound)
+	}
+}
+
+// chaosHandler returns the current chaos settings.
+func chaosHandler(chaos *Chaos) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(chaos.Settings())
+	}
+}
+
+// setChaosHandler replaces the chaos settings with the ones from the
+// request body.
+func setChaosHandler(chaos *Chaos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var settings ChaosSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "invalid chaos settings", http.StatusBadRequest)
+			return
+		}
+
+		if err := chaos.SetSettings(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.WithFields(log.Fields{"settings": settings, "remote_addr": r.RemoteAddr}).Warn("Chaos settings changed by admin")
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(settings)
+	}
+}
+
+// MaintenanceRequest is the body of the request starting a maintenance.
+type MaintenanceRequest struct {
+	Mode     string `json:"mode"`
+	Duration string `json:"duration"`
+}
+
+// maintenanceHandler returns the current maintenance windows by map.
+func maintenanceHandler(maintenance *Maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(maintenance.Windows())
+	}
+}
+
+// startMaintenanceHandler puts the map from the path in maintenance.
+func startMaintenanceHandler(maintenance *Maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request MaintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid maintenance request", http.StatusBadRequest)
+			return
+		}
+
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+
+		window, err := maintenance.Start(r.PathValue("map"), request.Mode, duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.WithFields(log.Fields{"map": r.PathValue("map"), "mode": window.Mode, "until": window.Until, "remote_addr": r.RemoteAddr}).Warn("Maintenance started by admin")
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(window)
+	}
+}
+
+// stopMaintenanceHandler ends the maintenance of the map from the path.
+func stopMaintenanceHandler(maintenance *Maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !maintenance.Stop(r.PathValue("map")) {
+			http.Error(w, "map is not in maintenance", http.StatusNotFound)
+			return
+		}
+
+		log.WithFields(log.Fields{"map": r.PathValue("map"), "remote_addr": r.RemoteAddr}).Warn("Maintenance stopped by admin")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
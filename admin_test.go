@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type AdminTestSuite struct {
+	suite.Suite
+}
+
+func (s *AdminTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *AdminTestSuite) TestConnections() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := NewTCPServer(ctx, TCPServerConfig{
+		Name:  "alias",
+		Addrs: []string{"127.0.0.1:0"},
+		Handler: func(conn net.Conn) {
+			buf := make([]byte, 64)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte("200 1\n"))
+			}
+		},
+	})
+	s.Require().NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+	defer wg.Wait()
+	defer cancel()
+
+	conn, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	s.Require().NoError(err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("get alias@example.org\n"))
+	s.Require().NoError(err)
+	_, err = conn.Read(make([]byte, 64))
+	s.Require().NoError(err)
+
+	mux := http.NewServeMux()
+	registerAdmin(mux, nil, []*TCPServer{server}, nil, nil, func(_ string, handler http.Handler) http.Handler { return handler })
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/connections", nil))
+	s.Equal(http.StatusOK, rec.Code)
+
+	var report ConnectionsReport
+	s.Require().NoError(json.NewDecoder(rec.Body).Decode(&report))
+	s.Require().Len(report.Connections, 1)
+
+	info := report.Connections[0]
+	s.Equal("alias", info.Server)
+	s.Equal(server.listeners[0].Addr().String(), info.Listener)
+	s.Equal(conn.LocalAddr().String(), info.RemoteAddr)
+	s.Equal(int64(1), info.Requests)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/connections/0", nil))
+	s.Equal(http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/connections/"+info.ID, nil))
+	s.Equal(http.StatusNoContent, rec.Code)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	s.Error(err)
+
+	s.Eventually(func() bool {
+		return len(server.Connections()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (s *AdminTestSuite) TestRequiresAuth() {
+	servers := []*TCPServer{{conns: make(map[uint64]*trackedConn)}}
+
+	rec := httptest.NewRecorder()
+	newMetricsMux(MetricsServerConfig{Servers: servers}).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/connections", nil))
+	s.Equal(http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	newMetricsMux(MetricsServerConfig{Servers: servers, Auth: HTTPAuth{Token: "secret"}}).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/connections", nil))
+	s.Equal(http.StatusUnauthorized, rec.Code)
+
+	req := httptest.NewRequest("GET", "/admin/connections", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	newMetricsMux(MetricsServerConfig{Servers: servers, Auth: HTTPAuth{Token: "secret"}}).ServeHTTP(rec, req)
+	s.Equal(http.StatusOK, rec.Code)
+}
+
+func (s *AdminTestSuite) TestConfig() {
+	config := &Config{UserliToken: "s3cr3t-token", ChaosEnabled: true, Chaos: ChaosSettings{ErrorRate: 0.1}}
+	chaos := NewChaos(config.Chaos)
+	s.Require().NoError(chaos.SetSettings(ChaosSettings{ErrorRate: 0.2}))
+
+	mux := http.NewServeMux()
+	registerAdmin(mux, config, nil, chaos, nil, func(_ string, handler http.Handler) http.Handler { return handler })
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/config", nil))
+	s.Equal(http.StatusOK, rec.Code)
+	s.NotContains(rec.Body.String(), "s3cr3t-token")
+
+	var fields struct {
+		UserliToken string        `json:"userli_token"`
+		Chaos       ChaosSettings `json:"chaos"`
+	}
+	s.Require().NoError(json.NewDecoder(rec.Body).Decode(&fields))
+	s.Equal(redactedValue, fields.UserliToken)
+	s.Equal(ChaosSettings{ErrorRate: 0.2}, fields.Chaos)
+}
+
+func (s *AdminTestSuite) TestChaos() {
+	chaos := NewChaos(ChaosSettings{})
+
+	mux := http.NewServeMux()
+	registerAdmin(mux, nil, nil, chaos, nil, func(_ string, handler http.Handler) http.Handler { return handler })
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/chaos", strings.NewReader(`{"latency_ms":100,"latency_rate":0.5,"error_rate":0.1}`)))
+	s.Equal(http.StatusOK, rec.Code)
+	s.Equal(ChaosSettings{LatencyMS: 100, LatencyRate: 0.5, ErrorRate: 0.1}, chaos.Settings())
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/chaos", strings.NewReader(`{"error_rate":0.6,"drop_rate":0.6}`)))
+	s.Equal(http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/chaos", nil))
+	s.Equal(http.StatusOK, rec.Code)
+
+	var settings ChaosSettings
+	s.Require().NoError(json.NewDecoder(rec.Body).Decode(&settings))
+	s.Equal(chaos.Settings(), settings)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/connections", nil))
+	s.Equal(http.StatusNotFound, rec.Code)
+}
+
+func (s *AdminTestSuite) TestMaintenance() {
+	maintenance := NewMaintenance([]string{"alias"})
+
+	mux := http.NewServeMux()
+	registerAdmin(mux, nil, nil, nil, maintenance, func(_ string, handler http.Handler) http.Handler { return handler })
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/maintenance/alias", strings.NewReader(`{"mode":"tempfail","duration":"30m"}`)))
+	s.Equal(http.StatusOK, rec.Code)
+	s.Equal(MaintenanceModeTempfail, maintenance.Mode("alias"))
+
+	for _, body := range []string{`{"mode":"tempfail","duration":"soon"}`, `{"mode":"cached","duration":"30m"}`, `{`} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/maintenance/alias", strings.NewReader(body)))
+		s.Equal(http.StatusBadRequest, rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/maintenance/unknown", strings.NewReader(`{"mode":"tempfail","duration":"30m"}`)))
+	s.Equal(http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/maintenance", nil))
+	s.Equal(http.StatusOK, rec.Code)
+
+	var windows map[string]MaintenanceWindow
+	s.Require().NoError(json.NewDecoder(rec.Body).Decode(&windows))
+	s.Equal(MaintenanceModeTempfail, windows["alias"].Mode)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/maintenance/alias", nil))
+	s.Equal(http.StatusNoContent, rec.Code)
+	s.Empty(maintenance.Mode("alias"))
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/maintenance/alias", nil))
+	s.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestAdmin(t *testing.T) {
+	suite.Run(t, new(AdminTestSuite))
+}
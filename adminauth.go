@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Scopes of the admin endpoints. An admin token with adminScopeAll may
+// access every endpoint.
+const (
+	adminScopeAll              = "*"
+	adminScopeConfigRead       = "config:read"
+	adminScopeConnectionsRead  = "connections:read"
+	adminScopeConnectionsWrite = "connections:write"
+	adminScopeChaosRead        = "chaos:read"
+	adminScopeChaosWrite       = "chaos:write"
+	adminScopeMaintenanceRead  = "maintenance:read"
+	adminScopeMaintenanceWrite = "maintenance:write"
+)
+
+// AdminToken is a bearer token granting access to the admin endpoints of
+// its scopes.
+type AdminToken struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// AdminTokens are the tokens for the admin endpoints.
+type AdminTokens []AdminToken
+
+// Redacted returns the tokens with the secrets replaced.
+func (t AdminTokens) Redacted() any {
+	redacted := make([]AdminToken, len(t))
+	for i, token := range t {
+		token.Token = redactedValue
+		redacted[i] = token
+	}
+
+	return redacted
+}
+
+// authorize returns the name of the token of the request if it grants
+// scope.
+func (t AdminTokens) authorize(r *http.Request, scope string) (string, bool) {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+
+	for _, token := range t {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token.Token)) != 1 {
+			continue
+		}
+
+		return token.Name, slices.Contains(token.Scopes, scope) || slices.Contains(token.Scopes, adminScopeAll)
+	}
+
+	return "", false
+}
+
+// restrictAdmin wraps an admin handler for scope. With admin tokens, only
+// a token granting scope is accepted. Otherwise auth applies like for
+// /metrics. The networks of auth are enforced either way, and every
+// request changing state is written to the audit log.
+func restrictAdmin(handler http.Handler, scope string, auth HTTPAuth, tokens AdminTokens) http.Handler {
+	if len(tokens) == 0 {
+		return restrict(audit(handler, scope, "metrics"), auth)
+	}
+
+	return restrict(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := tokens.authorize(r, scope)
+		if !ok {
+			if name != "" {
+				log.WithFields(log.Fields{"admin": name, "scope": scope, "method": r.Method, "path": r.URL.Path, "remote_addr": r.RemoteAddr}).Warn("Admin token lacks scope")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		audit(handler, scope, name).ServeHTTP(w, r)
+	}), HTTPAuth{AllowedNets: auth.AllowedNets})
+}
+
+// audit logs the requests to handler that change state with the name of
+// the admin and the response status.
+func audit(handler http.Handler, scope, admin string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		log.WithFields(log.Fields{
+			"admin":       admin,
+			"scope":       scope,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"remote_addr": r.RemoteAddr,
+			"status":      recorder.status,
+		}).Info("Admin action")
+	})
+}
+
+// statusRecorder remembers the status written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/suite"
+)
+
+type AdminAuthTestSuite struct {
+	suite.Suite
+
+	mux  *http.ServeMux
+	hook *test.Hook
+}
+
+func (s *AdminAuthTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+	s.hook = test.NewGlobal()
+
+	s.mux = newMetricsMux(MetricsServerConfig{
+		Chaos: NewChaos(ChaosSettings{}),
+		Auth:  HTTPAuth{Token: "metrics", AllowedNets: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}},
+		AdminTokens: AdminTokens{
+			{Name: "oncall", Token: "oncall-secret", Scopes: []string{adminScopeChaosRead}},
+			{Name: "ops", Token: "ops-secret", Scopes: []string{adminScopeAll}},
+		},
+	})
+}
+
+func (s *AdminAuthTestSuite) TearDownTest() {
+	s.hook.Reset()
+}
+
+func (s *AdminAuthTestSuite) request(method, token string) int {
+	req := httptest.NewRequest(method, "/admin/chaos", strings.NewReader(`{"error_rate":0.1}`))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+func (s *AdminAuthTestSuite) TestScopes() {
+	s.Equal(http.StatusUnauthorized, s.request("GET", ""))
+	s.Equal(http.StatusUnauthorized, s.request("GET", "metrics"))
+	s.Equal(http.StatusOK, s.request("GET", "oncall-secret"))
+	s.Equal(http.StatusForbidden, s.request("PUT", "oncall-secret"))
+	s.Equal(http.StatusOK, s.request("PUT", "ops-secret"))
+
+	req := httptest.NewRequest("GET", "/admin/chaos", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("Authorization", "Bearer ops-secret")
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+	s.Equal(http.StatusForbidden, rec.Code)
+}
+
+func (s *AdminAuthTestSuite) TestAudit() {
+	s.Equal(http.StatusOK, s.request("GET", "ops-secret"))
+	s.Equal(http.StatusOK, s.request("PUT", "ops-secret"))
+
+	var actions []*log.Entry
+	for _, entry := range s.hook.AllEntries() {
+		if entry.Message == "Admin action" {
+			actions = append(actions, entry)
+		}
+	}
+
+	s.Require().Len(actions, 1)
+	s.Equal("ops", actions[0].Data["admin"])
+	s.Equal(adminScopeChaosWrite, actions[0].Data["scope"])
+	s.Equal(http.StatusOK, actions[0].Data["status"])
+}
+
+func (s *AdminAuthTestSuite) TestRedacted() {
+	config := &Config{AdminTokens: AdminTokens{{Name: "ops", Token: "ops-secret", Scopes: []string{adminScopeAll}}}}
+
+	tokens := config.Redacted()["admin_tokens"].([]AdminToken)
+	s.Equal(redactedValue, tokens[0].Token)
+	s.Equal("ops", tokens[0].Name)
+}
+
+func TestAdminAuth(t *testing.T) {
+	suite.Run(t, new(AdminAuthTestSuite))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// aliasLoopMaxDepth limits the aliases followed to find a loop.
+const aliasLoopMaxDepth = 100
+
+// AliasLoops remembers the recently fetched aliases to detect loops like
+// a -> b -> a, which Postfix only notices once the recursion limit is hit
+// and then defers the mail.
+type AliasLoops struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	aliases map[string][]string
+}
+
+// NewAliasLoops remembers the destinations of up to maxEntries aliases.
+func NewAliasLoops(maxEntries int) *AliasLoops {
+	return &AliasLoops{maxEntries: maxEntries, aliases: make(map[string][]string)}
+}
+
+// Check remembers the destinations of key and returns the loops through
+// key by the destination they start with. Addresses are compared
+// case-insensitively and an alias pointing to itself is not a loop.
+func (l *AliasLoops) Check(key string, destinations []string) map[string][]string {
+	key = strings.ToLower(key)
+	normalized := make([]string, len(destinations))
+	for i, destination := range destinations {
+		normalized[i] = strings.ToLower(destination)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.aliases[key]; !ok && len(l.aliases) >= l.maxEntries {
+		for evict := range l.aliases {
+			delete(l.aliases, evict)
+			break
+		}
+	}
+	l.aliases[key] = normalized
+
+	var loops map[string][]string
+	for i, destination := range normalized {
+		if destination == key {
+			continue
+		}
+
+		if path := l.path(destination, key, map[string]bool{}, 0); path != nil {
+			if loops == nil {
+				loops = make(map[string][]string)
+			}
+			loops[destinations[i]] = append([]string{key}, path...)
+		}
+	}
+
+	return loops
+}
+
+// path returns the aliases leading from from to to, including both.
+func (l *AliasLoops) path(from, to string, visited map[string]bool, depth int) []string {
+	if from == to {
+		return []string{to}
+	}
+	if visited[from] || depth >= aliasLoopMaxDepth {
+		return nil
+	}
+	visited[from] = true
+
+	for _, next := range l.aliases[from] {
+		if next == from {
+			continue
+		}
+		if path := l.path(next, to, visited, depth+1); path != nil {
+			return append([]string{from}, path...)
+		}
+	}
+
+	return nil
+}
+
+// breakAliasLoops removes the destinations starting a loop.
+func breakAliasLoops(destinations []string, loops map[string][]string) []string {
+	return slices.DeleteFunc(slices.Clone(destinations), func(destination string) bool {
+		_, ok := loops[destination]
+		return ok
+	})
+}
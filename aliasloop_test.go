@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AliasLoopsTestSuite struct {
+	suite.Suite
+}
+
+func (s *AliasLoopsTestSuite) TestCheck() {
+	loops := NewAliasLoops(10)
+
+	s.Nil(loops.Check("a@example.com", []string{"b@example.com", "a@example.com"}))
+	s.Nil(loops.Check("b@example.com", []string{"c@example.com"}))
+
+	found := loops.Check("c@example.com", []string{"A@example.com", "d@example.com"})
+	s.Equal(map[string][]string{"A@example.com": {"c@example.com", "a@example.com", "b@example.com", "c@example.com"}}, found)
+	s.Equal([]string{"d@example.com"}, breakAliasLoops([]string{"A@example.com", "d@example.com"}, found))
+}
+
+func (s *AliasLoopsTestSuite) TestSelfReference() {
+	loops := NewAliasLoops(10)
+
+	s.Nil(loops.Check("a@example.com", []string{"a@example.com"}))
+	s.Nil(loops.Check("a@example.com", []string{"a@example.com"}))
+}
+
+func (s *AliasLoopsTestSuite) TestMaxEntries() {
+	loops := NewAliasLoops(1)
+
+	loops.Check("a@example.com", []string{"b@example.com"})
+	loops.Check("c@example.com", []string{"d@example.com"})
+
+	s.Len(loops.aliases, 1)
+	s.Nil(loops.Check("b@example.com", []string{"a@example.com"}))
+}
+
+func TestAliasLoops(t *testing.T) {
+	suite.Run(t, new(AliasLoopsTestSuite))
+}
+
+func BenchmarkAliasLoopsCheck(b *testing.B) {
+	loops := NewAliasLoops(100)
+	loops.Check("b@example.com", []string{"c@example.com"})
+	loops.Check("c@example.com", []string{"d@example.com"})
+	destinations := []string{"b@example.com", "e@example.com"}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		loops.Check("a@example.com", destinations)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	chaosFaultNone chaosFault = iota
+	chaosFaultError
+	chaosFaultDrop
+	chaosFaultMalformed
+
+	// ResponseChaos is the temporary error injected by the chaos mode.
+	ResponseChaos = "CHAOS"
+
+	// chaosMalformedResponse is written instead of a valid response.
+	chaosMalformedResponse = "chaos\n"
+)
+
+// chaosFault is a fault injected into a single lookup.
+type chaosFault int
+
+// String returns the metric label of the fault.
+func (f chaosFault) String() string {
+	switch f {
+	case chaosFaultError:
+		return "error"
+	case chaosFaultDrop:
+		return "drop"
+	case chaosFaultMalformed:
+		return "malformed"
+	default:
+		return "none"
+	}
+}
+
+// ChaosSettings are the faults injected into lookups. The rates are the
+// share of lookups between 0 and 1 that get the fault. A lookup gets at
+// most one of error, drop and malformed, with or without latency.
+type ChaosSettings struct {
+	// LatencyMS is the latency in milliseconds added to a lookup.
+	LatencyMS   int     `json:"latency_ms"`
+	LatencyRate float64 `json:"latency_rate"`
+
+	// ErrorRate is the share of lookups answered with a temporary error.
+	ErrorRate float64 `json:"error_rate"`
+
+	// DropRate is the share of connections closed without a response.
+	DropRate float64 `json:"drop_rate"`
+
+	// MalformedRate is the share of lookups answered with a response
+	// Postfix can not parse.
+	MalformedRate float64 `json:"malformed_rate"`
+}
+
+// Validate checks that the rates are between 0 and 1 and that the rates
+// of the exclusive faults add up to at most 1.
+func (s ChaosSettings) Validate() error {
+	if s.LatencyMS < 0 {
+		return errors.New("latency must not be negative")
+	}
+
+	for _, rate := range []float64{s.LatencyRate, s.ErrorRate, s.DropRate, s.MalformedRate} {
+		if rate < 0 || rate > 1 {
+			return errors.New("rates must be between 0 and 1")
+		}
+	}
+
+	if s.ErrorRate+s.DropRate+s.MalformedRate > 1 {
+		return errors.New("error, drop and malformed rates must add up to at most 1")
+	}
+
+	return nil
+}
+
+// Chaos injects faults into lookups to test the behavior of Postfix if
+// the adapter fails. It must never be enabled in production.
+type Chaos struct {
+	mu       sync.RWMutex
+	settings ChaosSettings
+
+	// random returns a number in [0, 1).
+	random func() float64
+}
+
+// NewChaos returns a Chaos injecting faults with the settings.
+func NewChaos(settings ChaosSettings) *Chaos {
+	return &Chaos{settings: settings, random: rand.Float64}
+}
+
+// Settings returns the current settings.
+func (c *Chaos) Settings() ChaosSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.settings
+}
+
+// SetSettings replaces the settings if they are valid.
+func (c *Chaos) SetSettings(settings ChaosSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.settings = settings
+
+	return nil
+}
+
+// inject picks the latency and fault for a lookup of handler. It is safe
+// to call on a nil Chaos.
+func (c *Chaos) inject(handler string) (time.Duration, chaosFault) {
+	if c == nil {
+		return 0, chaosFaultNone
+	}
+
+	settings := c.Settings()
+
+	var latency time.Duration
+	if settings.LatencyMS > 0 && c.random() < settings.LatencyRate {
+		latency = time.Duration(settings.LatencyMS) * time.Millisecond
+		addCounter(chaosFaults.WithLabelValues(handler, "latency"), "chaos_faults", 1, map[string]string{"handler": handler, "fault": "latency"})
+	}
+
+	fault := chaosFaultNone
+	switch r := c.random(); {
+	case r < settings.ErrorRate:
+		fault = chaosFaultError
+	case r < settings.ErrorRate+settings.DropRate:
+		fault = chaosFaultDrop
+	case r < settings.ErrorRate+settings.DropRate+settings.MalformedRate:
+		fault = chaosFaultMalformed
+	}
+	if fault != chaosFaultNone {
+		name := fault.String()
+		addCounter(chaosFaults.WithLabelValues(handler, name), "chaos_faults", 1, map[string]string{"handler": handler, "fault": name})
+	}
+
+	return latency, fault
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ChaosTestSuite struct {
+	suite.Suite
+}
+
+func (s *ChaosTestSuite) TestInject() {
+	s.Run("nil chaos", func() {
+		var chaos *Chaos
+
+		latency, fault := chaos.inject("alias")
+		s.Zero(latency)
+		s.Equal(chaosFaultNone, fault)
+	})
+
+	chaos := NewChaos(ChaosSettings{LatencyMS: 50, LatencyRate: 0.5, ErrorRate: 0.2, DropRate: 0.2, MalformedRate: 0.2})
+
+	for _, tc := range []struct {
+		random  float64
+		latency time.Duration
+		fault   chaosFault
+	}{
+		{0.1, 50 * time.Millisecond, chaosFaultError},
+		{0.3, 50 * time.Millisecond, chaosFaultDrop},
+		{0.5, 0, chaosFaultMalformed},
+		{0.7, 0, chaosFaultNone},
+	} {
+		chaos.random = func() float64 { return tc.random }
+
+		latency, fault := chaos.inject("alias")
+		s.Equal(tc.latency, latency)
+		s.Equal(tc.fault, fault)
+	}
+}
+
+func (s *ChaosTestSuite) TestValidate() {
+	s.NoError(ChaosSettings{}.Validate())
+	s.NoError(ChaosSettings{LatencyMS: 100, LatencyRate: 1, ErrorRate: 0.5, DropRate: 0.5}.Validate())
+	s.Error(ChaosSettings{LatencyMS: -1}.Validate())
+	s.Error(ChaosSettings{LatencyRate: 1.5}.Validate())
+	s.Error(ChaosSettings{ErrorRate: 0.5, DropRate: 0.3, MalformedRate: 0.3}.Validate())
+}
+
+func TestChaos(t *testing.T) {
+	suite.Run(t, new(ChaosTestSuite))
+}
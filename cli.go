@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// lookupHandlers returns the handlers of the lookup servers by map name.
+func lookupHandlers(adapter *PostfixAdapter) map[string]func(net.Conn) {
+	return map[string]func(net.Conn){
+		"alias":     adapter.AliasHandler,
+		"domain":    adapter.DomainHandler,
+		"mailbox":   adapter.MailboxHandler,
+		"senders":   adapter.SendersHandler,
+		"recipient": adapter.RecipientHandler,
+	}
+}
+
+// runLookup resolves key in the map with the handler of the lookup server
+// and writes the response as Postfix receives it to out. Like postmap -q,
+// it returns 0 if the key was found, 1 if not and 2 on errors.
+func runLookup(adapter *PostfixAdapter, args []string, out io.Writer) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: userli-postfix-adapter lookup <map> <key>")
+		return 2
+	}
+
+	handler, ok := lookupHandlers(adapter)[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown map %q, expected one of alias, domain, mailbox, senders, recipient\n", args[0])
+		return 2
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		handler(server)
+	}()
+
+	if _, err := fmt.Fprintf(client, "get %s\n", args[1]); err != nil {
+		fmt.Fprintf(os.Stderr, "error sending request: %v\n", err)
+		return 2
+	}
+
+	response, err := io.ReadAll(client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading response: %v\n", err)
+		return 2
+	}
+
+	_, _ = out.Write(response)
+
+	switch {
+	case bytes.HasPrefix(response, []byte(fmt.Sprintf("%d ", StatusOK))):
+		return 0
+	case bytes.HasPrefix(response, []byte(fmt.Sprintf("%d ", StatusNoResult))):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// runHealthcheck checks the health endpoint of the local metrics server
+// and optionally sends a lookup to the local lookup server of a map. It
+// returns 0 if all checks succeed and 1 otherwise.
+func runHealthcheck(config *Config, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	path := flags.String("path", "/livez", "Health endpoint to check")
+	probe := flags.String("probe", "", "Map whose lookup server is probed with a lookup (alias, domain, mailbox, senders or recipient)")
+	timeout := flags.Duration("timeout", 5*time.Second, "Timeout of each check")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if config.MetricsEnabled {
+		if err := checkHealthEndpoint(ctx, "http://"+loopbackAddr(config.MetricsListenAddr)+*path); err != nil {
+			fmt.Fprintf(out, "%s: %v\n", *path, err)
+			return 1
+		}
+	} else if *probe == "" {
+		fmt.Fprintln(out, "metrics server is disabled, use -probe to check a lookup server")
+		return 1
+	}
+
+	if *probe != "" {
+		addrs, ok := map[string][]string{
+			"alias":     config.AliasListenAddrs,
+			"domain":    config.DomainListenAddrs,
+			"mailbox":   config.MailboxListenAddrs,
+			"senders":   config.SendersListenAddrs,
+			"recipient": config.RecipientListenAddrs,
+		}[*probe]
+		if !ok {
+			fmt.Fprintf(out, "unknown map %q\n", *probe)
+			return 1
+		}
+		if len(addrs) == 0 {
+			fmt.Fprintf(out, "%s lookup server is not enabled\n", *probe)
+			return 1
+		}
+
+		// temporary errors of the userli API are not a failure of the lookup server
+		if _, err := sendLookup(ctx, loopbackAddr(addrs[0]), config.HealthCheckKey); err != nil {
+			fmt.Fprintf(out, "%s lookup: %v\n", *probe, err)
+			return 1
+		}
+	}
+
+	fmt.Fprintln(out, "ok")
+	return 0
+}
+
+// checkHealthEndpoint requests url and fails unless it responds with 200.
+func checkHealthEndpoint(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// sendLookup sends a lookup of key to the lookup server at addr and
+// returns the status of the response. It fails unless a well-formed
+// response is received.
+func sendLookup(ctx context.Context, addr, key string) (Status, error) {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return lookupStatus(conn, key)
+}
+
+// lookupStatus sends a lookup of key on conn and returns the status of
+// the response.
+func lookupStatus(conn net.Conn, key string) (Status, error) {
+	line, err := send(conn, "get "+key+"\n")
+	if err != nil {
+		return 0, err
+	}
+
+	var status Status
+	if _, err := fmt.Sscanf(line, "%d ", &status); err != nil {
+		return 0, fmt.Errorf("malformed response %q", line)
+	}
+
+	return status, nil
+}
+
+// loopbackAddr replaces an unspecified host in addr with the loopback
+// address, so a listen address can be dialed locally.
+func loopbackAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type CLITestSuite struct {
+	suite.Suite
+}
+
+func (s *CLITestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *CLITestSuite) TestRunLookup() {
+	userli := new(MockUserliService)
+	userli.On("GetAliases", mock.Anything, "alias@example.com").Return([]string{"user@example.com", "other@example.com"}, nil)
+	userli.On("GetAliases", mock.Anything, "none@example.com").Return([]string{}, nil)
+	userli.On("GetDomain", mock.Anything, "example.com").Return(false, errors.New("error"))
+
+	adapter := NewPostfixAdapter(userli)
+
+	s.Run("found", func() {
+		var out bytes.Buffer
+		s.Equal(0, runLookup(adapter, []string{"alias", "alias@example.com"}, &out))
+		s.Equal("200 user@example.com,other@example.com\n", out.String())
+	})
+
+	s.Run("not found", func() {
+		var out bytes.Buffer
+		s.Equal(1, runLookup(adapter, []string{"alias", "none@example.com"}, &out))
+		s.Equal("500 NO%20RESULT\n", out.String())
+	})
+
+	s.Run("error", func() {
+		var out bytes.Buffer
+		s.Equal(2, runLookup(adapter, []string{"domain", "example.com"}, &out))
+		s.Equal("400 Error%20fetching%20domain\n", out.String())
+	})
+
+	s.Run("unknown map", func() {
+		var out bytes.Buffer
+		s.Equal(2, runLookup(adapter, []string{"canonical", "user@example.com"}, &out))
+		s.Empty(out.String())
+	})
+
+	s.Run("missing key", func() {
+		var out bytes.Buffer
+		s.Equal(2, runLookup(adapter, []string{"alias"}, &out))
+	})
+}
+
+func (s *CLITestSuite) TestRunHealthcheck() {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/livez" || !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lookupServer, err := NewTCPServer(ctx, TCPServerConfig{
+		Name:  "domain",
+		Addrs: []string{"127.0.0.1:0"},
+		Handler: func(conn net.Conn) {
+			_, _ = conn.Read(make([]byte, 4096))
+			_, _ = conn.Write([]byte("500 NO%20RESULT\n"))
+		},
+	})
+	s.Require().NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go lookupServer.Serve(ctx, &wg)
+	defer wg.Wait()
+	defer cancel()
+
+	config := &Config{
+		MetricsEnabled:    true,
+		MetricsListenAddr: strings.TrimPrefix(server.URL, "http://"),
+		DomainListenAddrs: []string{lookupServer.listeners[0].Addr().String()},
+	}
+
+	s.Run("healthy", func() {
+		var out bytes.Buffer
+		s.Equal(0, runHealthcheck(config, nil, &out))
+		s.Equal("ok\n", out.String())
+	})
+
+	s.Run("probe", func() {
+		var out bytes.Buffer
+		s.Equal(0, runHealthcheck(config, []string{"-probe", "domain"}, &out))
+	})
+
+	s.Run("unknown probe", func() {
+		var out bytes.Buffer
+		s.Equal(1, runHealthcheck(config, []string{"-probe", "canonical"}, &out))
+	})
+
+	s.Run("disabled probe", func() {
+		var out bytes.Buffer
+		s.Equal(1, runHealthcheck(config, []string{"-probe", "recipient"}, &out))
+		s.Equal("recipient lookup server is not enabled\n", out.String())
+	})
+
+	s.Run("unhealthy", func() {
+		healthy.Store(false)
+		defer healthy.Store(true)
+
+		var out bytes.Buffer
+		s.Equal(1, runHealthcheck(config, nil, &out))
+		s.Contains(out.String(), "503")
+	})
+
+	s.Run("other path", func() {
+		var out bytes.Buffer
+		s.Equal(1, runHealthcheck(config, []string{"-path", "/ready"}, &out))
+	})
+}
+
+func (s *CLITestSuite) TestLoopbackAddr() {
+	s.Equal("127.0.0.1:10005", loopbackAddr(":10005"))
+	s.Equal("127.0.0.1:10005", loopbackAddr("0.0.0.0:10005"))
+	s.Equal("[::1]:10005", loopbackAddr("[::]:10005"))
+	s.Equal("10.0.0.1:10005", loopbackAddr("10.0.0.1:10005"))
+}
+
+func TestCLI(t *testing.T) {
+	suite.Run(t, new(CLITestSuite))
+}
@@ -1,33 +1,363 @@
 package main
 
 import (
+	"io"
+	"net/netip"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // Config is the configuration for the application.
 type Config struct {
+	// Backend answers the lookups, either BackendUserli or BackendStatic.
+	Backend string `json:"backend"`
+
+	// StaticFile contains the records of the static backend.
+	StaticFile string `json:"static_file"`
+
 	// UserliToken is the token for the userli service.
-	UserliToken string
+	UserliToken string `json:"userli_token" redact:"true"`
+
+	// UserliSecondaryToken is tried when userli rejects the token.
+	UserliSecondaryToken string `json:"userli_secondary_token" redact:"true"`
+
+	// UserliTokenFile is a file containing the token for the userli service.
+	UserliTokenFile string `json:"userli_token_file"`
+
+	// VaultAddr is the address of the vault server holding the userli token.
+	VaultAddr string `json:"vault_addr"`
+
+	// VaultToken is the token to authenticate against vault.
+	VaultToken string `json:"vault_token" redact:"true"`
+
+	// VaultSecretPath is the API path of the secret, e.g. "secret/data/userli".
+	VaultSecretPath string `json:"vault_secret_path"`
+
+	// VaultSecretField is the field of the secret containing the userli token.
+	VaultSecretField string `json:"vault_secret_field"`
+
+	// SecretRefreshInterval is the interval to refresh the userli token from its provider.
+	SecretRefreshInterval time.Duration `json:"secret_refresh_interval"`
 
 	// UserliBaseURL is the base URL for the userli service.
-	UserliBaseURL string
+	UserliBaseURL string `json:"userli_base_url"`
+
+	// ShadowBaseURL is the base URL of a userli instance that a share of
+	// the lookups is mirrored to for comparison.
+	ShadowBaseURL string `json:"shadow_base_url"`
+
+	// ShadowToken is the token for the shadow userli.
+	ShadowToken string `json:"shadow_token" redact:"true"`
+
+	// ShadowRate is the share of lookups mirrored to the shadow userli.
+	ShadowRate float64 `json:"shadow_rate"`
+
+	// Fallbacks are the sources consulted by map name when userli has no
+	// result, e.g. "tcp:legacy:10001" or "file:/etc/postfix/aliases".
+	Fallbacks map[string][]string `json:"fallbacks"`
+
+	// FallbackMerge are the maps whose values from userli and all
+	// fallback sources are merged instead of using the first match.
+	FallbackMerge map[string]bool `json:"fallback_merge"`
+
+	// FailurePolicies are the failure policies of the maps, either
+	// FailurePolicyTemp or FailurePolicyNotFound.
+	FailurePolicies map[string]string `json:"failure_policies"`
 
-	// AliasListenAddr is the address to listen for alias requests.
-	AliasListenAddr string
+	// CustomMaps are additional maps answered by external commands.
+	CustomMaps []CustomMapConfig `json:"custom_maps"`
 
-	// DomainListenAddr is the address to listen for domain requests.
-	DomainListenAddr string
+	// WildcardDomains are patterns like "*.example.org" of domains that
+	// exist without being looked up in userli.
+	WildcardDomains []string `json:"wildcard_domains"`
 
-	// MailboxListenAddr is the address to listen for mailbox requests.
-	MailboxListenAddr string
+	// ManagedDomains are the only domains looked up in userli if set.
+	ManagedDomains []string `json:"managed_domains"`
 
-	// SendersListenAddr is the address to listen for senders requests.
-	SendersListenAddr string
+	// UserliMaxValues is the maximum number of aliases or senders accepted
+	// in a userli response. Zero means unlimited.
+	UserliMaxValues int `json:"userli_max_values"`
+
+	// SMTPUTF8 enables internationalized addresses.
+	SMTPUTF8 bool `json:"smtputf8"`
+
+	// UserliBackends are additional userli instances serving some domains.
+	UserliBackends UserliBackendConfigs `json:"userli_backends"`
+
+	// AliasListenAddrs are the addresses to listen for alias requests.
+	AliasListenAddrs []string `json:"alias_listen_addrs"`
+
+	// DomainListenAddrs are the addresses to listen for domain requests.
+	DomainListenAddrs []string `json:"domain_listen_addrs"`
+
+	// MailboxListenAddrs are the addresses to listen for mailbox requests.
+	MailboxListenAddrs []string `json:"mailbox_listen_addrs"`
+
+	// SendersListenAddrs are the addresses to listen for senders requests.
+	SendersListenAddrs []string `json:"senders_listen_addrs"`
+
+	// RecipientListenAddrs are the addresses to listen for recipient requests.
+	RecipientListenAddrs []string `json:"recipient_listen_addrs"`
+
+	// ListenNetwork is the network used by the tcp_table servers ("tcp", "tcp4" or "tcp6").
+	ListenNetwork string `json:"listen_network"`
 
 	// MetricsListenAddr is the address to listen for metrics requests.
-	MetricsListenAddr string
+	MetricsListenAddr string `json:"metrics_listen_addr"`
+
+	// PushgatewayURL is the Pushgateway to push metrics to. Disabled if empty.
+	PushgatewayURL string `json:"pushgateway_url"`
+
+	// PushgatewayJob is the job label of the pushed metrics.
+	PushgatewayJob string `json:"pushgateway_job"`
+
+	// PushgatewayInterval is the interval between two pushes.
+	PushgatewayInterval time.Duration `json:"pushgateway_interval"`
+
+	// SLOWindow is the rolling window of the success ratio metric.
+	SLOWindow time.Duration `json:"slo_window"`
+
+	// LatencyObjective is the duration after which a request counts as slow.
+	LatencyObjective time.Duration `json:"latency_objective"`
+
+	// DomainMetricsEnabled enables per-domain request metrics.
+	DomainMetricsEnabled bool `json:"domain_metrics_enabled"`
+
+	// DomainMetricsAllowlist are domains that always get their own label.
+	DomainMetricsAllowlist []string `json:"domain_metrics_allowlist"`
+
+	// DomainMetricsLimit is the number of most requested domains that get their own label.
+	DomainMetricsLimit int `json:"domain_metrics_limit"`
+
+	// AccessLogFile is the file to write the access log to. The access log is disabled if empty.
+	AccessLogFile string `json:"access_log_file"`
+
+	// AccessLogMaxSize is the size in bytes after which the access log is rotated. Zero disables rotation.
+	AccessLogMaxSize int64 `json:"access_log_max_size"`
+
+	// AccessLogMaxBackups is the number of rotated access log files to keep.
+	AccessLogMaxBackups int `json:"access_log_max_backups"`
+
+	// StatsdAddr is the address of a statsd server to mirror metrics to. Disabled if empty.
+	StatsdAddr string `json:"statsd_addr"`
+
+	// StatsdFormat is either "statsd" or "dogstatsd".
+	StatsdFormat string `json:"statsd_format"`
+
+	// SentryDSN is the DSN to report errors and panics to. Disabled if empty.
+	SentryDSN string `json:"sentry_dsn" redact:"true"`
+
+	// SentryEnvironment is the environment reported to sentry.
+	SentryEnvironment string `json:"sentry_environment"`
+
+	// SyslogAddr is the syslog server to send the logs to, e.g.
+	// "udp://localhost:514". Disabled if empty.
+	SyslogAddr string `json:"syslog_addr"`
+
+	// SyslogFacility is the facility of the syslog messages.
+	SyslogFacility string `json:"syslog_facility"`
+
+	// MetricsToken is the bearer token required for /metrics, pprof and the admin endpoints.
+	MetricsToken string `json:"metrics_token" redact:"true"`
+
+	// MetricsUsername is the basic auth user for /metrics, pprof and the admin endpoints.
+	MetricsUsername string `json:"metrics_username"`
+
+	// MetricsPassword is the basic auth password for /metrics, pprof and the admin endpoints.
+	MetricsPassword string `json:"metrics_password" redact:"true"`
+
+	// MetricsAllowedNets are the networks allowed to access /metrics, pprof and the admin endpoints.
+	MetricsAllowedNets []netip.Prefix `json:"metrics_allowed_nets"`
+
+	// AdminTokens grant access to the admin endpoints of their scopes.
+	AdminTokens AdminTokens `json:"admin_tokens"`
+
+	// PprofEnabled exposes pprof on the metrics server.
+	PprofEnabled bool `json:"pprof_enabled"`
+
+	// PprofToken is the bearer token required to access pprof.
+	PprofToken string `json:"pprof_token" redact:"true"`
+
+	// PprofAllowedNets are the networks allowed to access pprof.
+	PprofAllowedNets []netip.Prefix `json:"pprof_allowed_nets"`
+
+	// OTLPEndpoint is the OTLP/HTTP endpoint to export traces to. Tracing is disabled if empty.
+	OTLPEndpoint string `json:"otlp_endpoint"`
+
+	// TraceSampleRatio is the share of lookups that are traced.
+	TraceSampleRatio float64 `json:"trace_sample_ratio"`
+
+	// RecordFile is the file every lookup is recorded to. Recording is
+	// disabled if empty.
+	RecordFile string `json:"record_file"`
+
+	// RecordPlainKeys records the keys instead of their hashes.
+	RecordPlainKeys bool `json:"record_plain_keys"`
+
+	// ProbeInterval is the interval of the probe lookups sent to the
+	// lookup servers. Probing is disabled if 0.
+	ProbeInterval time.Duration `json:"probe_interval"`
+
+	// HealthCheckMap and HealthCheckKey are the map and key looked up to
+	// check the userli API.
+	HealthCheckMap string `json:"health_check_map"`
+	HealthCheckKey string `json:"health_check_key"`
+
+	// StartupCheck verifies that userli accepts the token before the
+	// listeners are bound.
+	StartupCheck bool `json:"startup_check"`
+
+	// AliasSizeThreshold is the number of destinations of an alias above
+	// which lookups are logged and counted. It is disabled if 0.
+	AliasSizeThreshold int `json:"alias_size_threshold"`
+
+	// AliasLoopDetection enables detecting and breaking alias loops.
+	AliasLoopDetection bool `json:"alias_loop_detection"`
+
+	// AliasLoopCacheSize is the number of aliases remembered to detect loops.
+	AliasLoopCacheSize int `json:"alias_loop_cache_size"`
+
+	// ChaosEnabled enables fault injection into lookups.
+	ChaosEnabled bool `json:"chaos_enabled"`
+
+	// Chaos are the faults injected into lookups if ChaosEnabled is set.
+	Chaos ChaosSettings `json:"chaos"`
+
+	// Workers is the number of goroutines shared by all lookup servers to
+	// handle connections. Zero starts one goroutine per connection.
+	Workers int `json:"workers"`
+
+	// WorkerQueueSize is the number of connections waiting for a worker
+	// before further connections are shed.
+	WorkerQueueSize int `json:"worker_queue_size"`
+
+	// MaxConnections is the maximum number of concurrent connections per lookup server. Zero means unlimited.
+	MaxConnections int `json:"max_connections"`
+
+	// ShutdownTimeout is the maximum time to wait for active connections on shutdown.
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"`
+
+	// UpgradeTimeout is the maximum time to wait for a new process to take
+	// over the listeners on upgrade.
+	UpgradeTimeout time.Duration `json:"upgrade_timeout"`
+
+	// PIDFile is the file the process id is written to once the adapter
+	// is ready.
+	PIDFile string `json:"pid_file"`
+
+	// User is the user to switch to after binding the listeners.
+	User string `json:"user"`
+
+	// Group is the group to switch to after binding the listeners.
+	Group string `json:"group"`
+
+	// ChrootDir is the directory to chroot into after binding the listeners.
+	ChrootDir string `json:"chroot_dir"`
+
+	// Listeners contains the settings of the lookup servers by map name.
+	Listeners map[string]ListenerConfig `json:"listeners"`
+
+	// SafeModeMaps are the maps in safe mode until SafeModeUntil.
+	SafeModeMaps []string `json:"safe_mode_maps"`
+
+	// SafeModeUntil is the end of the safe mode configured at startup.
+	// Safe mode is disabled if zero.
+	SafeModeUntil time.Time `json:"safe_mode_until"`
+
+	// DisabledMaps contains the lookup maps that are disabled.
+	DisabledMaps map[string]bool `json:"disabled_maps"`
+
+	// TCPTableEnabled enables the tcp_table lookup servers.
+	TCPTableEnabled bool `json:"tcp_table_enabled"`
+
+	// MetricsEnabled enables the metrics server.
+	MetricsEnabled bool `json:"metrics_enabled"`
+}
+
+// ListenerConfig contains the settings of a single lookup server.
+type ListenerConfig struct {
+	// AllowedNets are the client networks allowed to connect. Empty allows all.
+	AllowedNets []netip.Prefix `json:"allowed_nets"`
+
+	// MaxConnections is the maximum number of concurrent connections. Zero
+	// means unlimited.
+	MaxConnections int `json:"max_connections"`
+
+	// ReadTimeout is the maximum time to receive a request.
+	ReadTimeout time.Duration `json:"read_timeout"`
+
+	// WriteTimeout is the maximum time to write a response.
+	WriteTimeout time.Duration `json:"write_timeout"`
+
+	// IdleTimeout is the maximum time a connection may stay open without
+	// receiving data.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+
+	// KeepAlive is the interval of TCP keep-alive probes. Zero disables them.
+	KeepAlive time.Duration `json:"keepalive"`
+
+	// NoDelay disables Nagle's algorithm.
+	NoDelay bool `json:"no_delay"`
+
+	// ReceiveBufferSize is the size of SO_RCVBUF. Zero keeps the system default.
+	ReceiveBufferSize int `json:"receive_buffer_size"`
+
+	// SendBufferSize is the size of SO_SNDBUF. Zero keeps the system default.
+	SendBufferSize int `json:"send_buffer_size"`
+
+	// MaxConnectionsPerIP is the maximum number of concurrent connections
+	// per client address. Zero means unlimited.
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+
+	// AcceptLoops is the number of goroutines accepting connections per address.
+	AcceptLoops int `json:"accept_loops"`
+
+	// AcceptRate is the maximum number of accepted connections per second.
+	// Zero means unlimited.
+	AcceptRate float64 `json:"accept_rate"`
+
+	// AcceptBurst is the number of connections accepted at once before
+	// AcceptRate applies.
+	AcceptBurst int `json:"accept_burst"`
+
+	// ReusePort opens one SO_REUSEPORT socket per accept loop.
+	ReusePort bool `json:"reuse_port"`
+}
+
+// CustomMapConfig contains the settings of a map answered by a command.
+type CustomMapConfig struct {
+	Name        string        `json:"name"`
+	Command     []string      `json:"command"`
+	Timeout     time.Duration `json:"timeout"`
+	ListenAddrs []string      `json:"listen_addrs"`
+}
+
+// UserliBackendConfig contains the settings of an additional userli
+// instance.
+type UserliBackendConfig struct {
+	Name    string   `json:"name"`
+	BaseURL string   `json:"base_url"`
+	Token   string   `json:"token"`
+	Domains []string `json:"domains"`
+}
+
+// UserliBackendConfigs are the settings of all additional userli instances.
+type UserliBackendConfigs []UserliBackendConfig
+
+// Redacted returns the settings with the tokens replaced.
+func (b UserliBackendConfigs) Redacted() any {
+	redacted := make([]UserliBackendConfig, len(b))
+	for i, backend := range b {
+		backend.Token = redactedValue
+		redacted[i] = backend
+	}
+
+	return redacted
 }
 
 // NewConfig creates a new Config with default values.
@@ -48,9 +378,19 @@ func NewConfig() *Config {
 	}
 	log.SetLevel(level)
 
-	if logFormat == "json" {
+	redactor.Register()
+
+	switch logFormat {
+	case "json":
 		log.SetFormatter(&log.JSONFormatter{})
-	} else {
+	case "journal":
+		hook, err := NewJournalHook(journalSocket)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to connect to the journal")
+		}
+		log.AddHook(hook)
+		log.SetOutput(io.Discard)
+	default:
 		log.SetFormatter(&log.TextFormatter{})
 	}
 
@@ -59,29 +399,55 @@ func NewConfig() *Config {
 		userliBaseURL = "http://localhost:8000"
 	}
 
+	userliTokenFile := os.Getenv("USERLI_TOKEN_FILE")
+	vaultAddr := os.Getenv("VAULT_ADDR")
+
+	backend := os.Getenv("BACKEND")
+	staticFile := os.Getenv("STATIC_FILE")
+	switch backend {
+	case "":
+		backend = BackendUserli
+	case BackendUserli:
+	case BackendStatic:
+		if staticFile == "" {
+			log.Fatal("STATIC_FILE is required for the static backend")
+		}
+	default:
+		log.Fatalf("BACKEND must be one of userli or static, got %q", backend)
+	}
+
 	userliToken := os.Getenv("USERLI_TOKEN")
-	if userliToken == "" {
+	if backend == BackendUserli && userliToken == "" && userliTokenFile == "" && vaultAddr == "" {
 		log.Fatal("USERLI_TOKEN is required")
 	}
 
-	aliasListenAddr := os.Getenv("ALIAS_LISTEN_ADDR")
-	if aliasListenAddr == "" {
-		aliasListenAddr = ":10001"
+	vaultSecretField := os.Getenv("VAULT_SECRET_FIELD")
+	if vaultSecretField == "" {
+		vaultSecretField = "token"
 	}
 
-	domainListenAddr := os.Getenv("DOMAIN_LISTEN_ADDR")
-	if domainListenAddr == "" {
-		domainListenAddr = ":10002"
+	secretRefreshInterval := parseDuration("SECRET_REFRESH_INTERVAL", 5*time.Minute)
+	if secretRefreshInterval <= 0 {
+		log.Fatalf("SECRET_REFRESH_INTERVAL must be positive, got %s", secretRefreshInterval)
 	}
 
-	mailboxListenAddr := os.Getenv("MAILBOX_LISTEN_ADDR")
-	if mailboxListenAddr == "" {
-		mailboxListenAddr = ":10003"
-	}
+	aliasListenAddrs := parseList("ALIAS_LISTEN_ADDR", []string{":10001"})
+
+	domainListenAddrs := parseList("DOMAIN_LISTEN_ADDR", []string{":10002"})
+
+	mailboxListenAddrs := parseList("MAILBOX_LISTEN_ADDR", []string{":10003"})
 
-	sendersListenAddr := os.Getenv("SENDERS_LISTEN_ADDR")
-	if sendersListenAddr == "" {
-		sendersListenAddr = ":10004"
+	sendersListenAddrs := parseList("SENDERS_LISTEN_ADDR", []string{":10004"})
+
+	recipientListenAddrs := parseList("RECIPIENT_LISTEN_ADDR", nil)
+
+	listenNetwork := os.Getenv("LISTEN_NETWORK")
+	switch listenNetwork {
+	case "":
+		listenNetwork = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		log.Fatalf("LISTEN_NETWORK must be one of tcp, tcp4 or tcp6, got %q", listenNetwork)
 	}
 
 	metricsListenAddr := os.Getenv("METRICS_LISTEN_ADDR")
@@ -89,13 +455,510 @@ func NewConfig() *Config {
 		metricsListenAddr = ":10005"
 	}
 
-	return &Config{
-		UserliBaseURL:     userliBaseURL,
-		UserliToken:       userliToken,
-		AliasListenAddr:   aliasListenAddr,
-		DomainListenAddr:  domainListenAddr,
-		MailboxListenAddr: mailboxListenAddr,
-		SendersListenAddr: sendersListenAddr,
-		MetricsListenAddr: metricsListenAddr,
+	disabledMaps := make(map[string]bool)
+	for _, name := range parseList("DISABLED_MAPS", nil) {
+		switch name {
+		case "alias", "domain", "mailbox", "senders", "recipient":
+			disabledMaps[name] = true
+		default:
+			log.Fatalf("DISABLED_MAPS contains unknown map %q", name)
+		}
+	}
+
+	var userliBackends UserliBackendConfigs
+	for _, name := range parseList("USERLI_BACKENDS", nil) {
+		// the names are used in the backend label of the userli metrics
+		if name == "default" || name == "shadow" {
+			log.Fatalf("USERLI_BACKENDS must not contain the reserved name %q", name)
+		}
+		prefix := "USERLI_" + strings.ToUpper(name) + "_"
+		backend := UserliBackendConfig{
+			Name:    name,
+			BaseURL: os.Getenv(prefix + "BASE_URL"),
+			Token:   os.Getenv(prefix + "TOKEN"),
+			Domains: parseList(prefix+"DOMAINS", nil),
+		}
+		if backend.BaseURL == "" || backend.Token == "" || len(backend.Domains) == 0 {
+			log.Fatalf("%sBASE_URL, %sTOKEN and %sDOMAINS are required for userli backend %q", prefix, prefix, prefix, name)
+		}
+		userliBackends = append(userliBackends, backend)
+	}
+
+	fallbacks := make(map[string][]string)
+	for _, name := range []string{"alias", "domain", "mailbox", "senders"} {
+		key := strings.ToUpper(name) + "_FALLBACK"
+		for _, spec := range parseList(key, nil) {
+			if !strings.HasPrefix(spec, "tcp:") && !strings.HasPrefix(spec, "file:") {
+				log.Fatalf("%s contains unknown source %q, expected tcp:host:port or file:/path", key, spec)
+			}
+			fallbacks[name] = append(fallbacks[name], spec)
+		}
+	}
+
+	failurePolicies := make(map[string]string)
+	for _, name := range []string{"alias", "domain", "mailbox", "senders", "recipient"} {
+		key := strings.ToUpper(name) + "_FAILURE_POLICY"
+		switch policy := os.Getenv(key); policy {
+		case "", FailurePolicyTemp:
+			failurePolicies[name] = FailurePolicyTemp
+		case FailurePolicyNotFound:
+			failurePolicies[name] = policy
+		default:
+			log.Fatalf("%s must be one of temp or notfound, got %q", key, policy)
+		}
+	}
+
+	fallbackMerge := make(map[string]bool)
+	for _, name := range []string{"alias", "senders"} {
+		key := strings.ToUpper(name) + "_FALLBACK_MODE"
+		switch mode := os.Getenv(key); mode {
+		case "", "first":
+		case "merge":
+			fallbackMerge[name] = true
+		default:
+			log.Fatalf("%s must be one of first or merge, got %q", key, mode)
+		}
+	}
+
+	wildcardDomains := parseList("WILDCARD_DOMAINS", nil)
+	for _, pattern := range wildcardDomains {
+		if !strings.HasPrefix(pattern, "*.") || strings.Count(pattern, "*") > 1 {
+			log.Fatalf("WILDCARD_DOMAINS must contain patterns like *.example.org, got %q", pattern)
+		}
+	}
+
+	var adminTokens AdminTokens
+	for _, name := range parseList("ADMIN_TOKENS", nil) {
+		prefix := "ADMIN_" + strings.ToUpper(name) + "_"
+		token := AdminToken{Name: name, Token: os.Getenv(prefix + "TOKEN"), Scopes: parseList(prefix+"SCOPES", nil)}
+		if token.Token == "" || len(token.Scopes) == 0 {
+			log.Fatalf("%sTOKEN and %sSCOPES are required for admin token %q", prefix, prefix, name)
+		}
+		for _, scope := range token.Scopes {
+			switch scope {
+			case adminScopeAll, adminScopeConnectionsRead, adminScopeConnectionsWrite, adminScopeChaosRead, adminScopeChaosWrite,
+				adminScopeMaintenanceRead, adminScopeMaintenanceWrite, adminScopeConfigRead:
+			default:
+				log.Fatalf("%sSCOPES contains unknown scope %q", prefix, scope)
+			}
+		}
+		adminTokens = append(adminTokens, token)
+	}
+
+	listeners := make(map[string]ListenerConfig)
+	for _, name := range []string{"alias", "domain", "mailbox", "senders", "recipient"} {
+		listeners[name] = parseListenerConfig(name)
+	}
+
+	var customMaps []CustomMapConfig
+	for _, name := range parseList("CUSTOM_MAPS", nil) {
+		if _, ok := listeners[name]; ok || name == "metrics" {
+			log.Fatalf("CUSTOM_MAPS contains the reserved name %q", name)
+		}
+
+		prefix := strings.ToUpper(name) + "_"
+		customMap := CustomMapConfig{
+			Name:        name,
+			Command:     strings.Fields(os.Getenv(prefix + "EXEC")),
+			Timeout:     parseDuration(prefix+"EXEC_TIMEOUT", 5*time.Second),
+			ListenAddrs: parseList(prefix+"LISTEN_ADDR", nil),
+		}
+		if len(customMap.Command) == 0 || len(customMap.ListenAddrs) == 0 {
+			log.Fatalf("%sEXEC and %sLISTEN_ADDR are required for custom map %q", prefix, prefix, name)
+		}
+		if customMap.Timeout <= 0 {
+			log.Fatalf("%sEXEC_TIMEOUT must be positive, got %s", prefix, customMap.Timeout)
+		}
+		customMaps = append(customMaps, customMap)
+		listeners[name] = parseListenerConfig(name)
+	}
+
+	statsdFormat := os.Getenv("STATSD_FORMAT")
+	switch statsdFormat {
+	case "":
+		statsdFormat = StatsdFormatStatsd
+	case StatsdFormatStatsd, StatsdFormatDogStatsd:
+	default:
+		log.Fatalf("STATSD_FORMAT must be one of statsd or dogstatsd, got %q", statsdFormat)
+	}
+
+	pushgatewayInterval := parseDuration("PUSHGATEWAY_INTERVAL", 15*time.Second)
+	if pushgatewayInterval <= 0 {
+		log.Fatalf("PUSHGATEWAY_INTERVAL must be positive, got %s", pushgatewayInterval)
+	}
+
+	chaos := ChaosSettings{
+		LatencyMS:     int(parseDuration("CHAOS_LATENCY", 0).Milliseconds()),
+		LatencyRate:   parseFloat("CHAOS_LATENCY_RATE", 0),
+		ErrorRate:     parseFloat("CHAOS_ERROR_RATE", 0),
+		DropRate:      parseFloat("CHAOS_DROP_RATE", 0),
+		MalformedRate: parseFloat("CHAOS_MALFORMED_RATE", 0),
+	}
+	if err := chaos.Validate(); err != nil {
+		log.Fatalf("Invalid CHAOS settings: %v", err)
+	}
+
+	shadowToken := os.Getenv("SHADOW_TOKEN")
+	if shadowToken == "" {
+		shadowToken = userliToken
+	}
+	shadowRate := parseFloat("SHADOW_RATE", 1)
+	if shadowRate < 0 || shadowRate > 1 {
+		log.Fatalf("SHADOW_RATE must be between 0 and 1")
+	}
+
+	aliasLoopCacheSize := parseInt("ALIAS_LOOP_CACHE_SIZE", 10000)
+	if aliasLoopCacheSize <= 0 {
+		log.Fatalf("ALIAS_LOOP_CACHE_SIZE must be positive, got %d", aliasLoopCacheSize)
+	}
+
+	aliasSizeThreshold := parseInt("ALIAS_EXPANSION_THRESHOLD", 0)
+	if aliasSizeThreshold < 0 {
+		log.Fatalf("ALIAS_EXPANSION_THRESHOLD must not be negative, got %d", aliasSizeThreshold)
+	}
+
+	syslogFacility := os.Getenv("SYSLOG_FACILITY")
+	if syslogFacility == "" {
+		syslogFacility = "mail"
+	}
+	if _, ok := syslogFacilities[syslogFacility]; !ok {
+		log.Fatalf("SYSLOG_FACILITY must be one of mail, daemon or local0 to local7, got %q", syslogFacility)
+	}
+
+	probeInterval := parseDuration("PROBE_INTERVAL", 0)
+	if probeInterval < 0 {
+		log.Fatalf("PROBE_INTERVAL must not be negative, got %s", probeInterval)
+	}
+
+	userliMaxValues := parseInt("USERLI_MAX_VALUES", 10000)
+	if userliMaxValues < 0 {
+		log.Fatalf("USERLI_MAX_VALUES must not be negative, got %d", userliMaxValues)
+	}
+
+	healthCheckMap := os.Getenv("HEALTH_CHECK_MAP")
+	switch healthCheckMap {
+	case "":
+		healthCheckMap = "domain"
+	case "alias", "domain", "mailbox", "senders":
+	default:
+		log.Fatalf("HEALTH_CHECK_MAP must be one of alias, domain, mailbox or senders, got %q", healthCheckMap)
+	}
+
+	healthCheckKey := os.Getenv("HEALTH_CHECK_KEY")
+	if healthCheckKey == "" {
+		healthCheckKey = healthCheckDomain
+	}
+
+	var safeModeUntil time.Time
+	if value := os.Getenv("SAFE_MODE_UNTIL"); value != "" {
+		var err error
+		safeModeUntil, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Fatalf("SAFE_MODE_UNTIL must be a RFC 3339 time, got %q", value)
+		}
+	}
+
+	upgradeTimeout := parseDuration("UPGRADE_TIMEOUT", 30*time.Second)
+	if upgradeTimeout <= 0 {
+		log.Fatalf("UPGRADE_TIMEOUT must be positive, got %s", upgradeTimeout)
+	}
+
+	traceSampleRatio := parseFloat("TRACE_SAMPLE_RATIO", 1)
+	if traceSampleRatio < 0 || traceSampleRatio > 1 {
+		log.Fatalf("TRACE_SAMPLE_RATIO must be between 0 and 1, got %v", traceSampleRatio)
+	}
+
+	pushgatewayJob := os.Getenv("PUSHGATEWAY_JOB")
+	if pushgatewayJob == "" {
+		pushgatewayJob = "userli_postfix_adapter"
+	}
+
+	tcpTableEnabled := parseBool("TCP_TABLE_ENABLED", true)
+	metricsEnabled := parseBool("METRICS_ENABLED", true)
+
+	if !tcpTableEnabled && !metricsEnabled {
+		log.Fatal("At least one service must be enabled")
+	}
+
+	config := &Config{
+		UserliBaseURL:          userliBaseURL,
+		Backend:                backend,
+		StaticFile:             staticFile,
+		UserliToken:            userliToken,
+		UserliSecondaryToken:   os.Getenv("USERLI_SECONDARY_TOKEN"),
+		UserliBackends:         userliBackends,
+		Fallbacks:              fallbacks,
+		FallbackMerge:          fallbackMerge,
+		FailurePolicies:        failurePolicies,
+		CustomMaps:             customMaps,
+		ManagedDomains:         parseList("MANAGED_DOMAINS", nil),
+		WildcardDomains:        wildcardDomains,
+		UserliMaxValues:        userliMaxValues,
+		SMTPUTF8:               parseBool("SMTPUTF8_ENABLED", false),
+		ShadowBaseURL:          os.Getenv("SHADOW_BASE_URL"),
+		ShadowToken:            shadowToken,
+		ShadowRate:             shadowRate,
+		UserliTokenFile:        userliTokenFile,
+		VaultAddr:              vaultAddr,
+		VaultToken:             os.Getenv("VAULT_TOKEN"),
+		VaultSecretPath:        os.Getenv("VAULT_SECRET_PATH"),
+		VaultSecretField:       vaultSecretField,
+		SecretRefreshInterval:  secretRefreshInterval,
+		AliasListenAddrs:       aliasListenAddrs,
+		DomainListenAddrs:      domainListenAddrs,
+		MailboxListenAddrs:     mailboxListenAddrs,
+		SendersListenAddrs:     sendersListenAddrs,
+		RecipientListenAddrs:   recipientListenAddrs,
+		ListenNetwork:          listenNetwork,
+		MetricsListenAddr:      metricsListenAddr,
+		PushgatewayURL:         os.Getenv("PUSHGATEWAY_URL"),
+		PushgatewayJob:         pushgatewayJob,
+		PushgatewayInterval:    pushgatewayInterval,
+		SLOWindow:              parseDuration("SLO_WINDOW", 5*time.Minute),
+		LatencyObjective:       parseDuration("LATENCY_OBJECTIVE", 250*time.Millisecond),
+		DomainMetricsEnabled:   parseBool("DOMAIN_METRICS_ENABLED", false),
+		DomainMetricsAllowlist: parseList("DOMAIN_METRICS_ALLOWLIST", nil),
+		DomainMetricsLimit:     parseInt("DOMAIN_METRICS_LIMIT", 50),
+		AccessLogFile:          os.Getenv("ACCESS_LOG_FILE"),
+		AccessLogMaxSize:       int64(parseInt("ACCESS_LOG_MAX_SIZE", 0)),
+		AccessLogMaxBackups:    parseInt("ACCESS_LOG_MAX_BACKUPS", 5),
+		StatsdAddr:             os.Getenv("STATSD_ADDR"),
+		StatsdFormat:           statsdFormat,
+		SentryDSN:              os.Getenv("SENTRY_DSN"),
+		SentryEnvironment:      os.Getenv("SENTRY_ENVIRONMENT"),
+		SyslogAddr:             os.Getenv("SYSLOG_ADDR"),
+		SyslogFacility:         syslogFacility,
+		MetricsToken:           os.Getenv("METRICS_TOKEN"),
+		MetricsUsername:        os.Getenv("METRICS_USERNAME"),
+		MetricsPassword:        os.Getenv("METRICS_PASSWORD"),
+		MetricsAllowedNets:     parsePrefixes("METRICS_ALLOWED_NETS"),
+		AdminTokens:            adminTokens,
+		PprofEnabled:           parseBool("PPROF_ENABLED", false),
+		PprofToken:             os.Getenv("PPROF_TOKEN"),
+		PprofAllowedNets:       parsePrefixes("PPROF_ALLOWED_NETS"),
+		OTLPEndpoint:           strings.TrimSuffix(os.Getenv("OTLP_ENDPOINT"), "/"),
+		TraceSampleRatio:       traceSampleRatio,
+		Workers:                parseInt("WORKERS", 0),
+		WorkerQueueSize:        parseInt("WORKER_QUEUE_SIZE", 100),
+		MaxConnections:         parseInt("MAX_CONNECTIONS", 0),
+		ShutdownTimeout:        parseDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		UpgradeTimeout:         upgradeTimeout,
+		RecordFile:             os.Getenv("RECORD_FILE"),
+		RecordPlainKeys:        parseBool("RECORD_PLAIN_KEYS", false),
+		ProbeInterval:          probeInterval,
+		HealthCheckMap:         healthCheckMap,
+		HealthCheckKey:         healthCheckKey,
+		StartupCheck:           parseBool("STARTUP_CHECK", false),
+		AliasSizeThreshold:     aliasSizeThreshold,
+		AliasLoopDetection:     parseBool("ALIAS_LOOP_DETECTION", false),
+		AliasLoopCacheSize:     aliasLoopCacheSize,
+		ChaosEnabled:           parseBool("CHAOS_ENABLED", false),
+		Chaos:                  chaos,
+		PIDFile:                os.Getenv("PID_FILE"),
+		User:                   os.Getenv("RUN_AS_USER"),
+		Group:                  os.Getenv("RUN_AS_GROUP"),
+		ChrootDir:              os.Getenv("CHROOT_DIR"),
+		Listeners:              listeners,
+		SafeModeMaps:           parseList("SAFE_MODE_MAPS", []string{"alias", "mailbox"}),
+		SafeModeUntil:          safeModeUntil,
+		DisabledMaps:           disabledMaps,
+		TCPTableEnabled:        tcpTableEnabled,
+		MetricsEnabled:         metricsEnabled,
+	}
+	redactor.Add(config.Secrets()...)
+
+	return config
+}
+
+// parseListenerConfig reads the settings of the lookup server for the map
+// name. Variables prefixed with the upper case map name, e.g.
+// ALIAS_ALLOWED_NETS, override the global ones.
+func parseListenerConfig(name string) ListenerConfig {
+	prefix := strings.ToUpper(name) + "_"
+
+	allowedNets := parsePrefixes(prefix + "ALLOWED_NETS")
+	if allowedNets == nil {
+		allowedNets = parsePrefixes("LISTEN_ALLOWED_NETS")
+	}
+
+	acceptRate := parseFloat(prefix+"ACCEPT_RATE", parseFloat("ACCEPT_RATE", 0))
+	if acceptRate < 0 {
+		log.Fatalf("ACCEPT_RATE of %s must not be negative, got %v", name, acceptRate)
 	}
+
+	return ListenerConfig{
+		AllowedNets:         allowedNets,
+		MaxConnections:      parseInt(prefix+"MAX_CONNECTIONS", parseInt("MAX_CONNECTIONS", 0)),
+		ReadTimeout:         parseDuration(prefix+"READ_TIMEOUT", parseDuration("READ_TIMEOUT", 10*time.Second)),
+		WriteTimeout:        parseDuration(prefix+"WRITE_TIMEOUT", parseDuration("WRITE_TIMEOUT", 0)),
+		IdleTimeout:         parseDuration(prefix+"IDLE_TIMEOUT", parseDuration("IDLE_TIMEOUT", 0)),
+		KeepAlive:           parseDuration(prefix+"KEEPALIVE", parseDuration("KEEPALIVE", 0)),
+		NoDelay:             parseBool(prefix+"TCP_NODELAY", parseBool("TCP_NODELAY", true)),
+		ReceiveBufferSize:   parseInt(prefix+"RECEIVE_BUFFER_SIZE", parseInt("RECEIVE_BUFFER_SIZE", 0)),
+		SendBufferSize:      parseInt(prefix+"SEND_BUFFER_SIZE", parseInt("SEND_BUFFER_SIZE", 0)),
+		MaxConnectionsPerIP: parseInt(prefix+"MAX_CONNECTIONS_PER_IP", parseInt("MAX_CONNECTIONS_PER_IP", 0)),
+		AcceptLoops:         parseInt(prefix+"ACCEPT_LOOPS", parseInt("ACCEPT_LOOPS", 1)),
+		AcceptRate:          acceptRate,
+		AcceptBurst:         parseInt(prefix+"ACCEPT_BURST", parseInt("ACCEPT_BURST", max(int(acceptRate), 1))),
+		ReusePort:           parseBool(prefix+"REUSE_PORT", parseBool("REUSE_PORT", false)),
+	}
+}
+
+// parseBool reads a boolean from the environment variable key.
+// It returns def if the variable is not set.
+func parseBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to parse %s", key)
+	}
+
+	return b
+}
+
+// parseInt reads an integer from the environment variable key.
+// It returns def if the variable is not set.
+func parseInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to parse %s", key)
+	}
+
+	return i
+}
+
+// parseFloat reads a float from the environment variable key.
+// It returns def if the variable is not set.
+func parseFloat(key string, def float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to parse %s", key)
+	}
+
+	return f
+}
+
+// parseDuration reads a duration from the environment variable key.
+// It returns def if the variable is not set.
+func parseDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to parse %s", key)
+	}
+
+	return d
+}
+
+// parsePrefixes reads a comma separated list of networks in CIDR notation
+// from the environment variable key. Single addresses are accepted as well.
+func parsePrefixes(key string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, item := range parseList(key, nil) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				log.WithError(err).Fatalf("Failed to parse %s", key)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			log.WithError(err).Fatalf("Failed to parse %s", key)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes
+}
+
+// parseList reads a comma separated list from the environment variable key.
+// It returns def if the variable is not set.
+func parseList(key string, def []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// redactedValue replaces secrets in logs and configuration dumps.
+const redactedValue = "REDACTED"
+
+// Secrets returns the values of the fields tagged for redaction and the
+// tokens of the userli backends and admin tokens.
+func (c *Config) Secrets() []string {
+	var secrets []string
+
+	v := reflect.ValueOf(*c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("redact") == "true" {
+			secrets = append(secrets, v.Field(i).String())
+		}
+	}
+	for _, backend := range c.UserliBackends {
+		secrets = append(secrets, backend.Token)
+	}
+	for _, token := range c.AdminTokens {
+		secrets = append(secrets, token.Token)
+	}
+
+	return secrets
+}
+
+// Redacted returns the configuration keyed by its json names with all
+// secrets replaced by redactedValue.
+func (c *Config) Redacted() map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	v := reflect.ValueOf(*c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i).Interface()
+
+		if field.Tag.Get("redact") == "true" && !v.Field(i).IsZero() {
+			value = redactedValue
+		}
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if r, ok := value.(interface{ Redacted() any }); ok {
+			value = r.Redacted()
+		}
+
+		fields[field.Tag.Get("json")] = value
+	}
+
+	return fields
 }
@@ -2,8 +2,10 @@ package main
 
 import (
 	"io"
+	"net/netip"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 
@@ -36,11 +38,22 @@ func (s *ConfigTestSuite) TestNewConfig() {
 
 		s.Equal("token", config.UserliToken)
 		s.Equal("http://localhost:8000", config.UserliBaseURL)
-		s.Equal(":10001", config.AliasListenAddr)
-		s.Equal(":10002", config.DomainListenAddr)
-		s.Equal(":10003", config.MailboxListenAddr)
-		s.Equal(":10004", config.SendersListenAddr)
+		s.Equal(BackendUserli, config.Backend)
+		s.Equal([]string{":10001"}, config.AliasListenAddrs)
+		s.Equal([]string{":10002"}, config.DomainListenAddrs)
+		s.Equal([]string{":10003"}, config.MailboxListenAddrs)
+		s.Equal([]string{":10004"}, config.SendersListenAddrs)
+		s.Equal("tcp", config.ListenNetwork)
+		s.Equal(10*time.Second, config.ShutdownTimeout)
+		s.Equal(30*time.Second, config.UpgradeTimeout)
+		s.Equal(10*time.Second, config.Listeners["alias"].ReadTimeout)
+		s.True(config.Listeners["alias"].NoDelay)
+		s.False(config.ChaosEnabled)
+		s.Equal(0, config.MaxConnections)
+		s.Empty(config.DisabledMaps)
 		s.Equal(":10005", config.MetricsListenAddr)
+		s.True(config.TCPTableEnabled)
+		s.True(config.MetricsEnabled)
 	})
 
 	s.Run("custom config", func() {
@@ -56,12 +69,244 @@ func (s *ConfigTestSuite) TestNewConfig() {
 
 		s.Equal("token", config.UserliToken)
 		s.Equal("http://example.com", config.UserliBaseURL)
-		s.Equal(":20001", config.AliasListenAddr)
-		s.Equal(":20002", config.DomainListenAddr)
-		s.Equal(":20003", config.MailboxListenAddr)
-		s.Equal(":20004", config.SendersListenAddr)
+		s.Equal([]string{":20001"}, config.AliasListenAddrs)
+		s.Equal([]string{":20002"}, config.DomainListenAddrs)
+		s.Equal([]string{":20003"}, config.MailboxListenAddrs)
+		s.Equal([]string{":20004"}, config.SendersListenAddrs)
 		s.Equal(":20005", config.MetricsListenAddr)
 	})
+
+	s.Run("multiple listen addresses", func() {
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("ALIAS_LISTEN_ADDR", "127.0.0.1:20001, 10.0.0.1:20001")
+		os.Setenv("LISTEN_NETWORK", "tcp4")
+		defer os.Unsetenv("LISTEN_NETWORK")
+
+		config := NewConfig()
+
+		s.Equal([]string{"127.0.0.1:20001", "10.0.0.1:20001"}, config.AliasListenAddrs)
+		s.Equal("tcp4", config.ListenNetwork)
+	})
+
+	s.Run("disabled maps", func() {
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("DISABLED_MAPS", "senders, alias")
+		defer os.Unsetenv("DISABLED_MAPS")
+
+		config := NewConfig()
+
+		s.Equal(map[string]bool{"senders": true, "alias": true}, config.DisabledMaps)
+	})
+
+	s.Run("listener overrides", func() {
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("LISTEN_ALLOWED_NETS", "10.0.0.0/8")
+		os.Setenv("ALIAS_ALLOWED_NETS", "192.0.2.1")
+		os.Setenv("MAX_CONNECTIONS_PER_IP", "10")
+		os.Setenv("SENDERS_MAX_CONNECTIONS_PER_IP", "20")
+		os.Setenv("MAX_CONNECTIONS", "100")
+		os.Setenv("DOMAIN_MAX_CONNECTIONS", "200")
+		os.Setenv("READ_TIMEOUT", "5s")
+		os.Setenv("SENDERS_READ_TIMEOUT", "30s")
+		os.Setenv("MAILBOX_TCP_NODELAY", "false")
+		os.Setenv("RECEIVE_BUFFER_SIZE", "65536")
+		defer os.Unsetenv("MAILBOX_TCP_NODELAY")
+		defer os.Unsetenv("RECEIVE_BUFFER_SIZE")
+		defer os.Unsetenv("MAX_CONNECTIONS")
+		defer os.Unsetenv("DOMAIN_MAX_CONNECTIONS")
+		defer os.Unsetenv("READ_TIMEOUT")
+		defer os.Unsetenv("SENDERS_READ_TIMEOUT")
+		defer os.Unsetenv("LISTEN_ALLOWED_NETS")
+		defer os.Unsetenv("ALIAS_ALLOWED_NETS")
+		defer os.Unsetenv("MAX_CONNECTIONS_PER_IP")
+		defer os.Unsetenv("SENDERS_MAX_CONNECTIONS_PER_IP")
+
+		config := NewConfig()
+
+		s.Equal([]netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}, config.Listeners["alias"].AllowedNets)
+		s.Equal([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, config.Listeners["domain"].AllowedNets)
+		s.Equal(10, config.Listeners["alias"].MaxConnectionsPerIP)
+		s.Equal(20, config.Listeners["senders"].MaxConnectionsPerIP)
+		s.Equal(100, config.Listeners["alias"].MaxConnections)
+		s.Equal(200, config.Listeners["domain"].MaxConnections)
+		s.Equal(5*time.Second, config.Listeners["alias"].ReadTimeout)
+		s.Equal(30*time.Second, config.Listeners["senders"].ReadTimeout)
+		s.True(config.Listeners["alias"].NoDelay)
+		s.False(config.Listeners["mailbox"].NoDelay)
+		s.Equal(65536, config.Listeners["domain"].ReceiveBufferSize)
+	})
+
+	s.Run("disabled services", func() {
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("METRICS_ENABLED", "false")
+		defer os.Unsetenv("METRICS_ENABLED")
+
+		config := NewConfig()
+
+		s.True(config.TCPTableEnabled)
+		s.False(config.MetricsEnabled)
+	})
+
+	s.Run("fail when all services disabled", func() {
+		defer func() { log.StandardLogger().ExitFunc = nil }()
+		var fatal bool
+		log.StandardLogger().ExitFunc = func(int) { fatal = true }
+
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("TCP_TABLE_ENABLED", "false")
+		os.Setenv("METRICS_ENABLED", "false")
+		defer os.Unsetenv("TCP_TABLE_ENABLED")
+		defer os.Unsetenv("METRICS_ENABLED")
+
+		_ = NewConfig()
+
+		s.True(fatal)
+	})
+
+	s.Run("fail when chaos rates are out of range", func() {
+		defer func() { log.StandardLogger().ExitFunc = nil }()
+		var fatal bool
+		log.StandardLogger().ExitFunc = func(int) { fatal = true }
+
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("CHAOS_ERROR_RATE", "2")
+		defer os.Unsetenv("CHAOS_ERROR_RATE")
+
+		_ = NewConfig()
+
+		s.True(fatal)
+	})
+
+	s.Run("fail when trace sample ratio is out of range", func() {
+		defer func() { log.StandardLogger().ExitFunc = nil }()
+		var fatal bool
+		log.StandardLogger().ExitFunc = func(int) { fatal = true }
+
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("TRACE_SAMPLE_RATIO", "1.5")
+		defer os.Unsetenv("TRACE_SAMPLE_RATIO")
+
+		_ = NewConfig()
+
+		s.True(fatal)
+	})
+
+	s.Run("fail when pushgateway interval is not positive", func() {
+		defer func() { log.StandardLogger().ExitFunc = nil }()
+		var fatal bool
+		log.StandardLogger().ExitFunc = func(int) { fatal = true }
+
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("PUSHGATEWAY_INTERVAL", "-1s")
+		defer os.Unsetenv("PUSHGATEWAY_INTERVAL")
+
+		_ = NewConfig()
+
+		s.True(fatal)
+	})
+
+	s.Run("fail when secret refresh interval is not positive", func() {
+		defer func() { log.StandardLogger().ExitFunc = nil }()
+		var fatal bool
+		log.StandardLogger().ExitFunc = func(int) { fatal = true }
+
+		os.Setenv("USERLI_TOKEN", "token")
+		os.Setenv("SECRET_REFRESH_INTERVAL", "0s")
+		defer os.Unsetenv("SECRET_REFRESH_INTERVAL")
+
+		_ = NewConfig()
+
+		s.True(fatal)
+	})
+}
+
+func (s *ConfigTestSuite) TestRedacted() {
+	config := &Config{UserliToken: "secret", UserliBaseURL: "http://example.com", ShutdownTimeout: 5 * time.Second}
+
+	fields := config.Redacted()
+
+	s.Equal(redactedValue, fields["userli_token"])
+	s.Equal("http://example.com", fields["userli_base_url"])
+	s.Equal("5s", fields["shutdown_timeout"])
+
+	config.UserliBackends = UserliBackendConfigs{{Name: "other", BaseURL: "http://other.example.com", Token: "other-secret", Domains: []string{"other.org"}}}
+	fields = config.Redacted()
+
+	backends := fields["userli_backends"].([]UserliBackendConfig)
+	s.Equal(redactedValue, backends[0].Token)
+	s.Equal("http://other.example.com", backends[0].BaseURL)
+	s.Equal("other-secret", config.UserliBackends[0].Token)
+}
+
+func (s *ConfigTestSuite) TestStaticBackend() {
+	s.T().Setenv("BACKEND", "static")
+	s.T().Setenv("STATIC_FILE", "/etc/userli-postfix-adapter/static.json")
+
+	config := NewConfig()
+
+	s.Equal(BackendStatic, config.Backend)
+	s.Equal("/etc/userli-postfix-adapter/static.json", config.StaticFile)
+
+	s.Run("missing file", func() {
+		s.T().Setenv("STATIC_FILE", "")
+
+		fatal := false
+		log.StandardLogger().ExitFunc = func(int) { fatal = true }
+		defer func() { log.StandardLogger().ExitFunc = nil }()
+
+		_ = NewConfig()
+
+		s.True(fatal)
+	})
+}
+
+func (s *ConfigTestSuite) TestCustomMaps() {
+	s.T().Setenv("USERLI_TOKEN", "token")
+	s.T().Setenv("CUSTOM_MAPS", "team")
+	s.T().Setenv("TEAM_EXEC", "/usr/local/bin/team-routing --strict")
+	s.T().Setenv("TEAM_LISTEN_ADDR", ":10007")
+	s.T().Setenv("TEAM_READ_TIMEOUT", "1s")
+
+	config := NewConfig()
+
+	s.Equal([]CustomMapConfig{{Name: "team", Command: []string{"/usr/local/bin/team-routing", "--strict"}, Timeout: 5 * time.Second, ListenAddrs: []string{":10007"}}}, config.CustomMaps)
+	s.Equal(time.Second, config.Listeners["team"].ReadTimeout)
+
+	s.Run("reserved name", func() {
+		s.T().Setenv("CUSTOM_MAPS", "alias")
+
+		fatal := false
+		log.StandardLogger().ExitFunc = func(int) { fatal = true }
+		defer func() { log.StandardLogger().ExitFunc = nil }()
+
+		_ = NewConfig()
+
+		s.True(fatal)
+	})
+}
+
+func (s *ConfigTestSuite) TestUserliBackends() {
+	s.T().Setenv("USERLI_TOKEN", "token")
+	s.T().Setenv("USERLI_BACKENDS", "other")
+	s.T().Setenv("USERLI_OTHER_BASE_URL", "http://other.example.com")
+	s.T().Setenv("USERLI_OTHER_TOKEN", "other-token")
+	s.T().Setenv("USERLI_OTHER_DOMAINS", "other.org,Other.net")
+
+	config := NewConfig()
+
+	s.Equal(UserliBackendConfigs{{Name: "other", BaseURL: "http://other.example.com", Token: "other-token", Domains: []string{"other.org", "Other.net"}}}, config.UserliBackends)
+
+	s.Run("missing domains", func() {
+		s.T().Setenv("USERLI_OTHER_DOMAINS", "")
+
+		fatal := false
+		log.StandardLogger().ExitFunc = func(int) { fatal = true }
+		defer func() { log.StandardLogger().ExitFunc = nil }()
+
+		_ = NewConfig()
+
+		s.True(fatal)
+	})
 }
 
 func TestConfig(t *testing.T) {
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// domainLabelOther is used for all domains without an own label.
+	domainLabelOther = "other"
+
+	// domainTopRefresh is the interval the top domains are recomputed in.
+	// The request counts are halved on every refresh, so the top domains
+	// follow the recent traffic.
+	domainTopRefresh = time.Minute
+
+	// domainCountersPerLabel is the number of domains counted per label
+	// to find the top domains with bounded memory.
+	domainCountersPerLabel = 10
+)
+
+// DomainLabeler maps domains to metric label values while keeping the
+// number of distinct values bounded. Allowlisted domains always get their
+// own label, the limit most requested other domains get one as well and
+// all remaining domains are reported as "other".
+type DomainLabeler struct {
+	allowlist map[string]bool
+	limit     int
+
+	mu        sync.Mutex
+	counts    map[string]uint64
+	top       map[string]bool
+	refreshed time.Time
+}
+
+// NewDomainLabeler creates a new DomainLabeler.
+func NewDomainLabeler(allowlist []string, limit int) *DomainLabeler {
+	allowed := make(map[string]bool, len(allowlist))
+	for _, domain := range allowlist {
+		allowed[strings.ToLower(domain)] = true
+	}
+
+	return &DomainLabeler{
+		allowlist: allowed,
+		limit:     limit,
+		counts:    make(map[string]uint64),
+		top:       make(map[string]bool),
+		refreshed: time.Now(),
+	}
+}
+
+// Label counts a request for the domain of key and returns its label
+// value. Key is either an email address or a domain.
+func (d *DomainLabeler) Label(key string) string {
+	domain := key
+	if i := strings.LastIndex(key, "@"); i >= 0 {
+		domain = key[i+1:]
+	}
+	domain = strings.ToLower(domain)
+
+	if domain == "" {
+		return domainLabelOther
+	}
+
+	if d.allowlist[domain] {
+		return domain
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.limit <= 0 {
+		return domainLabelOther
+	}
+
+	d.count(domain)
+	if time.Since(d.refreshed) >= domainTopRefresh {
+		d.refresh()
+	}
+
+	if d.top[domain] {
+		return domain
+	}
+
+	return domainLabelOther
+}
+
+// count increments the counter of domain. If all counters are in use,
+// the least requested domain is replaced and its count is inherited, so
+// new heavy hitters can still rise to the top (space-saving algorithm).
+// The caller must hold the lock.
+func (d *DomainLabeler) count(domain string) {
+	if _, ok := d.counts[domain]; ok || len(d.counts) < d.limit*domainCountersPerLabel {
+		d.counts[domain]++
+		return
+	}
+
+	var minDomain string
+	var minCount uint64
+	for candidate, count := range d.counts {
+		if minDomain == "" || count < minCount {
+			minDomain, minCount = candidate, count
+		}
+	}
+
+	delete(d.counts, minDomain)
+	d.counts[domain] = minCount + 1
+}
+
+// refresh recomputes the top domains and decays the counts. Series of
+// domains that dropped out of the top are removed. The caller must hold
+// the lock.
+func (d *DomainLabeler) refresh() {
+	domains := make([]string, 0, len(d.counts))
+	for domain := range d.counts {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if d.counts[domains[i]] != d.counts[domains[j]] {
+			return d.counts[domains[i]] > d.counts[domains[j]]
+		}
+		return domains[i] < domains[j]
+	})
+
+	top := make(map[string]bool, d.limit)
+	for _, domain := range domains[:min(d.limit, len(domains))] {
+		top[domain] = true
+	}
+
+	for domain := range d.top {
+		if !top[domain] {
+			domainRequests.DeletePartialMatch(prometheus.Labels{"domain": domain})
+		}
+	}
+
+	for domain, count := range d.counts {
+		if count /= 2; count == 0 {
+			delete(d.counts, domain)
+		} else {
+			d.counts[domain] = count
+		}
+	}
+
+	d.top = top
+	d.refreshed = time.Now()
+}
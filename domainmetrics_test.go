@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DomainLabelerTestSuite struct {
+	suite.Suite
+}
+
+func (s *DomainLabelerTestSuite) TestAllowlist() {
+	labeler := NewDomainLabeler([]string{"Example.org"}, 0)
+
+	s.Equal("example.org", labeler.Label("user@example.org"))
+	s.Equal("example.org", labeler.Label("Example.org"))
+	s.Equal(domainLabelOther, labeler.Label("user@example.com"))
+	s.Equal(domainLabelOther, labeler.Label("user@"))
+}
+
+func (s *DomainLabelerTestSuite) TestTopDomains() {
+	labeler := NewDomainLabeler(nil, 1)
+
+	// the first domain seen does not get a label before the refresh
+	s.Equal(domainLabelOther, labeler.Label("user@example.net"))
+	for i := 0; i < 3; i++ {
+		labeler.Label("user@example.com")
+	}
+
+	labeler.mu.Lock()
+	labeler.refresh()
+	labeler.mu.Unlock()
+
+	s.Equal("example.com", labeler.Label("user@example.com"))
+	s.Equal(domainLabelOther, labeler.Label("user@example.net"))
+}
+
+func (s *DomainLabelerTestSuite) TestCountersBounded() {
+	labeler := NewDomainLabeler(nil, 1)
+
+	for i := 0; i < 5; i++ {
+		labeler.Label("user@example.com")
+	}
+	for _, domain := range []string{"a.example", "b.example", "c.example", "d.example", "e.example", "f.example", "g.example", "h.example", "i.example", "j.example", "k.example"} {
+		labeler.Label("user@" + domain)
+	}
+
+	labeler.mu.Lock()
+	defer labeler.mu.Unlock()
+
+	s.Len(labeler.counts, domainCountersPerLabel)
+	s.Equal(uint64(5), labeler.counts["example.com"])
+
+	labeler.refresh()
+	s.Equal(map[string]bool{"example.com": true}, labeler.top)
+}
+
+func TestDomainLabeler(t *testing.T) {
+	suite.Run(t, new(DomainLabelerTestSuite))
+}
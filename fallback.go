@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// tcpTableSourceTimeout limits a lookup in a legacy tcp_table server.
+const tcpTableSourceTimeout = 5 * time.Second
+
+// LookupSource answers the lookups of a single map from a source other
+// than userli, e.g. a legacy lookup server during a migration.
+type LookupSource interface {
+	// Name identifies the source in logs and metrics.
+	Name() string
+
+	// Lookup returns the values of key and whether it was found.
+	Lookup(ctx context.Context, key string) ([]string, bool, error)
+}
+
+// NewLookupSource returns the source for spec, either "tcp:host:port" for
+// a Postfix tcp_table server or "file:/path" for a file with one key and
+// its comma separated values per line like a Postfix map source file.
+func NewLookupSource(spec string) (LookupSource, error) {
+	kind, location, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "tcp":
+		return &TCPTableSource{Addr: location}, nil
+	case "file":
+		return LoadFileSource(location)
+	default:
+		return nil, fmt.Errorf("unknown lookup source %q", spec)
+	}
+}
+
+// TCPTableSource looks up keys in a Postfix tcp_table server.
+type TCPTableSource struct {
+	Addr string
+}
+
+// Name implements LookupSource.
+func (s *TCPTableSource) Name() string {
+	return "tcp:" + s.Addr
+}
+
+// Lookup implements LookupSource.
+func (s *TCPTableSource) Lookup(ctx context.Context, key string) ([]string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, tcpTableSourceTimeout)
+	defer cancel()
+
+	line, err := exchange(ctx, s.Addr, "get "+url.PathEscape(key)+"\n")
+	if err != nil {
+		return nil, false, err
+	}
+
+	status, data, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	switch status {
+	case "200":
+		value, err := url.PathUnescape(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("malformed response %q", line)
+		}
+		return splitValues(value), true, nil
+	case "500":
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("unexpected response %q", line)
+	}
+}
+
+// FileSource looks up keys in a file loaded at startup. Keys are matched
+// case-insensitively like in Postfix maps.
+type FileSource struct {
+	path    string
+	entries map[string][]string
+}
+
+// LoadFileSource reads the file at path. Empty lines and lines starting
+// with # are ignored.
+func LoadFileSource(path string) (*FileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, " ")
+		entries[strings.ToLower(key)] = splitValues(value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &FileSource{path: path, entries: entries}, nil
+}
+
+// Name implements LookupSource.
+func (s *FileSource) Name() string {
+	return "file:" + s.path
+}
+
+// Lookup implements LookupSource. Like in Postfix virtual maps, an
+// address without an entry matches the entry "@domain" of its domain.
+func (s *FileSource) Lookup(_ context.Context, key string) ([]string, bool, error) {
+	key = strings.ToLower(key)
+	if values, ok := s.entries[key]; ok {
+		return values, true, nil
+	}
+
+	if i := strings.LastIndex(key, "@"); i > 0 {
+		values, ok := s.entries[key[i:]]
+		return values, ok, nil
+	}
+
+	return nil, false, nil
+}
+
+// splitValues splits a comma separated list of values.
+func splitValues(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// FallbackUserli consults the sources of a map in order when userli has
+// no result for a key, e.g. for addresses not yet migrated to userli. For
+// maps in merge mode, the values of userli and of all sources having the
+// key are combined instead, in this order and without duplicates.
+type FallbackUserli struct {
+	primary UserliService
+	sources map[string][]LookupSource
+	merge   map[string]bool
+}
+
+// NewFallbackUserli returns a service consulting the sources by map name
+// on a miss in primary, or always for the maps in merge. Merging only
+// applies to the alias and senders maps.
+func NewFallbackUserli(primary UserliService, sources map[string][]LookupSource, merge map[string]bool) *FallbackUserli {
+	return &FallbackUserli{primary: primary, sources: sources, merge: merge}
+}
+
+// GetAliases implements UserliService.
+func (f *FallbackUserli) GetAliases(ctx context.Context, email string) ([]string, error) {
+	aliases, err := f.primary.GetAliases(ctx, email)
+	if err != nil {
+		return aliases, err
+	}
+
+	return f.chain(ctx, "alias", email, aliases)
+}
+
+// GetDomain implements UserliService.
+func (f *FallbackUserli) GetDomain(ctx context.Context, domain string) (bool, error) {
+	exists, err := f.primary.GetDomain(ctx, domain)
+	if err != nil || exists {
+		return exists, err
+	}
+
+	_, exists, err = f.lookup(ctx, "domain", domain)
+	return exists, err
+}
+
+// GetMailbox implements UserliService.
+func (f *FallbackUserli) GetMailbox(ctx context.Context, email string) (bool, error) {
+	exists, err := f.primary.GetMailbox(ctx, email)
+	if err != nil || exists {
+		return exists, err
+	}
+
+	_, exists, err = f.lookup(ctx, "mailbox", email)
+	return exists, err
+}
+
+// GetSenders implements UserliService.
+func (f *FallbackUserli) GetSenders(ctx context.Context, email string) ([]string, error) {
+	senders, err := f.primary.GetSenders(ctx, email)
+	if err != nil {
+		return senders, err
+	}
+
+	return f.chain(ctx, "senders", email, senders)
+}
+
+// chain completes the values of userli for key with the sources of
+// mapName.
+func (f *FallbackUserli) chain(ctx context.Context, mapName, key string, values []string) ([]string, error) {
+	if !f.merge[mapName] {
+		if len(values) > 0 {
+			return values, nil
+		}
+
+		values, _, err := f.lookup(ctx, mapName, key)
+		return values, err
+	}
+
+	seen := make(map[string]bool, len(values))
+	merged := make([]string, 0, len(values))
+	add := func(values []string) {
+		for _, value := range values {
+			if !seen[value] {
+				seen[value] = true
+				merged = append(merged, value)
+			}
+		}
+	}
+
+	add(values)
+	for _, source := range f.sources[mapName] {
+		sourceValues, _, err := f.lookupSource(ctx, mapName, source, key)
+		if err != nil {
+			return nil, err
+		}
+		add(sourceValues)
+	}
+
+	return merged, nil
+}
+
+// lookup returns the result of the first source of mapName that has key.
+// An error of a source is returned, so Postfix retries instead of
+// treating the key as unknown.
+func (f *FallbackUserli) lookup(ctx context.Context, mapName, key string) ([]string, bool, error) {
+	for _, source := range f.sources[mapName] {
+		values, found, err := f.lookupSource(ctx, mapName, source, key)
+		if err != nil || found {
+			return values, found, err
+		}
+	}
+
+	return nil, false, nil
+}
+
+// lookupSource looks up key in source and counts the result.
+func (f *FallbackUserli) lookupSource(ctx context.Context, mapName string, source LookupSource, key string) ([]string, bool, error) {
+	values, found, err := source.Lookup(ctx, key)
+
+	result := "miss"
+	switch {
+	case err != nil:
+		result = "error"
+	case found:
+		result = "hit"
+	}
+	name := source.Name()
+	addCounter(fallbackLookups.WithLabelValues(mapName, name, result), "fallback_lookups", 1, map[string]string{"map": mapName, "source": name, "result": result})
+
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", source.Name(), err)
+	}
+
+	return values, found, nil
+}
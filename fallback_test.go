@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type FallbackTestSuite struct {
+	suite.Suite
+}
+
+func (s *FallbackTestSuite) TestFileSource() {
+	path := filepath.Join(s.T().TempDir(), "aliases")
+	s.Require().NoError(os.WriteFile(path, []byte("# legacy aliases\n\nOld@example.com a@example.com, b@example.com\nexample.org 1\n"), 0600))
+
+	source, err := NewLookupSource("file:" + path)
+	s.Require().NoError(err)
+	s.Equal("file:"+path, source.Name())
+
+	values, found, err := source.Lookup(context.Background(), "old@EXAMPLE.com")
+	s.NoError(err)
+	s.True(found)
+	s.Equal([]string{"a@example.com", "b@example.com"}, values)
+
+	_, found, err = source.Lookup(context.Background(), "new@example.com")
+	s.NoError(err)
+	s.False(found)
+
+	_, err = NewLookupSource("file:" + filepath.Join(s.T().TempDir(), "missing"))
+	s.Error(err)
+
+	_, err = NewLookupSource("ldap://legacy")
+	s.Error(err)
+}
+
+func (s *FallbackTestSuite) TestTCPTableSource() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			request, _ := bufio.NewReader(conn).ReadString('\n')
+			switch request {
+			case "get old@example.com\n":
+				_, _ = conn.Write([]byte("200 a@example.com,b%20c@example.com\n"))
+			case "get new@example.com\n":
+				_, _ = conn.Write([]byte("500 NO%20RESULT\n"))
+			default:
+				_, _ = conn.Write([]byte("400 ERROR\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	source, err := NewLookupSource("tcp:" + listener.Addr().String())
+	s.Require().NoError(err)
+
+	values, found, err := source.Lookup(context.Background(), "old@example.com")
+	s.NoError(err)
+	s.True(found)
+	s.Equal([]string{"a@example.com", "b c@example.com"}, values)
+
+	_, found, err = source.Lookup(context.Background(), "new@example.com")
+	s.NoError(err)
+	s.False(found)
+
+	_, _, err = source.Lookup(context.Background(), "error@example.com")
+	s.Error(err)
+}
+
+func (s *FallbackTestSuite) TestFallbackUserli() {
+	ctx := context.Background()
+	userli := new(MockUserliService)
+	userli.On("GetAliases", ctx, "user@example.com").Return([]string{"user@example.org"}, nil)
+	userli.On("GetAliases", ctx, mock.Anything).Return([]string{}, nil)
+	userli.On("GetMailbox", ctx, mock.Anything).Return(false, nil)
+	userli.On("GetDomain", ctx, mock.Anything).Return(false, errors.New("error"))
+
+	legacy := &FileSource{path: "legacy", entries: map[string][]string{
+		"old@example.com": {"old@example.net"},
+		"example.com":     {"1"},
+	}}
+	fallback := NewFallbackUserli(userli, map[string][]LookupSource{
+		"alias":   {legacy},
+		"mailbox": {legacy},
+		"domain":  {legacy},
+	}, nil)
+
+	hits := testutil.ToFloat64(fallbackLookups.WithLabelValues("alias", "file:legacy", "hit"))
+
+	aliases, err := fallback.GetAliases(ctx, "user@example.com")
+	s.NoError(err)
+	s.Equal([]string{"user@example.org"}, aliases)
+
+	aliases, err = fallback.GetAliases(ctx, "old@example.com")
+	s.NoError(err)
+	s.Equal([]string{"old@example.net"}, aliases)
+	s.Equal(hits+1, testutil.ToFloat64(fallbackLookups.WithLabelValues("alias", "file:legacy", "hit")))
+
+	exists, err := fallback.GetMailbox(ctx, "old@example.com")
+	s.NoError(err)
+	s.True(exists)
+
+	exists, err = fallback.GetMailbox(ctx, "unknown@example.com")
+	s.NoError(err)
+	s.False(exists)
+
+	// errors of userli are not hidden by the fallback
+	_, err = fallback.GetDomain(ctx, "example.com")
+	s.Error(err)
+
+	senders, err := NewFallbackUserli(userli, nil, nil).GetAliases(ctx, "unknown@example.com")
+	s.NoError(err)
+	s.Empty(senders)
+}
+
+func (s *FallbackTestSuite) TestMerge() {
+	ctx := context.Background()
+	userli := new(MockUserliService)
+	userli.On("GetAliases", ctx, "user@example.com").Return([]string{"user@example.org", "archive@example.net"}, nil)
+	userli.On("GetAliases", ctx, mock.Anything).Return([]string{}, nil)
+
+	archive := &FileSource{path: "archive", entries: map[string][]string{"@example.com": {"archive@example.net"}}}
+	extra := &FileSource{path: "extra", entries: map[string][]string{"user@example.com": {"extra@example.net"}}}
+	fallback := NewFallbackUserli(userli, map[string][]LookupSource{"alias": {extra, archive}}, map[string]bool{"alias": true})
+
+	aliases, err := fallback.GetAliases(ctx, "user@example.com")
+	s.NoError(err)
+	s.Equal([]string{"user@example.org", "archive@example.net", "extra@example.net"}, aliases)
+
+	aliases, err = fallback.GetAliases(ctx, "other@example.com")
+	s.NoError(err)
+	s.Equal([]string{"archive@example.net"}, aliases)
+
+	aliases, err = fallback.GetAliases(ctx, "other@example.org")
+	s.NoError(err)
+	s.Empty(aliases)
+}
+
+func TestFallback(t *testing.T) {
+	suite.Run(t, new(FallbackTestSuite))
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// handoverFDsEnv lists the keys of the sockets passed to a new process
+	// in the order of the file descriptors starting at 3.
+	handoverFDsEnv = "HANDOVER_FDS"
+
+	// handoverReadyEnv is the file descriptor the new process writes to
+	// once it accepts connections.
+	handoverReadyEnv = "HANDOVER_READY_FD"
+)
+
+var errUpgradeInProgress = errors.New("upgrade already in progress")
+
+// Handover passes the listening sockets to a new process of the adapter
+// on upgrade. The sockets stay open during the upgrade, so Postfix never
+// sees a refused connection while the old process drains.
+type Handover struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	listeners map[string]net.Listener
+	keys      []string
+	ready     *os.File
+	upgrading bool
+}
+
+// NewHandover returns a Handover holding the sockets inherited from the
+// previous process, if any.
+func NewHandover() *Handover {
+	h := &Handover{inherited: make(map[string]*os.File), listeners: make(map[string]net.Listener)}
+
+	if keys := os.Getenv(handoverFDsEnv); keys != "" {
+		for i, key := range strings.Split(keys, ",") {
+			h.inherited[key] = os.NewFile(uintptr(3+i), key)
+		}
+	}
+
+	if fd, err := strconv.Atoi(os.Getenv(handoverReadyEnv)); err == nil {
+		h.ready = os.NewFile(uintptr(fd), "handover-ready")
+	}
+
+	// the sockets are passed again explicitly on the next upgrade
+	os.Unsetenv(handoverFDsEnv)
+	os.Unsetenv(handoverReadyEnv)
+
+	return h
+}
+
+// Listen returns the socket for key inherited from the previous process
+// or binds a new one with lc. It binds a new socket on a nil Handover.
+func (h *Handover) Listen(ctx context.Context, lc net.ListenConfig, network, key, addr string) (net.Listener, error) {
+	if h == nil {
+		return lc.Listen(ctx, network, addr)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var listener net.Listener
+	if file, ok := h.inherited[key]; ok {
+		delete(h.inherited, key)
+
+		var err error
+		listener, err = net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherit %s: %w", key, err)
+		}
+		log.WithFields(log.Fields{"key": key, "addr": listener.Addr().String()}).Info("Inherited listener")
+	} else {
+		var err error
+		listener, err = lc.Listen(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := h.listeners[key]; !ok {
+		h.keys = append(h.keys, key)
+	}
+	h.listeners[key] = listener
+
+	return listener, nil
+}
+
+// Ready tells the previous process that all sockets are taken over, so it
+// can shut down. Inherited sockets that are no longer configured are
+// closed. It is safe to call on a nil Handover.
+func (h *Handover) Ready() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key, file := range h.inherited {
+		log.WithField("key", key).Warn("Closing inherited listener that is no longer configured")
+		file.Close()
+		delete(h.inherited, key)
+	}
+
+	if h.ready == nil {
+		return nil
+	}
+
+	defer func() {
+		h.ready.Close()
+		h.ready = nil
+	}()
+
+	_, err := h.ready.Write([]byte{1})
+	return err
+}
+
+// Upgrade starts the running binary again with the same arguments, passes
+// all sockets to it and waits until it is ready. The new process is
+// killed if it is not ready within the timeout.
+func (h *Handover) Upgrade(ctx context.Context, timeout time.Duration) (err error) {
+	files, keys, err := h.files()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+		if err != nil {
+			h.mu.Lock()
+			h.upgrading = false
+			h.mu.Unlock()
+		}
+	}()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find executable: %w", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		handoverFDsEnv+"="+strings.Join(keys, ","),
+		handoverReadyEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	cmd.ExtraFiles = append(files, readyW)
+
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("start %s: %w", executable, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("new process exited before it was ready: %w", err)
+		}
+		log.WithField("pid", cmd.Process.Pid).Info("New process is ready")
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("new process exited before it was ready: %w", err)
+	case <-timer.C:
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("new process not ready within %s", timeout)
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		return ctx.Err()
+	}
+}
+
+// files duplicates the file descriptors of all sockets for a new process.
+func (h *Handover) files() ([]*os.File, []string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.upgrading {
+		return nil, nil, errUpgradeInProgress
+	}
+
+	files := make([]*os.File, 0, len(h.keys))
+	keys := make([]string, 0, len(h.keys))
+	for _, key := range h.keys {
+		listener, ok := h.listeners[key].(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+
+		file, err := listener.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("duplicate %s: %w", key, err)
+		}
+		files = append(files, file)
+		keys = append(keys, key)
+	}
+	h.upgrading = true
+
+	return files, keys, nil
+}
+
+// WatchSignals upgrades on SIGUSR2 until the context is canceled. Once the
+// new process is ready, shutdown is called to drain this one.
+func (h *Handover) WatchSignals(ctx context.Context, timeout time.Duration, shutdown func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Info("Upgrading")
+			if err := h.Upgrade(ctx, timeout); err != nil {
+				log.WithError(err).Error("Error upgrading")
+				continue
+			}
+			shutdown()
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type HandoverTestSuite struct {
+	suite.Suite
+}
+
+func (s *HandoverTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *HandoverTestSuite) TestListen() {
+	s.Run("nil handover binds a new socket", func() {
+		var handover *Handover
+
+		listener, err := handover.Listen(context.Background(), net.ListenConfig{}, "tcp", "alias/:0/0", "127.0.0.1:0")
+		s.Require().NoError(err)
+		defer listener.Close()
+
+		s.NoError(handover.Ready())
+	})
+
+	s.Run("inherited socket", func() {
+		previous, err := net.Listen("tcp", "127.0.0.1:0")
+		s.Require().NoError(err)
+		file, err := previous.(*net.TCPListener).File()
+		s.Require().NoError(err)
+
+		handover := &Handover{
+			inherited: map[string]*os.File{"alias/:10001/0": file},
+			listeners: make(map[string]net.Listener),
+		}
+
+		listener, err := handover.Listen(context.Background(), net.ListenConfig{}, "tcp", "alias/:10001/0", ":10001")
+		s.Require().NoError(err)
+		defer listener.Close()
+
+		s.Equal(previous.Addr().String(), listener.Addr().String())
+		s.Equal([]string{"alias/:10001/0"}, handover.keys)
+		s.Empty(handover.inherited)
+
+		// the socket stays open after the previous process closed it
+		previous.Close()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		s.Require().NoError(err)
+		conn.Close()
+	})
+}
+
+func (s *HandoverTestSuite) TestReady() {
+	unused, err := os.CreateTemp(s.T().TempDir(), "unused")
+	s.Require().NoError(err)
+
+	readyR, readyW, err := os.Pipe()
+	s.Require().NoError(err)
+	defer readyR.Close()
+
+	handover := &Handover{
+		inherited: map[string]*os.File{"senders/:10004/0": unused},
+		listeners: make(map[string]net.Listener),
+		ready:     readyW,
+	}
+
+	s.NoError(handover.Ready())
+	s.Empty(handover.inherited)
+
+	data, err := io.ReadAll(readyR)
+	s.NoError(err)
+	s.Equal([]byte{1}, data)
+}
+
+func (s *HandoverTestSuite) TestFiles() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer listener.Close()
+
+	handover := &Handover{
+		listeners: map[string]net.Listener{"domain/:10002/0": listener},
+		keys:      []string{"domain/:10002/0"},
+	}
+
+	files, keys, err := handover.files()
+	s.Require().NoError(err)
+	s.Len(files, 1)
+	s.Equal([]string{"domain/:10002/0"}, keys)
+	for _, file := range files {
+		file.Close()
+	}
+
+	_, _, err = handover.files()
+	s.ErrorIs(err, errUpgradeInProgress)
+}
+
+func TestHandover(t *testing.T) {
+	suite.Run(t, new(HandoverTestSuite))
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+
+	// healthCheckDomain is looked up to check the userli API.
+	healthCheckDomain = "health-check.invalid"
+
+	healthCheckTimeout = 5 * time.Second
+)
+
+// probeConns holds the connections of the running probes, so the lookup
+// servers can tell them from the lookups of Postfix.
+var probeConns = &probeConnections{}
+
+// probeConnections is a set of the local addresses of probe connections.
+type probeConnections struct {
+	active atomic.Int32
+	addrs  sync.Map
+}
+
+func (p *probeConnections) add(addr net.Addr) {
+	p.addrs.Store(addr.String(), struct{}{})
+	p.active.Add(1)
+}
+
+func (p *probeConnections) remove(addr net.Addr) {
+	p.active.Add(-1)
+	p.addrs.Delete(addr.String())
+}
+
+// contains reports whether the accepted connection conn was opened by a
+// probe. It only looks at the address while a probe runs.
+func (p *probeConnections) contains(conn net.Conn) bool {
+	if p.active.Load() == 0 {
+		return false
+	}
+
+	_, ok := p.addrs.Load(conn.RemoteAddr().String())
+	return ok
+}
+
+// Health tracks the state of the listeners and checks the userli API.
+type Health struct {
+	userli UserliService
+
+	// CheckMap and CheckKey are the map and key looked up to check the
+	// userli API.
+	CheckMap string
+	CheckKey string
+
+	mu          sync.RWMutex
+	listeners   map[string]bool
+	probes      map[string]error
+	initialized bool
+	started     bool
+}
+
+// HealthCheck is the result of a single check.
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthReport is the result of all checks.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// NewHealth creates a new Health checking the given userli service.
+func NewHealth(userli UserliService) *Health {
+	return &Health{
+		userli:    userli,
+		CheckMap:  "domain",
+		CheckKey:  healthCheckDomain,
+		listeners: make(map[string]bool),
+		probes:    make(map[string]error),
+	}
+}
+
+// SetListener records whether the listener of server on addr is accepting
+// connections. It is safe to call on a nil Health.
+func (h *Health) SetListener(server, addr string, up bool) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.listeners["listener_"+server+"_"+addr] = up
+}
+
+// SetInitialized records that the adapter completed its initialization.
+// It is safe to call on a nil Health.
+func (h *Health) SetInitialized() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.initialized = true
+}
+
+// Report runs all checks.
+func (h *Health) Report(ctx context.Context) HealthReport {
+	report := HealthReport{Status: HealthStatusOK, Checks: make(map[string]HealthCheck)}
+
+	h.mu.RLock()
+	for name, up := range h.listeners {
+		if up {
+			report.Checks[name] = HealthCheck{Status: HealthStatusOK}
+		} else {
+			report.Checks[name] = HealthCheck{Status: HealthStatusFail, Error: "listener is not accepting connections"}
+		}
+	}
+	for name, err := range h.probes {
+		if err == nil {
+			report.Checks["probe_"+name] = HealthCheck{Status: HealthStatusOK}
+		} else {
+			report.Checks["probe_"+name] = HealthCheck{Status: HealthStatusFail, Error: err.Error()}
+		}
+	}
+	h.mu.RUnlock()
+
+	report.Checks["userli"] = h.checkUserli(ctx)
+
+	for _, check := range report.Checks {
+		if check.Status != HealthStatusOK {
+			report.Status = HealthStatusFail
+		}
+	}
+
+	return report
+}
+
+func (h *Health) checkUserli(ctx context.Context) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var err error
+	switch h.CheckMap {
+	case "alias":
+		_, err = h.userli.GetAliases(ctx, h.CheckKey)
+	case "mailbox":
+		_, err = h.userli.GetMailbox(ctx, h.CheckKey)
+	case "senders":
+		_, err = h.userli.GetSenders(ctx, h.CheckKey)
+	default:
+		_, err = h.userli.GetDomain(ctx, h.CheckKey)
+	}
+	if err != nil {
+		return HealthCheck{Status: HealthStatusFail, Error: err.Error()}
+	}
+
+	return HealthCheck{Status: HealthStatusOK}
+}
+
+// HealthHandler serves the detailed health report as JSON. It responds
+// with 503 if any check fails.
+func (h *Health) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	report := h.Report(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != HealthStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// ReadinessHandler responds with 200 once all listeners are accepting
+// connections and the userli API is reachable, and with 503 otherwise.
+func (h *Health) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	if name, ok := h.listenersUp(); !ok {
+		http.Error(w, name+" is not accepting connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	if name, err := h.probeFailure(); err != nil {
+		http.Error(w, name+" lookup server: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if check := h.checkUserli(r.Context()); check.Status != HealthStatusOK {
+		http.Error(w, "userli: "+check.Error, http.StatusServiceUnavailable)
+		return
+	}
+
+	_, _ = w.Write([]byte(HealthStatusOK))
+}
+
+// StartupHandler responds with 200 once the adapter is initialized and all
+// listeners accepted connections once. Unlike ReadinessHandler it does not
+// check the userli API and never fails again after it succeeded.
+func (h *Health) StartupHandler(w http.ResponseWriter, _ *http.Request) {
+	if !h.startupComplete() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+
+	_, _ = w.Write([]byte(HealthStatusOK))
+}
+
+func (h *Health) startupComplete() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.started || !h.initialized {
+		return h.started
+	}
+
+	for _, up := range h.listeners {
+		if !up {
+			return false
+		}
+	}
+	h.started = true
+
+	return true
+}
+
+// listenersUp reports whether all listeners accept connections. If not,
+// it returns the name of one listener that is down.
+func (h *Health) listenersUp() (string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for name, up := range h.listeners {
+		if !up {
+			return name, false
+		}
+	}
+
+	return "", true
+}
+
+// Probe sends a lookup to the lookup server of every map in servers, a map
+// of the map names to their addresses, every interval until ctx is
+// canceled. A server that accepts connections but does not answer fails
+// the health and readiness checks.
+func (h *Health) Probe(ctx context.Context, servers map[string]string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for name, addr := range servers {
+			h.probe(ctx, name, addr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends a single lookup to the server of the map name at addr.
+func (h *Health) probe(ctx context.Context, name, addr string) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	// temporary errors of the userli API are not a failure of the lookup
+	// server
+	conn, err := dial(ctx, loopbackAddr(addr))
+	if err == nil {
+		probeConns.add(conn.LocalAddr())
+		_, err = lookupStatus(conn, h.CheckKey)
+		probeConns.remove(conn.LocalAddr())
+		conn.Close()
+	}
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+		log.WithError(err).WithField("map", name).Warn("Lookup server probe failed")
+		setGaugeVec(probeUp, "probe_up", 0, prometheus.Labels{"handler": name})
+	} else {
+		setGaugeVec(probeUp, "probe_up", 1, prometheus.Labels{"handler": name})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.probes[name] = err
+}
+
+// probeFailure returns the name and error of a failed probe, if any.
+func (h *Health) probeFailure() (string, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for name, err := range h.probes {
+		if err != nil {
+			return name, err
+		}
+	}
+
+	return "", nil
+}
+
+// LivenessHandler responds with 200 as long as the process is serving HTTP.
+func LivenessHandler(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte(HealthStatusOK))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type HealthTestSuite struct {
+	suite.Suite
+}
+
+func (s *HealthTestSuite) serve(health *Health) (int, HealthReport) {
+	rec := httptest.NewRecorder()
+	health.HealthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+
+	var report HealthReport
+	s.NoError(json.NewDecoder(rec.Body).Decode(&report))
+
+	return rec.Code, report
+}
+
+func (s *HealthTestSuite) TestHealthHandler() {
+	s.Run("healthy", func() {
+		userli := new(MockUserliService)
+		userli.On("GetDomain", mock.Anything, healthCheckDomain).Return(false, nil)
+
+		health := NewHealth(userli)
+		health.SetListener("alias", "127.0.0.1:10001", true)
+
+		code, report := s.serve(health)
+		s.Equal(http.StatusOK, code)
+		s.Equal(HealthStatusOK, report.Status)
+		s.Equal(HealthStatusOK, report.Checks["listener_alias_127.0.0.1:10001"].Status)
+		s.Equal(HealthStatusOK, report.Checks["userli"].Status)
+	})
+
+	s.Run("listener down", func() {
+		userli := new(MockUserliService)
+		userli.On("GetDomain", mock.Anything, healthCheckDomain).Return(false, nil)
+
+		health := NewHealth(userli)
+		health.SetListener("alias", "127.0.0.1:10001", false)
+
+		code, report := s.serve(health)
+		s.Equal(http.StatusServiceUnavailable, code)
+		s.Equal(HealthStatusFail, report.Status)
+		s.Equal(HealthStatusFail, report.Checks["listener_alias_127.0.0.1:10001"].Status)
+	})
+
+	s.Run("userli unreachable", func() {
+		userli := new(MockUserliService)
+		userli.On("GetDomain", mock.Anything, healthCheckDomain).Return(false, errors.New("connection refused"))
+
+		code, report := s.serve(NewHealth(userli))
+		s.Equal(http.StatusServiceUnavailable, code)
+		s.Equal(HealthCheck{Status: HealthStatusFail, Error: "connection refused"}, report.Checks["userli"])
+	})
+}
+
+func (s *HealthTestSuite) TestCheckKey() {
+	userli := new(MockUserliService)
+	userli.On("GetMailbox", mock.Anything, "postmaster@example.org").Return(true, nil)
+
+	health := NewHealth(userli)
+	health.CheckMap = "mailbox"
+	health.CheckKey = "postmaster@example.org"
+
+	code, report := s.serve(health)
+	s.Equal(http.StatusOK, code)
+	s.Equal(HealthStatusOK, report.Checks["userli"].Status)
+	userli.AssertExpectations(s.T())
+	userli.AssertNotCalled(s.T(), "GetDomain", mock.Anything, mock.Anything)
+}
+
+func (s *HealthTestSuite) TestReadinessHandler() {
+	userli := new(MockUserliService)
+	userli.On("GetDomain", mock.Anything, healthCheckDomain).Return(false, nil)
+
+	health := NewHealth(userli)
+	health.SetListener("alias", "127.0.0.1:10001", false)
+
+	rec := httptest.NewRecorder()
+	health.ReadinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	s.Equal(http.StatusServiceUnavailable, rec.Code)
+
+	health.SetListener("alias", "127.0.0.1:10001", true)
+
+	rec = httptest.NewRecorder()
+	health.ReadinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	s.Equal(http.StatusOK, rec.Code)
+}
+
+func (s *HealthTestSuite) TestStartupHandler() {
+	userli := new(MockUserliService)
+	health := NewHealth(userli)
+	health.SetListener("alias", "127.0.0.1:10001", false)
+
+	startup := func() int {
+		rec := httptest.NewRecorder()
+		health.StartupHandler(rec, httptest.NewRequest("GET", "/startupz", nil))
+		return rec.Code
+	}
+
+	s.Equal(http.StatusServiceUnavailable, startup())
+
+	health.SetInitialized()
+	s.Equal(http.StatusServiceUnavailable, startup())
+
+	health.SetListener("alias", "127.0.0.1:10001", true)
+	s.Equal(http.StatusOK, startup())
+
+	// does not flap once started
+	health.SetListener("alias", "127.0.0.1:10001", false)
+	s.Equal(http.StatusOK, startup())
+
+	userli.AssertNotCalled(s.T(), "GetDomain", mock.Anything, mock.Anything)
+}
+
+func (s *HealthTestSuite) TestProbe() {
+	userli := new(MockUserliService)
+	userli.On("GetDomain", mock.Anything, healthCheckDomain).Return(false, nil)
+	health := NewHealth(userli)
+
+	answering, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer answering.Close()
+	go func() {
+		for {
+			conn, err := answering.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Read(make([]byte, 64))
+			_, _ = conn.Write([]byte("500 NO%20RESULT\n"))
+			conn.Close()
+		}
+	}()
+
+	// accepts connections, but never answers
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer hung.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	health.probe(ctx, "alias", answering.Addr().String())
+	s.Equal(1.0, testutil.ToFloat64(probeUp.WithLabelValues("alias")))
+
+	rec := httptest.NewRecorder()
+	health.ReadinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	s.Equal(http.StatusOK, rec.Code)
+
+	health.probe(ctx, "mailbox", hung.Addr().String())
+	s.Equal(0.0, testutil.ToFloat64(probeUp.WithLabelValues("mailbox")))
+
+	code, report := s.serve(health)
+	s.Equal(http.StatusServiceUnavailable, code)
+	s.Equal(HealthStatusOK, report.Checks["probe_alias"].Status)
+	s.Equal(HealthStatusFail, report.Checks["probe_mailbox"].Status)
+
+	rec = httptest.NewRecorder()
+	health.ReadinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	s.Equal(http.StatusServiceUnavailable, rec.Code)
+	s.Contains(rec.Body.String(), "mailbox lookup server")
+}
+
+func (s *HealthTestSuite) TestProbeIsNoLookup() {
+	userli := new(MockUserliService)
+	userli.On("GetDomain", mock.Anything, mock.Anything).Return(false, nil)
+	health := NewHealth(userli)
+
+	var accessLog bytes.Buffer
+	adapter := NewPostfixAdapter(userli)
+	adapter.AccessLog = log.New()
+	adapter.AccessLog.SetOutput(&accessLog)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server, err := NewTCPServer(ctx, TCPServerConfig{Name: "domain", Addrs: []string{"127.0.0.1:0"}, Handler: adapter.DomainHandler})
+	s.Require().NoError(err)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+	addr := server.listeners[0].Addr().String()
+
+	health.probe(ctx, "domain", addr)
+	s.Equal(1.0, testutil.ToFloat64(probeUp.WithLabelValues("domain")))
+
+	_, err = sendLookup(ctx, addr, "example.org")
+	s.Require().NoError(err)
+
+	// the server drains the connections before it stops
+	cancel()
+	wg.Wait()
+	s.Contains(accessLog.String(), "key=example.org")
+	s.NotContains(accessLog.String(), "key="+healthCheckDomain)
+}
+
+func (s *HealthTestSuite) TestLivenessHandler() {
+	rec := httptest.NewRecorder()
+	LivenessHandler(rec, httptest.NewRequest("GET", "/livez", nil))
+
+	s.Equal(http.StatusOK, rec.Code)
+	s.Equal("ok", rec.Body.String())
+}
+
+func TestHealth(t *testing.T) {
+	suite.Run(t, new(HealthTestSuite))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// hookMaxOutput is the maximum size of the output of a hook.
+	hookMaxOutput = 64 * 1024
+
+	// hookPath is the only environment variable passed to hooks besides
+	// the map name, so they do not see secrets like USERLI_TOKEN.
+	hookPath = "PATH=/usr/local/bin:/usr/bin:/bin"
+)
+
+// ExecHook answers the lookups of a custom map by running a command. The
+// key is written to its standard input. The first line of the output is
+// the result, an empty output means not found and a failed command or a
+// timeout is a temporary error.
+type ExecHook struct {
+	Name    string
+	Command []string
+	Timeout time.Duration
+}
+
+// HookHandler handles the get command for the custom map of hook.
+func (p *PostfixAdapter) HookHandler(hook *ExecHook) func(net.Conn) {
+	return func(conn net.Conn) {
+		p.handle(conn, hook.Name, hook.lookup)
+	}
+}
+
+func (h *ExecHook) lookup(ctx context.Context, logger *log.Entry, key string) Response {
+	value, err := h.run(ctx, key)
+
+	result := "found"
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		result = "timeout"
+	case err != nil:
+		result = "error"
+	case value == "":
+		result = "not_found"
+	}
+	addCounter(hookRuns.WithLabelValues(h.Name, result), "hook_runs", 1, map[string]string{"map": h.Name, "result": result})
+
+	if err != nil {
+		logger.WithError(err).WithField("key", key).Error("Error running hook")
+		return Response{Status: StatusError, Response: "Error running hook"}
+	}
+
+	if value == "" {
+		return Response{Status: StatusNoResult, Response: ResponseNoResult}
+	}
+
+	return Response{Status: StatusOK, Response: value}
+}
+
+// errHookOutputTooLarge is returned if a hook writes more than
+// hookMaxOutput bytes.
+var errHookOutputTooLarge = errors.New("hook output too large")
+
+// run executes the command for key and returns the first line of its
+// output. The command is killed once its output exceeds hookMaxOutput.
+func (h *ExecHook) run(ctx context.Context, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	killCtx, kill := context.WithCancel(ctx)
+	defer kill()
+
+	stdout := &limitedBuffer{limit: hookMaxOutput, exceeded: kill}
+	stderr := &limitedBuffer{limit: hookMaxOutput}
+	cmd := exec.CommandContext(killCtx, h.Command[0], h.Command[1:]...)
+	cmd.Env = []string{hookPath, "USERLI_POSTFIX_ADAPTER_MAP=" + h.Name}
+	cmd.Stdin = strings.NewReader(key + "\n")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if stdout.full {
+		return "", errHookOutputTooLarge
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%w: %s", err, message)
+		}
+		return "", err
+	}
+
+	line, _, _ := strings.Cut(stdout.String(), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+// limitedBuffer keeps up to limit bytes and drops the rest. exceeded is
+// called once if more is written. The buffer is not embedded, so io.Copy
+// can not bypass Write with its ReadFrom.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	full     bool
+	exceeded func()
+}
+
+// Write implements io.Writer. It never fails, so the command is not
+// stopped by a broken pipe before it is killed.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		if !b.full && b.exceeded != nil {
+			b.exceeded()
+		}
+		b.full = true
+		return len(p), nil
+	}
+
+	return b.buf.Write(p)
+}
+
+// String returns the kept output.
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
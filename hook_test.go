@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type HookTestSuite struct {
+	suite.Suite
+}
+
+func (s *HookTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *HookTestSuite) lookup(hook *ExecHook, key string) string {
+	adapter := NewPostfixAdapter(new(MockUserliService))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		adapter.HookHandler(hook)(server)
+	}()
+
+	_, err := client.Write([]byte("get " + key + "\n"))
+	s.Require().NoError(err)
+
+	response, err := io.ReadAll(client)
+	s.Require().NoError(err)
+
+	return string(response)
+}
+
+func (s *HookTestSuite) TestLookup() {
+	script := `read key; case "$key" in team@example.org) echo "a@example.org,b@example.org";; fail@example.org) echo broken >&2; exit 2;; esac`
+	hook := &ExecHook{Name: "team", Command: []string{"/bin/sh", "-c", script}, Timeout: time.Second}
+
+	found := testutil.ToFloat64(hookRuns.WithLabelValues("team", "found"))
+
+	s.Equal("200 a@example.org,b@example.org\n", s.lookup(hook, "team@example.org"))
+	s.Equal("500 NO%20RESULT\n", s.lookup(hook, "other@example.org"))
+	s.Equal("400 Error%20running%20hook\n", s.lookup(hook, "fail@example.org"))
+	s.Equal(found+1, testutil.ToFloat64(hookRuns.WithLabelValues("team", "found")))
+}
+
+func (s *HookTestSuite) TestTimeout() {
+	hook := &ExecHook{Name: "slow", Command: []string{"/bin/sh", "-c", "sleep 5"}, Timeout: 50 * time.Millisecond}
+
+	timeouts := testutil.ToFloat64(hookRuns.WithLabelValues("slow", "timeout"))
+
+	s.Equal("400 Error%20running%20hook\n", s.lookup(hook, "user@example.org"))
+	s.Equal(timeouts+1, testutil.ToFloat64(hookRuns.WithLabelValues("slow", "timeout")))
+}
+
+func (s *HookTestSuite) TestOutputTooLarge() {
+	hook := &ExecHook{Name: "large", Command: []string{"/bin/sh", "-c", "head -c 100000 /dev/zero; exec sleep 5"}, Timeout: 10 * time.Second}
+
+	start := time.Now()
+	_, err := hook.run(context.Background(), "user@example.org")
+	s.ErrorIs(err, errHookOutputTooLarge)
+	s.Less(time.Since(start), 5*time.Second)
+}
+
+func (s *HookTestSuite) TestLimitedBuffer() {
+	exceeded := 0
+	buf := &limitedBuffer{limit: 4, exceeded: func() { exceeded++ }}
+
+	n, err := buf.Write([]byte("abc"))
+	s.NoError(err)
+	s.Equal(3, n)
+	n, err = buf.Write([]byte("def"))
+	s.NoError(err)
+	s.Equal(3, n)
+	_, _ = buf.Write([]byte("ghi"))
+
+	s.Equal("abcd", buf.String())
+	s.True(buf.full)
+	s.Equal(1, exceeded)
+}
+
+func (s *HookTestSuite) TestEnvironment() {
+	s.T().Setenv("USERLI_TOKEN", "secret")
+	hook := &ExecHook{Name: "env", Command: []string{"/bin/sh", "-c", `echo "${USERLI_TOKEN:-unset}-$USERLI_POSTFIX_ADAPTER_MAP"`}, Timeout: time.Second}
+
+	s.Equal("200 unset-env\n", s.lookup(hook, "user@example.org"))
+}
+
+func TestHook(t *testing.T) {
+	suite.Run(t, new(HookTestSuite))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// HTTPAuth restricts access to HTTP handlers. Clients must connect from
+// one of the allowed networks and present either the bearer token or the
+// basic auth credentials. Empty values disable the respective check.
+type HTTPAuth struct {
+	Token       string
+	Username    string
+	Password    string
+	AllowedNets []netip.Prefix
+}
+
+// Enabled reports whether any restriction is configured.
+func (a HTTPAuth) Enabled() bool {
+	return a.Token != "" || a.Username != "" || a.Password != "" || len(a.AllowedNets) > 0
+}
+
+// restrict wraps handler so that only clients permitted by auth are served.
+func restrict(handler http.Handler, auth HTTPAuth) http.Handler {
+	basic := auth.Username != "" || auth.Password != ""
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(auth.AllowedNets) > 0 && !remoteAllowed(r.RemoteAddr, auth.AllowedNets) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if auth.Token != "" || basic {
+			valid := (auth.Token != "" && bearerTokenValid(r, auth.Token)) ||
+				(basic && basicAuthValid(r, auth.Username, auth.Password))
+			if !valid {
+				if basic {
+					w.Header().Add("WWW-Authenticate", `Basic realm="userli-postfix-adapter"`)
+				}
+				if auth.Token != "" {
+					w.Header().Add("WWW-Authenticate", "Bearer")
+				}
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// remoteAllowed reports whether the remote address is part of one of the
+// allowed networks.
+func remoteAllowed(remoteAddr string, allowed []netip.Prefix) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bearerTokenValid compares the bearer token of the request in constant time.
+func bearerTokenValid(r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// basicAuthValid compares the basic auth credentials of the request in
+// constant time.
+func basicAuthValid(r *http.Request, username, password string) bool {
+	givenUser, givenPassword, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userMatch := subtle.ConstantTimeCompare([]byte(givenUser), []byte(username))
+	passwordMatch := subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password))
+
+	return userMatch&passwordMatch == 1
+}
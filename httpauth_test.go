@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HTTPAuthTestSuite struct {
+	suite.Suite
+
+	handler http.Handler
+}
+
+func (s *HTTPAuthTestSuite) SetupTest() {
+	s.handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func (s *HTTPAuthTestSuite) request(handler http.Handler, remoteAddr, authorization string) int {
+	req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	req.RemoteAddr = remoteAddr
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+func (s *HTTPAuthTestSuite) TestRestrict() {
+	s.Run("no restrictions", func() {
+		handler := restrict(s.handler, HTTPAuth{})
+		s.Equal(http.StatusOK, s.request(handler, "192.0.2.1:1234", ""))
+	})
+
+	s.Run("token", func() {
+		handler := restrict(s.handler, HTTPAuth{Token: "secret"})
+		s.Equal(http.StatusUnauthorized, s.request(handler, "192.0.2.1:1234", ""))
+		s.Equal(http.StatusUnauthorized, s.request(handler, "192.0.2.1:1234", "Bearer wrong"))
+		s.Equal(http.StatusOK, s.request(handler, "192.0.2.1:1234", "Bearer secret"))
+	})
+
+	s.Run("allowed networks", func() {
+		allowed := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+		handler := restrict(s.handler, HTTPAuth{AllowedNets: allowed})
+		s.Equal(http.StatusForbidden, s.request(handler, "192.0.2.1:1234", ""))
+		s.Equal(http.StatusOK, s.request(handler, "10.1.2.3:1234", ""))
+		s.Equal(http.StatusOK, s.request(handler, "[::ffff:10.1.2.3]:1234", ""))
+		s.Equal(http.StatusOK, s.request(handler, "[::1]:1234", ""))
+	})
+
+	s.Run("basic auth", func() {
+		handler := restrict(s.handler, HTTPAuth{Username: "prometheus", Password: "secret"})
+		s.Equal(http.StatusUnauthorized, s.request(handler, "192.0.2.1:1234", ""))
+		s.Equal(http.StatusUnauthorized, s.request(handler, "192.0.2.1:1234", "Basic cHJvbWV0aGV1czp3cm9uZw=="))
+		s.Equal(http.StatusOK, s.request(handler, "192.0.2.1:1234", "Basic cHJvbWV0aGV1czpzZWNyZXQ="))
+	})
+
+	s.Run("token or basic auth", func() {
+		handler := restrict(s.handler, HTTPAuth{Token: "token", Username: "prometheus", Password: "secret"})
+		s.Equal(http.StatusOK, s.request(handler, "192.0.2.1:1234", "Bearer token"))
+		s.Equal(http.StatusOK, s.request(handler, "192.0.2.1:1234", "Basic cHJvbWV0aGV1czpzZWNyZXQ="))
+		s.Equal(http.StatusUnauthorized, s.request(handler, "192.0.2.1:1234", "Bearer secret"))
+	})
+}
+
+func (s *HTTPAuthTestSuite) TestPprofAuth() {
+	metricsNets := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	pprofNets := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	s.Run("metrics credentials", func() {
+		config := MetricsServerConfig{Auth: HTTPAuth{Username: "prometheus", Password: "secret", AllowedNets: metricsNets}}
+		handler := restrict(s.handler, config.pprofAuth())
+		s.Equal(http.StatusOK, s.request(handler, "10.1.2.3:1234", "Basic cHJvbWV0aGV1czpzZWNyZXQ="))
+	})
+
+	s.Run("pprof token replaces metrics credentials", func() {
+		config := MetricsServerConfig{
+			Auth:             HTTPAuth{Token: "metrics", Username: "prometheus", Password: "secret", AllowedNets: metricsNets},
+			PprofToken:       "pprof",
+			PprofAllowedNets: pprofNets,
+		}
+		handler := restrict(s.handler, config.pprofAuth())
+		s.Equal(http.StatusOK, s.request(handler, "192.0.2.1:1234", "Bearer pprof"))
+		s.Equal(http.StatusUnauthorized, s.request(handler, "192.0.2.1:1234", "Bearer metrics"))
+		s.Equal(http.StatusUnauthorized, s.request(handler, "192.0.2.1:1234", "Basic cHJvbWV0aGV1czpzZWNyZXQ="))
+		s.Equal(http.StatusForbidden, s.request(handler, "10.1.2.3:1234", "Bearer pprof"))
+	})
+
+	s.Run("pprof token keeps metrics networks", func() {
+		config := MetricsServerConfig{Auth: HTTPAuth{Token: "metrics", AllowedNets: metricsNets}, PprofToken: "pprof"}
+		handler := restrict(s.handler, config.pprofAuth())
+		s.Equal(http.StatusOK, s.request(handler, "10.1.2.3:1234", "Bearer pprof"))
+		s.Equal(http.StatusForbidden, s.request(handler, "192.0.2.1:1234", "Bearer pprof"))
+	})
+}
+
+func TestHTTPAuth(t *testing.T) {
+	suite.Run(t, new(HTTPAuthTestSuite))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// journalSocket is the socket of the native journal protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// JournalHook is a logrus hook writing entries with their fields to the
+// systemd journal using the native protocol.
+// See https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+type JournalHook struct {
+	conn *net.UnixConn
+}
+
+// NewJournalHook connects to the journal socket at path.
+func NewJournalHook(path string) (*JournalHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &JournalHook{conn: conn}, nil
+}
+
+// Levels implements log.Hook.
+func (h *JournalHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements log.Hook.
+func (h *JournalHook) Fire(entry *log.Entry) error {
+	_, err := h.conn.Write(journalMessage(entry))
+	return err
+}
+
+// journalMessage encodes entry as a datagram of the native protocol. The
+// fields of the entry are added with their names in upper case, e.g.
+// HANDLER or REQUEST_ID.
+func journalMessage(entry *log.Entry) []byte {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", entry.Message)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(syslogSeverity(entry.Level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", syslogIdentifier)
+
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJournalField(&buf, journalFieldName(key), fmt.Sprint(value))
+	}
+
+	return buf.Bytes()
+}
+
+// writeJournalField appends a field. Values with newlines are encoded
+// with their length, as the protocol requires.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName converts key to a valid journal field name, which
+// consists of upper case letters, digits and underscores and does not
+// start with an underscore or a digit.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" {
+		return "FIELD"
+	}
+
+	return name[:min(len(name), 64)]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type JournalTestSuite struct {
+	suite.Suite
+}
+
+func (s *JournalTestSuite) TestFire() {
+	path := filepath.Join(s.T().TempDir(), "journal.socket")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	s.Require().NoError(err)
+	defer journal.Close()
+
+	hook, err := NewJournalHook(path)
+	s.Require().NoError(err)
+
+	logger := log.New()
+	entry := logger.WithFields(log.Fields{"handler": "alias", "request-id": "1", "error": errors.New("failed")})
+	entry.Level = log.WarnLevel
+	entry.Message = "first line\nsecond line"
+	s.NoError(hook.Fire(entry))
+
+	buf := make([]byte, 4096)
+	n, err := journal.Read(buf)
+	s.Require().NoError(err)
+	message := buf[:n]
+
+	s.Contains(string(message), "PRIORITY=4\n")
+	s.Contains(string(message), "SYSLOG_IDENTIFIER=userli-postfix-adapter\n")
+	s.Contains(string(message), "HANDLER=alias\n")
+	s.Contains(string(message), "REQUEST_ID=1\n")
+	s.Contains(string(message), "ERROR=failed\n")
+
+	var multiline bytes.Buffer
+	multiline.WriteString("MESSAGE\n")
+	_ = binary.Write(&multiline, binary.LittleEndian, uint64(len("first line\nsecond line")))
+	multiline.WriteString("first line\nsecond line\n")
+	s.Contains(string(message), multiline.String())
+}
+
+func (s *JournalTestSuite) TestFieldName() {
+	s.Equal("REQUEST_ID", journalFieldName("request_id"))
+	s.Equal("REMOTE_ADDR", journalFieldName("remote.addr"))
+	s.Equal("KEY", journalFieldName("_1key"))
+	s.Equal("FIELD", journalFieldName("_"))
+}
+
+func TestJournal(t *testing.T) {
+	suite.Run(t, new(JournalTestSuite))
+}
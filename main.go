@@ -2,30 +2,399 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	dumpConfig := flag.Bool("dump-config", false, "Print the effective configuration as JSON and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if flag.Arg(0) == "mockserver" {
+		os.Exit(runMockServer(flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "replay" {
+		os.Exit(runReplay(flag.Args()[1:], os.Stdout))
+	}
+
+	if flag.Arg(0) == "selftest" {
+		os.Exit(runSelftest(flag.Args()[1:], os.Stdout))
+	}
+
 	config := NewConfig()
-	userli := NewUserli(config.UserliToken, config.UserliBaseURL)
-	adapter := NewPostfixAdapter(userli)
+
+	if *dumpConfig {
+		data, err := json.MarshalIndent(config.Redacted(), "", "  ")
+		if err != nil {
+			log.WithError(err).Fatal("Error encoding configuration")
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	if flag.Arg(0) == "healthcheck" {
+		os.Exit(runHealthcheck(config, flag.Args()[1:], os.Stdout))
+	}
+
+	log.WithFields(config.Redacted()).Info("Effective configuration")
+
+	TuneRuntime("/sys/fs/cgroup")
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	go StartMetricsServer(ctx, config.MetricsListenAddr)
+	// the old process shuts down once a new one took over its listeners
+	ctx, shutdown := context.WithCancel(ctx)
+	defer shutdown()
+
+	if config.SentryDSN != "" {
+		hook, err := NewSentryHook(config.SentryDSN, config.SentryEnvironment)
+		if err != nil {
+			log.WithError(err).Fatal("Error creating sentry hook")
+		}
+		log.AddHook(hook)
+		go hook.Run(ctx)
+	}
+
+	if config.SyslogAddr != "" {
+		hook, err := NewSyslogHook(config.SyslogAddr, config.SyslogFacility)
+		if err != nil {
+			log.WithError(err).Fatal("Error creating syslog hook")
+		}
+		log.AddHook(hook)
+		go hook.Run(ctx)
+	}
+
+	if config.StatsdAddr != "" {
+		var err error
+		statsd, err = NewStatsdClient(config.StatsdAddr, config.StatsdFormat)
+		if err != nil {
+			log.WithError(err).Fatal("Error creating statsd client")
+		}
+	}
+
+	if config.OTLPEndpoint != "" {
+		tracer = NewTracer(config.OTLPEndpoint, config.TraceSampleRatio)
+		go tracer.Run(ctx)
+	}
+
+	newUserli := func(token, baseURL string) *Userli {
+		userli := NewUserli(token, baseURL)
+		userli.SMTPUTF8 = config.SMTPUTF8
+		userli.MaxValues = config.UserliMaxValues
+		return userli
+	}
+
+	var primary UserliService
+	var service UserliService
+	// instances are the userli instances verified by the startup check
+	instances := make(map[string]*Userli)
+	if config.Backend == BackendStatic {
+		fixtures, err := LoadMockUserliFixtures(config.StaticFile)
+		if err != nil {
+			log.WithError(err).Fatal("Error loading static backend")
+		}
+		primary = NewStaticUserli(fixtures)
+		service = primary
+	} else {
+		userli := newUserli(config.UserliToken, config.UserliBaseURL)
+		userli.SetSecondaryToken(config.UserliSecondaryToken)
+		if provider := NewSecretProvider(config); provider != nil {
+			token, err := provider.Token(ctx)
+			if err != nil {
+				log.WithError(err).Fatal("Error fetching userli token")
+			}
+			redactor.Add(token)
+			userli.SetToken(token)
+
+			go WatchSecret(ctx, provider, config.SecretRefreshInterval, userli)
+		}
+
+		primary = userli
+		service = userli
+		instances["default"] = userli
+		if len(config.UserliBackends) > 0 {
+			backends := make([]UserliBackend, 0, len(config.UserliBackends))
+			for _, backend := range config.UserliBackends {
+				backendUserli := newUserli(backend.Token, backend.BaseURL)
+				backendUserli.Backend = backend.Name
+				instances[backend.Name] = backendUserli
+				backends = append(backends, UserliBackend{
+					Name:    backend.Name,
+					Domains: backend.Domains,
+					Service: backendUserli,
+				})
+			}
+			service = NewUserliRouter(userli, backends)
+		}
+	}
+
+	if config.ShadowBaseURL != "" {
+		log.WithFields(log.Fields{"url": config.ShadowBaseURL, "rate": config.ShadowRate}).Info("Mirroring lookups to shadow userli")
+		shadow := newUserli(config.ShadowToken, config.ShadowBaseURL)
+		shadow.Backend = "shadow"
+		service = NewShadowUserli(service, shadow, config.ShadowRate)
+	}
+
+	if len(config.Fallbacks) > 0 {
+		sources := make(map[string][]LookupSource)
+		for name, specs := range config.Fallbacks {
+			for _, spec := range specs {
+				source, err := NewLookupSource(spec)
+				if err != nil {
+					log.WithError(err).WithField("map", name).Fatal("Error loading fallback source")
+				}
+				sources[name] = append(sources[name], source)
+			}
+		}
+		service = NewFallbackUserli(service, sources, config.FallbackMerge)
+	}
+
+	adapter := NewPostfixAdapter(service)
+	adapter.Use(DisableMaps(config.DisabledMaps))
+
+	maintenanceMaps := []string{"alias", "domain", "mailbox", "senders", "recipient"}
+	for _, customMap := range config.CustomMaps {
+		maintenanceMaps = append(maintenanceMaps, customMap.Name)
+	}
+	maintenance := NewMaintenance(maintenanceMaps)
+	if time.Now().Before(config.SafeModeUntil) {
+		for _, name := range config.SafeModeMaps {
+			if _, err := maintenance.StartUntil(name, MaintenanceModeSafe, config.SafeModeUntil); err != nil {
+				log.WithError(err).Fatal("Invalid SAFE_MODE_MAPS")
+			}
+		}
+		log.WithFields(log.Fields{"maps": config.SafeModeMaps, "until": config.SafeModeUntil}).Warn("Safe mode is enabled, lookups without result are deferred")
+	}
+
+	if len(config.WildcardDomains) > 0 {
+		adapter.Use(WildcardDomains(config.WildcardDomains))
+	}
+	if len(config.ManagedDomains) > 0 {
+		adapter.Use(ManagedDomains(config.ManagedDomains))
+	}
+
+	// after ManagedDomains, so lookups for other domains are not deferred
+	adapter.Use(MaintenanceMode(maintenance))
+
+	if config.ChaosEnabled {
+		log.WithField("settings", config.Chaos).Warn("Chaos mode is enabled, faults are injected into lookups")
+		adapter.Chaos = NewChaos(config.Chaos)
+	}
+
+	if flag.Arg(0) == "lookup" {
+		os.Exit(runLookup(adapter, flag.Args()[1:], os.Stdout))
+	}
+
+	slo = NewSLOTracker(config.SLOWindow, config.LatencyObjective)
+
+	if config.DomainMetricsEnabled {
+		adapter.DomainLabeler = NewDomainLabeler(config.DomainMetricsAllowlist, config.DomainMetricsLimit)
+	}
+
+	adapter.AliasExpansionThreshold = config.AliasSizeThreshold
+
+	if config.AliasLoopDetection {
+		adapter.Use(BreakAliasLoops(NewAliasLoops(config.AliasLoopCacheSize)))
+	}
+
+	// innermost, so only errors of the lookups themselves are affected
+	adapter.Use(FailurePolicy(config.FailurePolicies))
+
+	if config.RecordFile != "" {
+		recorder, err := NewRecorder(config.RecordFile, !config.RecordPlainKeys)
+		if err != nil {
+			log.WithError(err).Fatal("Error opening record file")
+		}
+		defer recorder.Close()
+		go recorder.Run(ctx)
+
+		adapter.Recorder = recorder
+	}
+
+	if config.AccessLogFile != "" {
+		accessLogFile, err := NewAccessLogFile(config.AccessLogFile, config.AccessLogMaxSize, config.AccessLogMaxBackups)
+		if err != nil {
+			log.WithError(err).Fatal("Error opening access log")
+		}
+		go accessLogFile.WatchSignals(ctx)
+
+		adapter.AccessLog = NewAccessLogger(accessLogFile)
+	}
+
+	if config.StartupCheck {
+		for name, userli := range instances {
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			err := userli.Check(checkCtx, config.HealthCheckMap, config.HealthCheckKey)
+			cancel()
+			if err != nil {
+				log.WithError(err).WithField("backend", name).Fatal("Startup check failed")
+			}
+		}
+		log.Info("Startup check passed")
+	}
+
+	health := NewHealth(primary)
+	health.CheckMap = config.HealthCheckMap
+	health.CheckKey = config.HealthCheckKey
+
+	// initializes the userli_up metric before the first lookup
+	if check := health.checkUserli(ctx); check.Status != HealthStatusOK {
+		log.WithField("error", check.Error).Warn("Userli is not reachable")
+	}
+
+	var workers *WorkerPool
+	if config.Workers > 0 {
+		workers = NewWorkerPool(config.Workers, config.WorkerQueueSize)
+	}
+
+	handover := NewHandover()
+
+	var servers []*TCPServer
+	if config.TCPTableEnabled {
+		serverConfigs := []TCPServerConfig{
+			{Name: "alias", Addrs: config.AliasListenAddrs, Handler: adapter.AliasHandler},
+			{Name: "domain", Addrs: config.DomainListenAddrs, Handler: adapter.DomainHandler},
+			{Name: "mailbox", Addrs: config.MailboxListenAddrs, Handler: adapter.MailboxHandler},
+			{Name: "senders", Addrs: config.SendersListenAddrs, Handler: adapter.SendersHandler},
+			{Name: "recipient", Addrs: config.RecipientListenAddrs, Handler: adapter.RecipientHandler},
+		}
+		for _, customMap := range config.CustomMaps {
+			hook := &ExecHook{Name: customMap.Name, Command: customMap.Command, Timeout: customMap.Timeout}
+			serverConfigs = append(serverConfigs, TCPServerConfig{Name: customMap.Name, Addrs: customMap.ListenAddrs, Handler: adapter.HookHandler(hook)})
+		}
+
+		for _, serverConfig := range serverConfigs {
+			if len(serverConfig.Addrs) == 0 {
+				continue
+			}
+			serverConfig.Network = config.ListenNetwork
+			serverConfig.ShutdownTimeout = config.ShutdownTimeout
+			serverConfig.MaxConnections = config.Listeners[serverConfig.Name].MaxConnections
+			serverConfig.OnConnectionPoolFull = countRejectedConnection
+			serverConfig.AllowedNets = config.Listeners[serverConfig.Name].AllowedNets
+			serverConfig.MaxConnectionsPerIP = config.Listeners[serverConfig.Name].MaxConnectionsPerIP
+			serverConfig.OnConnectionDenied = countDeniedConnection
+			serverConfig.Workers = workers
+			serverConfig.OnOverload = adapter.Shed
+			serverConfig.AcceptLoops = config.Listeners[serverConfig.Name].AcceptLoops
+			serverConfig.AcceptRate = config.Listeners[serverConfig.Name].AcceptRate
+			serverConfig.AcceptBurst = config.Listeners[serverConfig.Name].AcceptBurst
+			serverConfig.ReusePort = config.Listeners[serverConfig.Name].ReusePort
+			serverConfig.ReadTimeout = config.Listeners[serverConfig.Name].ReadTimeout
+			serverConfig.WriteTimeout = config.Listeners[serverConfig.Name].WriteTimeout
+			serverConfig.IdleTimeout = config.Listeners[serverConfig.Name].IdleTimeout
+			serverConfig.KeepAlive = config.Listeners[serverConfig.Name].KeepAlive
+			serverConfig.DisableNoDelay = !config.Listeners[serverConfig.Name].NoDelay
+			serverConfig.ReadBufferSize = config.Listeners[serverConfig.Name].ReceiveBufferSize
+			serverConfig.WriteBufferSize = config.Listeners[serverConfig.Name].SendBufferSize
+			serverConfig.Health = health
+			serverConfig.Handover = handover
+
+			server, err := NewTCPServer(ctx, serverConfig)
+			if err != nil {
+				log.WithError(err).Fatal("Error creating listener")
+			}
+			servers = append(servers, server)
+		}
+	}
+
+	var metricsListener net.Listener
+	if config.MetricsEnabled {
+		var err error
+		metricsListener, err = handover.Listen(ctx, net.ListenConfig{}, "tcp", "metrics/"+config.MetricsListenAddr, config.MetricsListenAddr)
+		if err != nil {
+			log.WithError(err).Fatal("Error creating metrics listener")
+		}
+	}
+
+	if err := DropPrivileges(config.User, config.Group, config.ChrootDir); err != nil {
+		log.WithError(err).Fatal("Error dropping privileges")
+	}
+
+	registry := NewRegistry()
+
+	if config.PushgatewayURL != "" {
+		go PushMetrics(ctx, config.PushgatewayURL, config.PushgatewayJob, config.PushgatewayInterval, registry)
+	}
+
+	if metricsListener != nil {
+		go StartMetricsServer(ctx, metricsListener, MetricsServerConfig{
+			Registry:    registry,
+			Health:      health,
+			Config:      config,
+			Servers:     servers,
+			Chaos:       adapter.Chaos,
+			Maintenance: maintenance,
+			Auth: HTTPAuth{
+				Token:       config.MetricsToken,
+				Username:    config.MetricsUsername,
+				Password:    config.MetricsPassword,
+				AllowedNets: config.MetricsAllowedNets,
+			},
+			AdminTokens:      config.AdminTokens,
+			PprofEnabled:     config.PprofEnabled,
+			PprofToken:       config.PprofToken,
+			PprofAllowedNets: config.PprofAllowedNets,
+		})
+	}
 
 	var wg sync.WaitGroup
 
-	wg.Add(4)
-	go StartTCPServer(ctx, &wg, config.AliasListenAddr, adapter.AliasHandler)
-	go StartTCPServer(ctx, &wg, config.DomainListenAddr, adapter.DomainHandler)
-	go StartTCPServer(ctx, &wg, config.MailboxListenAddr, adapter.MailboxHandler)
-	go StartTCPServer(ctx, &wg, config.SendersListenAddr, adapter.SendersHandler)
+	wg.Add(len(servers))
+	for _, server := range servers {
+		go server.Serve(ctx, &wg)
+	}
+	health.SetInitialized()
+
+	if config.ProbeInterval > 0 && len(servers) > 0 {
+		probes := make(map[string]string)
+		for name, addrs := range map[string][]string{
+			"alias":     config.AliasListenAddrs,
+			"domain":    config.DomainListenAddrs,
+			"mailbox":   config.MailboxListenAddrs,
+			"senders":   config.SendersListenAddrs,
+			"recipient": config.RecipientListenAddrs,
+		} {
+			if len(addrs) > 0 {
+				probes[name] = addrs[0]
+			}
+		}
+		go health.Probe(ctx, probes, config.ProbeInterval)
+	}
+
+	if err := handover.Ready(); err != nil {
+		log.WithError(err).Error("Error notifying the previous process")
+	}
+
+	if config.PIDFile != "" {
+		if err := os.WriteFile(config.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			log.WithError(err).Error("Error writing pid file")
+		}
+	}
+
+	go handover.WatchSignals(ctx, config.UpgradeTimeout, shutdown)
+
+	if len(servers) == 0 {
+		<-ctx.Done()
+	}
 
 	wg.Wait()
 	log.Info("All servers stopped")
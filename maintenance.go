@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaintenanceModeTempfail answers all lookups of a map with a
+	// temporary error, so Postfix defers the mail.
+	MaintenanceModeTempfail = "tempfail"
+
+	// MaintenanceModeSafe answers lookups that found nothing with a
+	// temporary error, so mail is deferred instead of bounced while userli
+	// may return false negatives, e.g. during a data migration.
+	MaintenanceModeSafe = "safe"
+
+	// ResponseMaintenance is the temporary error of maps in maintenance.
+	ResponseMaintenance = "MAINTENANCE"
+)
+
+// MaintenanceWindow is the maintenance of a single map.
+type MaintenanceWindow struct {
+	Mode  string    `json:"mode"`
+	Until time.Time `json:"until"`
+}
+
+// Maintenance tracks the maps in maintenance. A map leaves maintenance
+// automatically when its window expires.
+type Maintenance struct {
+	maps map[string]bool
+
+	mu      sync.RWMutex
+	windows map[string]MaintenanceWindow
+}
+
+// NewMaintenance returns a Maintenance for the maps.
+func NewMaintenance(maps []string) *Maintenance {
+	m := &Maintenance{maps: make(map[string]bool, len(maps)), windows: make(map[string]MaintenanceWindow)}
+	for _, name := range maps {
+		m.maps[name] = true
+	}
+
+	return m
+}
+
+// Start puts the map in maintenance with mode for duration.
+func (m *Maintenance) Start(mapName, mode string, duration time.Duration) (MaintenanceWindow, error) {
+	if duration <= 0 {
+		return MaintenanceWindow{}, fmt.Errorf("duration must be positive")
+	}
+
+	return m.StartUntil(mapName, mode, time.Now().Add(duration))
+}
+
+// StartUntil puts the map in maintenance with mode until the given time.
+func (m *Maintenance) StartUntil(mapName, mode string, until time.Time) (MaintenanceWindow, error) {
+	if !m.maps[mapName] {
+		return MaintenanceWindow{}, fmt.Errorf("unknown map %q", mapName)
+	}
+	if mode != MaintenanceModeTempfail && mode != MaintenanceModeSafe {
+		return MaintenanceWindow{}, fmt.Errorf("unknown maintenance mode %q", mode)
+	}
+
+	window := MaintenanceWindow{Mode: mode, Until: until}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.windows[mapName] = window
+
+	return window, nil
+}
+
+// Stop ends the maintenance of the map. It returns false if the map was
+// not in maintenance.
+func (m *Maintenance) Stop(mapName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	window, ok := m.windows[mapName]
+	delete(m.windows, mapName)
+
+	return ok && time.Now().Before(window.Until)
+}
+
+// Mode returns the maintenance mode of the map or an empty string.
+func (m *Maintenance) Mode(mapName string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	window, ok := m.windows[mapName]
+	if !ok || !time.Now().Before(window.Until) {
+		return ""
+	}
+
+	return window.Mode
+}
+
+// Windows returns the current maintenance windows by map.
+func (m *Maintenance) Windows() map[string]MaintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	windows := make(map[string]MaintenanceWindow, len(m.windows))
+	for name, window := range m.windows {
+		if now.Before(window.Until) {
+			windows[name] = window
+		}
+	}
+
+	return windows
+}
+
+// MaintenanceMode answers the lookups of maps in maintenance according to
+// their mode. In safe mode lookups without result are answered with a
+// temporary error.
+func MaintenanceMode(maintenance *Maintenance) Middleware {
+	return func(handler string, next lookupFunc) lookupFunc {
+		return func(ctx context.Context, logger *log.Entry, key string) Response {
+			switch maintenance.Mode(handler) {
+			case MaintenanceModeTempfail:
+				return Response{Status: StatusError, Response: ResponseMaintenance}
+			case MaintenanceModeSafe:
+				response := next(ctx, logger, key)
+				if response.Status == StatusNoResult {
+					logger.WithField("key", key).Info("Safe mode: deferring lookup without result")
+					return Response{Status: StatusError, Response: ResponseMaintenance}
+				}
+				return response
+			}
+
+			return next(ctx, logger, key)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type MaintenanceTestSuite struct {
+	suite.Suite
+}
+
+func (s *MaintenanceTestSuite) TestStartStop() {
+	maintenance := NewMaintenance([]string{"alias", "mailbox"})
+
+	_, err := maintenance.Start("unknown", MaintenanceModeTempfail, time.Hour)
+	s.Error(err)
+	_, err = maintenance.Start("alias", "cached", time.Hour)
+	s.Error(err)
+	_, err = maintenance.Start("alias", MaintenanceModeTempfail, 0)
+	s.Error(err)
+
+	window, err := maintenance.Start("alias", MaintenanceModeTempfail, time.Hour)
+	s.NoError(err)
+	s.Equal(MaintenanceModeTempfail, window.Mode)
+	s.Equal(MaintenanceModeTempfail, maintenance.Mode("alias"))
+	s.Empty(maintenance.Mode("mailbox"))
+	s.Equal(map[string]MaintenanceWindow{"alias": window}, maintenance.Windows())
+
+	s.True(maintenance.Stop("alias"))
+	s.False(maintenance.Stop("alias"))
+	s.Empty(maintenance.Mode("alias"))
+}
+
+func (s *MaintenanceTestSuite) TestExpiry() {
+	maintenance := NewMaintenance([]string{"alias"})
+
+	_, err := maintenance.Start("alias", MaintenanceModeTempfail, time.Millisecond)
+	s.NoError(err)
+	time.Sleep(2 * time.Millisecond)
+
+	s.Empty(maintenance.Mode("alias"))
+	s.Empty(maintenance.Windows())
+	s.False(maintenance.Stop("alias"))
+}
+
+func (s *MaintenanceTestSuite) TestMiddleware() {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	maintenance := NewMaintenance([]string{"alias", "mailbox"})
+	middleware := MaintenanceMode(maintenance)
+	lookup := staticLookup(Response{Status: StatusOK, Response: "user@example.com"})
+
+	_, err := maintenance.Start("alias", MaintenanceModeTempfail, time.Hour)
+	s.NoError(err)
+
+	s.Equal(Response{Status: StatusError, Response: ResponseMaintenance}, middleware("alias", lookup)(context.Background(), log.NewEntry(logger), "alias@example.com"))
+	s.Equal(StatusOK, middleware("mailbox", lookup)(context.Background(), log.NewEntry(logger), "user@example.com").Status)
+}
+
+func (s *MaintenanceTestSuite) TestSafeMode() {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	maintenance := NewMaintenance([]string{"alias", "mailbox"})
+	middleware := MaintenanceMode(maintenance)
+
+	_, err := maintenance.StartUntil("mailbox", MaintenanceModeSafe, time.Now().Add(time.Hour))
+	s.NoError(err)
+
+	found := staticLookup(Response{Status: StatusOK, Response: "1"})
+	notFound := staticLookup(Response{Status: StatusNoResult, Response: ResponseNoResult})
+
+	s.Equal(Response{Status: StatusOK, Response: "1"}, middleware("mailbox", found)(context.Background(), log.NewEntry(logger), "user@example.com"))
+	s.Equal(Response{Status: StatusError, Response: ResponseMaintenance}, middleware("mailbox", notFound)(context.Background(), log.NewEntry(logger), "unknown@example.com"))
+	s.Equal(StatusNoResult, middleware("alias", notFound)(context.Background(), log.NewEntry(logger), "unknown@example.com").Status)
+
+	_, err = maintenance.StartUntil("alias", MaintenanceModeSafe, time.Now().Add(-time.Minute))
+	s.NoError(err)
+	s.Equal(StatusNoResult, middleware("alias", notFound)(context.Background(), log.NewEntry(logger), "unknown@example.com").Status)
+}
+
+func TestMaintenance(t *testing.T) {
+	suite.Run(t, new(MaintenanceTestSuite))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Middleware wraps the lookup of a map, so features like deny lists,
+// rewrites or auditing can change the key or the response without
+// touching the connection handling. handler is the name of the map.
+type Middleware func(handler string, next lookupFunc) lookupFunc
+
+// Use adds middlewares to the lookups of all maps. The first middleware
+// added is the outermost one.
+func (p *PostfixAdapter) Use(middlewares ...Middleware) {
+	p.middlewares = append(p.middlewares, middlewares...)
+	p.lookups.Clear()
+}
+
+// lookup returns the lookup of handler wrapped with the middlewares. The
+// wrapped lookup is built once per map, so the middlewares do not allocate
+// their closures for every request.
+func (p *PostfixAdapter) lookup(handler string, lookup lookupFunc) lookupFunc {
+	if wrapped, ok := p.lookups.Load(handler); ok {
+		return wrapped.(lookupFunc)
+	}
+
+	wrapped, _ := p.lookups.LoadOrStore(handler, p.wrap(handler, lookup))
+	return wrapped.(lookupFunc)
+}
+
+// wrap applies the middlewares to the lookup of handler.
+func (p *PostfixAdapter) wrap(handler string, lookup lookupFunc) lookupFunc {
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		lookup = p.middlewares[i](handler, lookup)
+	}
+
+	return lookup
+}
+
+// DisableMaps answers every lookup of the maps with ResponseMapDisabled
+// instead of querying userli.
+func DisableMaps(maps map[string]bool) Middleware {
+	return func(handler string, next lookupFunc) lookupFunc {
+		if !maps[handler] {
+			return next
+		}
+
+		return func(context.Context, *log.Entry, string) Response {
+			return Response{Status: StatusNoResult, Response: ResponseMapDisabled}
+		}
+	}
+}
+
+// BreakAliasLoops drops the destinations of an alias that lead back to it
+// according to loops.
+func BreakAliasLoops(loops *AliasLoops) Middleware {
+	return func(handler string, next lookupFunc) lookupFunc {
+		if handler != "alias" {
+			return next
+		}
+
+		return func(ctx context.Context, logger *log.Entry, email string) Response {
+			response := next(ctx, logger, email)
+			if response.Status != StatusOK {
+				return response
+			}
+
+			aliases := strings.Split(response.Response, ",")
+			found := loops.Check(email, aliases)
+			if len(found) == 0 {
+				return response
+			}
+
+			for _, loop := range found {
+				logger.WithFields(log.Fields{"email": email, "loop": strings.Join(loop, " -> ")}).Warn("Alias loop detected, dropping destination")
+				addCounter(aliasLoops, "alias_loops", 1, nil)
+			}
+
+			aliases = breakAliasLoops(aliases, found)
+			if len(aliases) == 0 {
+				return Response{Status: StatusNoResult, Response: ResponseNoResult}
+			}
+
+			return Response{Status: StatusOK, Response: strings.Join(aliases, ",")}
+		}
+	}
+}
+
+// WildcardDomains answers lookups in the domain map for domains matching
+// one of the patterns as existing without querying userli, e.g. for
+// dynamic subdomains like "*.lists.example.org".
+func WildcardDomains(patterns []string) Middleware {
+	wildcards := newDomainPatterns(patterns)
+
+	return func(handler string, next lookupFunc) lookupFunc {
+		if handler != "domain" {
+			return next
+		}
+
+		return func(ctx context.Context, logger *log.Entry, domain string) Response {
+			if wildcards.Match(domain) {
+				return Response{Status: StatusOK, Response: "1"}
+			}
+
+			return next(ctx, logger, domain)
+		}
+	}
+}
+
+// domainPatterns matches domains exactly or, for patterns like
+// "*.example.org", all of their subdomains.
+type domainPatterns struct {
+	exact    map[string]bool
+	suffixes []string
+}
+
+func newDomainPatterns(patterns []string) domainPatterns {
+	p := domainPatterns{exact: make(map[string]bool, len(patterns))}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			p.suffixes = append(p.suffixes, suffix)
+			continue
+		}
+		p.exact[pattern] = true
+	}
+
+	return p
+}
+
+// Match reports whether domain matches one of the patterns.
+func (p domainPatterns) Match(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if p.exact[domain] {
+		return true
+	}
+
+	for _, suffix := range p.suffixes {
+		if len(domain) > len(suffix) && strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ManagedDomains answers lookups for keys outside of domains with
+// ResponseNoResult without querying userli, which saves the requests for
+// foreign domains on busy MX hosts. Keys are addresses or, in the domain
+// map, domains.
+func ManagedDomains(domains []string) Middleware {
+	managed := newDomainPatterns(domains)
+
+	return func(handler string, next lookupFunc) lookupFunc {
+		switch handler {
+		case "alias", "domain", "mailbox", "senders", "recipient":
+		default:
+			return next
+		}
+
+		unmanaged := unmanagedLookups.WithLabelValues(handler)
+
+		return func(ctx context.Context, logger *log.Entry, key string) Response {
+			domain := key
+			if handler != "domain" {
+				domain = domainOf(key)
+			}
+
+			if !managed.Match(domain) {
+				addCounter(unmanaged, "unmanaged_lookups", 1, map[string]string{"handler": handler})
+				return Response{Status: StatusNoResult, Response: ResponseNoResult}
+			}
+
+			return next(ctx, logger, key)
+		}
+	}
+}
+
+const (
+	// FailurePolicyTemp answers failed lookups with a temporary error, so
+	// Postfix retries later.
+	FailurePolicyTemp = "temp"
+
+	// FailurePolicyNotFound answers failed lookups as not found.
+	FailurePolicyNotFound = "notfound"
+)
+
+// FailurePolicy applies the failure policy of the maps to lookups that
+// failed with a temporary error. Maps without policy keep the error.
+func FailurePolicy(policies map[string]string) Middleware {
+	return func(handler string, next lookupFunc) lookupFunc {
+		if policies[handler] != FailurePolicyNotFound {
+			return next
+		}
+
+		notFound := failedLookupsNotFound.WithLabelValues(handler)
+
+		return func(ctx context.Context, logger *log.Entry, key string) Response {
+			response := next(ctx, logger, key)
+			if response.Status != StatusError {
+				return response
+			}
+
+			logger.WithFields(log.Fields{"key": key, "error": response.Response}).Warn("Lookup failed, answering as not found")
+			addCounter(notFound, "failed_lookups_not_found", 1, map[string]string{"handler": handler})
+
+			return Response{Status: StatusNoResult, Response: ResponseNoResult}
+		}
+	}
+}
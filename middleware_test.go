@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type MiddlewareTestSuite struct {
+	suite.Suite
+
+	logger *log.Entry
+}
+
+func (s *MiddlewareTestSuite) SetupTest() {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	s.logger = log.NewEntry(logger)
+}
+
+// staticLookup returns a lookup answering every key with response.
+func staticLookup(response Response) lookupFunc {
+	return func(context.Context, *log.Entry, string) Response {
+		return response
+	}
+}
+
+func (s *MiddlewareTestSuite) TestOrder() {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(handler string, next lookupFunc) lookupFunc {
+			return func(ctx context.Context, logger *log.Entry, key string) Response {
+				calls = append(calls, name+":"+handler)
+				return next(ctx, logger, key)
+			}
+		}
+	}
+
+	adapter := NewPostfixAdapter(new(MockUserliService))
+	adapter.Use(trace("first"), trace("second"))
+
+	response := adapter.wrap("alias", staticLookup(Response{Status: StatusOK, Response: "a@example.com"}))(context.Background(), s.logger, "alias@example.com")
+
+	s.Equal(StatusOK, response.Status)
+	s.Equal([]string{"first:alias", "second:alias"}, calls)
+}
+
+func (s *MiddlewareTestSuite) TestDisableMaps() {
+	middleware := DisableMaps(map[string]bool{"senders": true})
+	lookup := staticLookup(Response{Status: StatusOK, Response: "user@example.com"})
+
+	s.Equal(Response{Status: StatusNoResult, Response: ResponseMapDisabled}, middleware("senders", lookup)(context.Background(), s.logger, "user@example.com"))
+	s.Equal(Response{Status: StatusOK, Response: "user@example.com"}, middleware("alias", lookup)(context.Background(), s.logger, "user@example.com"))
+}
+
+func (s *MiddlewareTestSuite) TestBreakAliasLoops() {
+	middleware := BreakAliasLoops(NewAliasLoops(10))
+	ctx := context.Background()
+
+	response := middleware("alias", staticLookup(Response{Status: StatusOK, Response: "b@example.com"}))(ctx, s.logger, "a@example.com")
+	s.Equal(Response{Status: StatusOK, Response: "b@example.com"}, response)
+
+	response = middleware("alias", staticLookup(Response{Status: StatusOK, Response: "a@example.com,c@example.com"}))(ctx, s.logger, "b@example.com")
+	s.Equal(Response{Status: StatusOK, Response: "c@example.com"}, response)
+
+	response = middleware("alias", staticLookup(Response{Status: StatusOK, Response: "a@example.com"}))(ctx, s.logger, "b@example.com")
+	s.Equal(Response{Status: StatusNoResult, Response: ResponseNoResult}, response)
+
+	// other maps are not checked
+	response = middleware("senders", staticLookup(Response{Status: StatusOK, Response: "a@example.com"}))(ctx, s.logger, "b@example.com")
+	s.Equal(Response{Status: StatusOK, Response: "a@example.com"}, response)
+}
+
+func (s *MiddlewareTestSuite) TestManagedDomains() {
+	middleware := ManagedDomains([]string{"Example.org"})
+	lookup := staticLookup(Response{Status: StatusOK, Response: "1"})
+	ctx := context.Background()
+
+	s.Equal(StatusOK, middleware("mailbox", lookup)(ctx, s.logger, "user@example.ORG").Status)
+	s.Equal(StatusOK, middleware("domain", lookup)(ctx, s.logger, "example.org.").Status)
+	s.Equal(StatusOK, middleware("alias", lookup)(ctx, s.logger, "@example.org").Status)
+	s.Equal(StatusOK, ManagedDomains([]string{"*.example.org"})("mailbox", lookup)(ctx, s.logger, "user@sub.example.org").Status)
+
+	before := testutil.ToFloat64(unmanagedLookups.WithLabelValues("mailbox"))
+
+	s.Equal(Response{Status: StatusNoResult, Response: ResponseNoResult}, middleware("mailbox", lookup)(ctx, s.logger, "user@example.com"))
+	s.Equal(StatusNoResult, middleware("domain", lookup)(ctx, s.logger, "example.com").Status)
+	s.Equal(StatusNoResult, middleware("alias", lookup)(ctx, s.logger, "postmaster").Status)
+	s.Equal(before+1, testutil.ToFloat64(unmanagedLookups.WithLabelValues("mailbox")))
+
+	// custom maps are not restricted
+	s.Equal(StatusOK, middleware("team", lookup)(ctx, s.logger, "user@example.com").Status)
+}
+
+func (s *MiddlewareTestSuite) TestWildcardDomains() {
+	middleware := WildcardDomains([]string{"*.lists.example.org"})
+	lookup := staticLookup(Response{Status: StatusNoResult, Response: ResponseNoResult})
+	ctx := context.Background()
+
+	s.Equal(Response{Status: StatusOK, Response: "1"}, middleware("domain", lookup)(ctx, s.logger, "team.lists.example.org"))
+	s.Equal(StatusOK, middleware("domain", lookup)(ctx, s.logger, "a.b.Lists.example.org.").Status)
+	s.Equal(StatusNoResult, middleware("domain", lookup)(ctx, s.logger, "lists.example.org").Status)
+	s.Equal(StatusNoResult, middleware("domain", lookup)(ctx, s.logger, "otherlists.example.org").Status)
+	s.Equal(StatusNoResult, middleware("mailbox", lookup)(ctx, s.logger, "user@team.lists.example.org").Status)
+}
+
+func (s *MiddlewareTestSuite) TestFailurePolicy() {
+	middleware := FailurePolicy(map[string]string{"domain": FailurePolicyNotFound, "senders": FailurePolicyTemp})
+	failed := staticLookup(Response{Status: StatusError, Response: "Error fetching domain"})
+	found := staticLookup(Response{Status: StatusOK, Response: "1"})
+
+	before := testutil.ToFloat64(failedLookupsNotFound.WithLabelValues("domain"))
+	s.Equal(Response{Status: StatusNoResult, Response: ResponseNoResult}, middleware("domain", failed)(context.Background(), s.logger, "example.org"))
+	s.Equal(before+1, testutil.ToFloat64(failedLookupsNotFound.WithLabelValues("domain")))
+
+	s.Equal(Response{Status: StatusOK, Response: "1"}, middleware("domain", found)(context.Background(), s.logger, "example.org"))
+	s.Equal(StatusError, middleware("senders", failed)(context.Background(), s.logger, "user@example.org").Status)
+	s.Equal(StatusError, middleware("mailbox", failed)(context.Background(), s.logger, "user@example.org").Status)
+}
+
+func TestMiddleware(t *testing.T) {
+	suite.Run(t, new(MiddlewareTestSuite))
+}
+
+func BenchmarkDomainPatternsMatch(b *testing.B) {
+	patterns := newDomainPatterns([]string{"example.org", "example.com", "*.example.net"})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		patterns.Match("mail.Example.NET.")
+	}
+}
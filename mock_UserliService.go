@@ -2,16 +2,20 @@
 
 package main
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	context "context"
+
+	mock "github.com/stretchr/testify/mock"
+)
 
 // MockUserliService is an autogenerated mock type for the UserliService type
 type MockUserliService struct {
 	mock.Mock
 }
 
-// GetAliases provides a mock function with given fields: email
-func (_m *MockUserliService) GetAliases(email string) ([]string, error) {
-	ret := _m.Called(email)
+// GetAliases provides a mock function with given fields: ctx, email
+func (_m *MockUserliService) GetAliases(ctx context.Context, email string) ([]string, error) {
+	ret := _m.Called(ctx, email)
 
 	if len(ret) == 0 {
 		panic("no return value specified for GetAliases")
@@ -19,19 +23,19 @@ func (_m *MockUserliService) GetAliases(email string) ([]string, error) {
 
 	var r0 []string
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string) ([]string, error)); ok {
-		return rf(email)
+	if rf, ok := ret.Get(0).(func(context.Context, string) ([]string, error)); ok {
+		return rf(ctx, email)
 	}
-	if rf, ok := ret.Get(0).(func(string) []string); ok {
-		r0 = rf(email)
+	if rf, ok := ret.Get(0).(func(context.Context, string) []string); ok {
+		r0 = rf(ctx, email)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]string)
 		}
 	}
 
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(email)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, email)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -39,9 +43,9 @@ func (_m *MockUserliService) GetAliases(email string) ([]string, error) {
 	return r0, r1
 }
 
-// GetDomain provides a mock function with given fields: domain
-func (_m *MockUserliService) GetDomain(domain string) (bool, error) {
-	ret := _m.Called(domain)
+// GetDomain provides a mock function with given fields: ctx, domain
+func (_m *MockUserliService) GetDomain(ctx context.Context, domain string) (bool, error) {
+	ret := _m.Called(ctx, domain)
 
 	if len(ret) == 0 {
 		panic("no return value specified for GetDomain")
@@ -49,17 +53,17 @@ func (_m *MockUserliService) GetDomain(domain string) (bool, error) {
 
 	var r0 bool
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string) (bool, error)); ok {
-		return rf(domain)
+	if rf, ok := ret.Get(0).(func(context.Context, string) (bool, error)); ok {
+		return rf(ctx, domain)
 	}
-	if rf, ok := ret.Get(0).(func(string) bool); ok {
-		r0 = rf(domain)
+	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
+		r0 = rf(ctx, domain)
 	} else {
 		r0 = ret.Get(0).(bool)
 	}
 
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(domain)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, domain)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -67,9 +71,9 @@ func (_m *MockUserliService) GetDomain(domain string) (bool, error) {
 	return r0, r1
 }
 
-// GetMailbox provides a mock function with given fields: email
-func (_m *MockUserliService) GetMailbox(email string) (bool, error) {
-	ret := _m.Called(email)
+// GetMailbox provides a mock function with given fields: ctx, email
+func (_m *MockUserliService) GetMailbox(ctx context.Context, email string) (bool, error) {
+	ret := _m.Called(ctx, email)
 
 	if len(ret) == 0 {
 		panic("no return value specified for GetMailbox")
@@ -77,17 +81,17 @@ func (_m *MockUserliService) GetMailbox(email string) (bool, error) {
 
 	var r0 bool
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string) (bool, error)); ok {
-		return rf(email)
+	if rf, ok := ret.Get(0).(func(context.Context, string) (bool, error)); ok {
+		return rf(ctx, email)
 	}
-	if rf, ok := ret.Get(0).(func(string) bool); ok {
-		r0 = rf(email)
+	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
+		r0 = rf(ctx, email)
 	} else {
 		r0 = ret.Get(0).(bool)
 	}
 
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(email)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, email)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -95,9 +99,9 @@ func (_m *MockUserliService) GetMailbox(email string) (bool, error) {
 	return r0, r1
 }
 
-// GetSenders provides a mock function with given fields: email
-func (_m *MockUserliService) GetSenders(email string) ([]string, error) {
-	ret := _m.Called(email)
+// GetSenders provides a mock function with given fields: ctx, email
+func (_m *MockUserliService) GetSenders(ctx context.Context, email string) ([]string, error) {
+	ret := _m.Called(ctx, email)
 
 	if len(ret) == 0 {
 		panic("no return value specified for GetSenders")
@@ -105,19 +109,19 @@ func (_m *MockUserliService) GetSenders(email string) ([]string, error) {
 
 	var r0 []string
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string) ([]string, error)); ok {
-		return rf(email)
+	if rf, ok := ret.Get(0).(func(context.Context, string) ([]string, error)); ok {
+		return rf(ctx, email)
 	}
-	if rf, ok := ret.Get(0).(func(string) []string); ok {
-		r0 = rf(email)
+	if rf, ok := ret.Get(0).(func(context.Context, string) []string); ok {
+		r0 = rf(ctx, email)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]string)
 		}
 	}
 
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(email)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, email)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MockUserliFixtures are the records served by the mock userli server.
+type MockUserliFixtures struct {
+	Domains   []string            `json:"domains"`
+	Mailboxes []string            `json:"mailboxes"`
+	Aliases   map[string][]string `json:"aliases"`
+	Senders   map[string][]string `json:"senders"`
+}
+
+// LoadMockUserliFixtures reads the fixtures from the JSON file at path.
+func LoadMockUserliFixtures(path string) (*MockUserliFixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures MockUserliFixtures
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return &fixtures, nil
+}
+
+// NewMockUserliHandler serves the postfix endpoints of the userli API from
+// the fixtures. If token is not empty, requests must authenticate with it.
+func NewMockUserliHandler(fixtures *MockUserliFixtures, token string) http.Handler {
+	static := NewStaticUserli(fixtures)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/postfix/alias/{email}", func(w http.ResponseWriter, r *http.Request) {
+		aliases, _ := static.GetAliases(r.Context(), r.PathValue("email"))
+		writeMockResponse(w, aliases)
+	})
+	mux.HandleFunc("GET /api/postfix/domain/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		exists, _ := static.GetDomain(r.Context(), r.PathValue("domain"))
+		writeMockResponse(w, exists)
+	})
+	mux.HandleFunc("GET /api/postfix/mailbox/{email}", func(w http.ResponseWriter, r *http.Request) {
+		exists, _ := static.GetMailbox(r.Context(), r.PathValue("email"))
+		writeMockResponse(w, exists)
+	})
+	mux.HandleFunc("GET /api/postfix/senders/{email}", func(w http.ResponseWriter, r *http.Request) {
+		senders, _ := static.GetSenders(r.Context(), r.PathValue("email"))
+		writeMockResponse(w, senders)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.WithFields(log.Fields{"method": r.Method, "path": r.URL.Path}).Debug("Mock userli request")
+
+		if token != "" && !bearerTokenValid(r, token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// writeMockResponse writes value as JSON.
+func writeMockResponse(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.WithError(err).Error("Error writing mock userli response")
+	}
+}
+
+// runMockServer serves the mock userli API until the process is stopped.
+func runMockServer(args []string) int {
+	flags := flag.NewFlagSet("mockserver", flag.ContinueOnError)
+	fixturesPath := flags.String("fixtures", "fixtures.json", "JSON file with the domains, mailboxes, aliases and senders to serve")
+	listenAddr := flags.String("listen", "127.0.0.1:8000", "Address to listen on")
+	token := flags.String("token", "", "Bearer token required from clients")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	fixtures, err := LoadMockUserliFixtures(*fixturesPath)
+	if err != nil {
+		log.WithError(err).Error("Error loading fixtures")
+		return 1
+	}
+
+	log.WithField("addr", *listenAddr).Info("Mock userli server started")
+	err = http.ListenAndServe(*listenAddr, NewMockUserliHandler(fixtures, *token))
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Error("Error serving mock userli")
+		return 1
+	}
+
+	return 0
+}
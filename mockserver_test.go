@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type MockServerTestSuite struct {
+	suite.Suite
+}
+
+func (s *MockServerTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *MockServerTestSuite) TestMockUserliHandler() {
+	path := filepath.Join(s.T().TempDir(), "fixtures.json")
+	s.Require().NoError(os.WriteFile(path, []byte(`{
+		"domains": ["example.org"],
+		"mailboxes": ["user@example.org"],
+		"aliases": {"alias@example.org": ["user@example.org"]},
+		"senders": {"user@example.org": ["user@example.org", "alias@example.org"]}
+	}`), 0600))
+
+	fixtures, err := LoadMockUserliFixtures(path)
+	s.Require().NoError(err)
+
+	server := httptest.NewServer(NewMockUserliHandler(fixtures, "token"))
+	defer server.Close()
+
+	userli := NewUserli("token", server.URL)
+	userli.Client = server.Client()
+	ctx := context.Background()
+
+	exists, err := userli.GetDomain(ctx, "example.org")
+	s.NoError(err)
+	s.True(exists)
+
+	exists, err = userli.GetDomain(ctx, "example.com")
+	s.NoError(err)
+	s.False(exists)
+
+	exists, err = userli.GetMailbox(ctx, "User@example.org")
+	s.NoError(err)
+	s.True(exists)
+
+	aliases, err := userli.GetAliases(ctx, "alias@example.org")
+	s.NoError(err)
+	s.Equal([]string{"user@example.org"}, aliases)
+
+	aliases, err = userli.GetAliases(ctx, "none@example.org")
+	s.NoError(err)
+	s.Empty(aliases)
+
+	senders, err := userli.GetSenders(ctx, "user@example.org")
+	s.NoError(err)
+	s.Equal([]string{"user@example.org", "alias@example.org"}, senders)
+
+	s.Run("invalid token", func() {
+		userli := NewUserli("invalid", server.URL)
+		userli.Client = server.Client()
+
+		_, err := userli.GetDomain(ctx, "example.org")
+		s.Error(err)
+	})
+}
+
+func (s *MockServerTestSuite) TestLoadMockUserliFixtures() {
+	_, err := LoadMockUserliFixtures(filepath.Join(s.T().TempDir(), "missing.json"))
+	s.Error(err)
+
+	path := filepath.Join(s.T().TempDir(), "invalid.json")
+	s.Require().NoError(os.WriteFile(path, []byte("{"), 0600))
+
+	_, err = LoadMockUserliFixtures(path)
+	s.Error(err)
+}
+
+func TestMockServer(t *testing.T) {
+	suite.Run(t, new(MockServerTestSuite))
+}
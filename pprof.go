@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// registerPprof adds the pprof handlers below /debug/pprof/ to mux, each
+// wrapped with guard.
+func registerPprof(mux *http.ServeMux, guard func(http.Handler) http.Handler) {
+	mux.Handle("/debug/pprof/", guard(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", guard(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", guard(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", guard(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", guard(http.HandlerFunc(pprof.Trace)))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DropPrivileges optionally changes the root directory and switches to
+// the given user and group. It must be called after all listeners are
+// bound. Empty values leave the corresponding setting untouched.
+func DropPrivileges(username, groupname, chrootDir string) error {
+	uid, gid := -1, -1
+
+	if username != "" {
+		u, err := lookupUser(username)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+
+	if groupname != "" {
+		g, err := lookupGroup(groupname)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// a process started by an upgrade already runs with the target ids
+	if os.Getuid() != 0 && (uid == -1 || uid == os.Getuid()) && (gid == -1 || gid == os.Getgid()) {
+		uid, gid = -1, -1
+	}
+
+	if chrootDir != "" {
+		if err := syscall.Chroot(chrootDir); err != nil {
+			return fmt.Errorf("chroot to %s: %w", chrootDir, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir after chroot: %w", err)
+		}
+	}
+
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %w", gid, err)
+		}
+	}
+
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", uid, err)
+		}
+	}
+
+	if uid != -1 || gid != -1 || chrootDir != "" {
+		log.WithFields(log.Fields{"uid": os.Getuid(), "gid": os.Getgid(), "chroot": chrootDir}).Info("Dropped privileges")
+	}
+
+	return nil
+}
+
+// lookupUser resolves a user by name or numeric id.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+
+	return user.Lookup(name)
+}
+
+// lookupGroup resolves a group by name or numeric id.
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupGroupId(name)
+	}
+
+	return user.LookupGroup(name)
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/http"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -17,19 +22,315 @@ var (
 		Help:    "Duration of requests to userli",
 		Buckets: prometheus.ExponentialBuckets(0.1, 1.5, 5.0),
 	}, []string{"handler", "status"})
+	domainRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_domain_requests_total",
+		Help: "Requests per domain, limited to allowlisted and the most requested domains",
+	}, []string{"handler", "domain", "status"})
+	slowRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_slow_requests_total",
+		Help: "Requests exceeding the latency objective",
+	}, []string{"handler"})
+	userliUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "userli_postfix_adapter_userli_up",
+		Help: "Whether the last request to userli succeeded without server error",
+	}, []string{"backend"})
+	probeUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "userli_postfix_adapter_probe_up",
+		Help: "Whether the last probe lookup to the lookup server of a map succeeded",
+	}, []string{"handler"})
+	connectionsForceClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_connections_force_closed_total",
+		Help: "Connections closed forcefully because the shutdown timeout was reached",
+	}, []string{"server"})
+	connectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_connections_rejected_total",
+		Help: "Connections rejected because the connection pool was full",
+	}, []string{"server"})
+	connectionsDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_connections_denied_total",
+		Help: "Connections denied because of the allowed networks or the limit per client address",
+	}, []string{"server", "reason"})
+	slowClients = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_slow_clients_total",
+		Help: "Connections closed because the client did not send its request within the read timeout",
+	}, []string{"server"})
+	acceptsThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_accepts_throttled_total",
+		Help: "Accepts delayed because the accept rate was exceeded",
+	}, []string{"server"})
+	acceptErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_accept_errors_total",
+		Help: "Errors accepting connections, e.g. because of too many open files",
+	}, []string{"server"})
+	workerQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "userli_postfix_adapter_worker_queue_depth",
+		Help: "Connections waiting for a worker",
+	})
+	requestsShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_requests_shed_total",
+		Help: "Connections answered with a temporary error because no worker was available",
+	}, []string{"handler"})
+	chaosFaults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_chaos_faults_total",
+		Help: "Faults injected into lookups by the chaos mode",
+	}, []string{"handler", "fault"})
+	userliErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_userli_errors_total",
+		Help: "Failed requests to userli by error type",
+	}, []string{"backend", "error_type"})
+	userliTokenFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_userli_token_fallbacks_total",
+		Help: "Requests to userli retried with the secondary token after the primary one was rejected",
+	})
+	aliasLoops = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_alias_loops_total",
+		Help: "Alias loops detected and broken by dropping the destination",
+	})
+	fallbackLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_fallback_lookups_total",
+		Help: "Lookups in fallback sources after a miss in userli by result (hit, miss, error)",
+	}, []string{"map", "source", "result"})
+	hookRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_hook_runs_total",
+		Help: "Runs of custom map hooks by result (found, not_found, error, timeout)",
+	}, []string{"map", "result"})
+	aliasExpansionSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "userli_postfix_adapter_alias_expansion_size",
+		Help:    "Number of destinations returned by userli for an alias",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+	largeAliasExpansions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_large_alias_expansions_total",
+		Help: "Alias lookups with more destinations than ALIAS_EXPANSION_THRESHOLD",
+	})
+	abandonedLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_abandoned_lookups_total",
+		Help: "Lookups canceled because the client closed the connection",
+	}, []string{"handler"})
+	failedLookupsNotFound = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_failed_lookups_not_found_total",
+		Help: "Failed lookups answered as not found because of the failure policy of the map",
+	}, []string{"handler"})
+	unmanagedLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_unmanaged_lookups_total",
+		Help: "Lookups for domains outside of MANAGED_DOMAINS answered without querying userli",
+	}, []string{"handler"})
+	shadowLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "userli_postfix_adapter_shadow_lookups_total",
+		Help: "Lookups mirrored to the shadow userli by result (match, mismatch, error, skipped)",
+	}, []string{"handler", "result"})
+	runtimeGOMAXPROCS = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "userli_postfix_adapter_gomaxprocs",
+		Help: "GOMAXPROCS chosen at startup",
+	})
+	runtimeMemoryLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "userli_postfix_adapter_memory_limit_bytes",
+		Help: "Soft memory limit of the Go runtime chosen at startup",
+	})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "userli_postfix_adapter_build_info",
+		Help: "Build information of the running adapter",
+	}, []string{"version", "commit", "date"})
 )
 
-// StartMetricsServer starts a new HTTP server for prometheus metrics.
-func StartMetricsServer(ctx context.Context, listenAddr string) {
+// MetricsServerConfig is the configuration for the metrics server.
+type MetricsServerConfig struct {
+	// Registry is served on /metrics. A new registry is created if nil.
+	Registry *prometheus.Registry
+
+	// Health serves /health, /ready and /startupz if set.
+	Health *Health
+
+	// Config is exposed redacted on the admin config endpoint if set.
+	Config *Config
+
+	// Servers are exposed on the admin connections endpoint.
+	Servers []*TCPServer
+
+	// Chaos is configured on the admin chaos endpoint if set.
+	Chaos *Chaos
+
+	// Maintenance is configured on the admin maintenance endpoints if set.
+	Maintenance *Maintenance
+
+	// Auth restricts access to /metrics, pprof and the admin endpoints.
+	Auth HTTPAuth
+
+	// AdminTokens replace the credentials of Auth for the admin endpoints
+	// if set.
+	AdminTokens AdminTokens
+
+	// PprofEnabled exposes the pprof handlers below /debug/pprof/.
+	PprofEnabled bool
+
+	// PprofToken is the bearer token required for the pprof handlers. It
+	// replaces the credentials of Auth if set.
+	PprofToken string
+
+	// PprofAllowedNets are the networks allowed to access the pprof
+	// handlers. They replace the networks of Auth if set.
+	PprofAllowedNets []netip.Prefix
+}
+
+// pprofAuth returns Auth with the pprof specific overrides applied.
+func (c MetricsServerConfig) pprofAuth() HTTPAuth {
+	auth := c.Auth
+	if c.PprofToken != "" {
+		auth = HTTPAuth{Token: c.PprofToken, AllowedNets: auth.AllowedNets}
+	}
+	if len(c.PprofAllowedNets) > 0 {
+		auth.AllowedNets = c.PprofAllowedNets
+	}
+
+	return auth
+}
+
+// NewRegistry returns a registry with all metrics of the adapter.
+func NewRegistry() *prometheus.Registry {
 	registry := prometheus.NewRegistry()
 
 	registry.MustRegister(
 		collectors.NewGoCollector(),
 		requestDurations,
+		domainRequests,
+		slowRequests,
+		userliUp,
+		userliErrors,
+		probeUp,
+		connectionsForceClosed,
+		connectionsRejected,
+		connectionsDenied,
+		slowClients,
+		acceptsThrottled,
+		acceptErrors,
+		workerQueueDepth,
+		requestsShed,
+		chaosFaults,
+		shadowLookups,
+		userliTokenFallbacks,
+		aliasLoops,
+		fallbackLookups,
+		hookRuns,
+		unmanagedLookups,
+		failedLookupsNotFound,
+		abandonedLookups,
+		aliasExpansionSize,
+		largeAliasExpansions,
+		runtimeGOMAXPROCS,
+		runtimeMemoryLimit,
+		buildInfo,
 	)
 
-	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if slo != nil {
+		registry.MustRegister(slo)
+	}
+
+	buildInfo.With(prometheus.Labels{"version": version, "commit": commit, "date": date}).Set(1)
+
+	return registry
+}
+
+// StartMetricsServer starts a new HTTP server for prometheus metrics on the given listener.
+func StartMetricsServer(ctx context.Context, listener net.Listener, config MetricsServerConfig) {
+	server := &http.Server{Handler: newMetricsMux(config)}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Info("Metrics server started on ", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Fatal("Metrics server failed")
+	}
+}
+
+// newMetricsMux returns the handlers of the metrics server.
+func newMetricsMux(config MetricsServerConfig) *http.ServeMux {
+	registry := config.Registry
+	if registry == nil {
+		registry = NewRegistry()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", restrict(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), config.Auth))
+	mux.HandleFunc("/livez", LivenessHandler)
+
+	if config.Health != nil {
+		mux.HandleFunc("/health", config.Health.HealthHandler)
+		mux.HandleFunc("/ready", config.Health.ReadinessHandler)
+		mux.HandleFunc("/startupz", config.Health.StartupHandler)
+	}
+
+	// the admin endpoints expose client addresses and can close
+	// connections, so they are never served without access restriction
+	if config.Auth.Enabled() || len(config.AdminTokens) > 0 {
+		registerAdmin(mux, config.Config, config.Servers, config.Chaos, config.Maintenance, func(scope string, handler http.Handler) http.Handler {
+			return restrictAdmin(handler, scope, config.Auth, config.AdminTokens)
+		})
+	}
+
+	if config.PprofEnabled {
+		auth := config.pprofAuth()
+		registerPprof(mux, func(handler http.Handler) http.Handler {
+			return restrict(handler, auth)
+		})
+	}
+
+	return mux
+}
+
+// countRejectedConnection records a connection rejected because the
+// connection pool of server was full.
+func countRejectedConnection(server string) {
+	addCounter(connectionsRejected.WithLabelValues(server), "connections_rejected", 1, map[string]string{"server": server})
+}
+
+// countDeniedConnection records a connection denied for reason.
+func countDeniedConnection(server, reason string) {
+	addCounter(connectionsDenied.WithLabelValues(server, reason), "connections_denied", 1, map[string]string{"server": server, "reason": reason})
+}
+
+// requestObservers caches the request duration histograms of every map by
+// status, so lookups do not resolve the labels again.
+var requestObservers sync.Map
+
+// observeRequest records the duration of a request of handler answered
+// with status.
+func observeRequest(handler, status string, duration time.Duration) {
+	observers, ok := requestObservers.Load(handler)
+	if !ok {
+		observers, _ = requestObservers.LoadOrStore(handler, map[string]prometheus.Observer{
+			"success": requestDurations.WithLabelValues(handler, "success"),
+			"error":   requestDurations.WithLabelValues(handler, "error"),
+		})
+	}
+
+	observer, ok := observers.(map[string]prometheus.Observer)[status]
+	if !ok {
+		observer = requestDurations.WithLabelValues(handler, status)
+	}
+	observer.Observe(duration.Seconds())
+	statsd.Timing("request_duration", duration, map[string]string{"handler": handler, "status": status})
+}
+
+// addCounter adds n to the counter and mirrors it to statsd as name with
+// tags. Counters with labels are passed resolved, e.g. with
+// WithLabelValues, as resolving a prometheus.Labels map allocates it on
+// every call.
+func addCounter(counter prometheus.Counter, name string, n int, tags map[string]string) {
+	counter.Add(float64(n))
+	statsd.Count(name, n, tags)
+}
+
+// setGauge sets the gauge and mirrors it to statsd as name.
+func setGauge(gauge prometheus.Gauge, name string, value float64) {
+	gauge.Set(value)
+	statsd.Gauge(name, value, nil)
+}
 
-	log.Info("Metrics server started on ", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+// setGaugeVec sets the gauge with labels and mirrors it to statsd as name.
+func setGaugeVec(gauge *prometheus.GaugeVec, name string, value float64, labels prometheus.Labels) {
+	gauge.With(labels).Set(value)
+	statsd.Gauge(name, value, labels)
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+)
+
+// PushMetrics periodically pushes all metrics of the registry to the
+// Pushgateway at url until the context is canceled. The metrics are
+// grouped by job and the hostname as instance.
+func PushMetrics(ctx context.Context, url, job string, interval time.Duration, registry *prometheus.Registry) {
+	instance, err := os.Hostname()
+	if err != nil {
+		instance = "unknown"
+	}
+
+	pusher := push.New(url, job).Gatherer(registry).Grouping("instance", instance)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := pusher.PushContext(ctx); err != nil && ctx.Err() == nil {
+			log.WithError(err).Warn("Error pushing metrics")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
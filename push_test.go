@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/h2non/gock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type PushTestSuite struct {
+	suite.Suite
+}
+
+func (s *PushTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *PushTestSuite) TestPushMetrics() {
+	gock.DisableNetworking()
+	defer gock.Off()
+
+	gock.New("http://pushgateway:9091").
+		Put("/metrics/job/userli_postfix_adapter/instance/").
+		Reply(200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		PushMetrics(ctx, "http://pushgateway:9091", "userli_postfix_adapter", time.Hour, NewRegistry())
+		close(done)
+	}()
+
+	s.Eventually(gock.IsDone, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func TestPush(t *testing.T) {
+	suite.Run(t, new(PushTestSuite))
+}
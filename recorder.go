@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hashedKeyPrefix marks recorded keys that were replaced with a hash.
+const hashedKeyPrefix = "sha256:"
+
+// hashKey returns a short hash of key, so lookups of the same key can be
+// correlated without exposing it.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashedKeyPrefix + hex.EncodeToString(sum[:8])
+}
+
+// RecordEntry is a single recorded lookup.
+type RecordEntry struct {
+	Time      time.Time `json:"time"`
+	Map       string    `json:"map"`
+	Key       string    `json:"key"`
+	Status    Status    `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+}
+
+// Recorder writes the lookups as JSON lines to a file, e.g. to replay
+// them against a test instance.
+type Recorder struct {
+	hashKeys bool
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// NewRecorder appends the lookups to the file at path. Keys are replaced
+// with a hash unless hashKeys is false.
+func NewRecorder(path string, hashKeys bool) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{hashKeys: hashKeys, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Record writes a lookup of key in the map. It is safe to call on a nil
+// Recorder.
+func (r *Recorder) Record(mapName, key string, status Status, latency time.Duration) {
+	if r == nil {
+		return
+	}
+
+	if r.hashKeys {
+		key = hashKey(key)
+	}
+
+	data, err := json.Marshal(RecordEntry{
+		Time:      time.Now(),
+		Map:       mapName,
+		Key:       key,
+		Status:    status,
+		LatencyMS: float64(latency.Microseconds()) / 1000,
+	})
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.writer.Write(append(data, '\n')); err != nil {
+		log.WithError(err).Error("Error recording lookup")
+	}
+}
+
+// Run flushes the recorded lookups every second until the context is
+// canceled.
+func (r *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// Close flushes the recorded lookups and closes the file.
+func (r *Recorder) Close() error {
+	r.flush()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.file.Close()
+}
+
+func (r *Recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.writer.Flush(); err != nil {
+		log.WithError(err).Error("Error flushing recorded lookups")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type RecorderTestSuite struct {
+	suite.Suite
+}
+
+func (s *RecorderTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *RecorderTestSuite) TestRecord() {
+	s.Run("nil recorder", func() {
+		var recorder *Recorder
+		recorder.Record("alias", "user@example.org", StatusOK, time.Millisecond)
+	})
+
+	s.Run("hashed keys", func() {
+		entries := s.record(true)
+		s.Require().Len(entries, 2)
+		s.Equal("alias", entries[0].Map)
+		s.Equal(hashKey("user@example.org"), entries[0].Key)
+		s.Equal(StatusOK, entries[0].Status)
+		s.Equal(1.5, entries[0].LatencyMS)
+		s.Equal(StatusNoResult, entries[1].Status)
+	})
+
+	s.Run("plain keys", func() {
+		entries := s.record(false)
+		s.Require().Len(entries, 2)
+		s.Equal("user@example.org", entries[0].Key)
+	})
+}
+
+// record records two lookups and returns the entries read from the file.
+func (s *RecorderTestSuite) record(hashKeys bool) []RecordEntry {
+	path := filepath.Join(s.T().TempDir(), "record.jsonl")
+
+	recorder, err := NewRecorder(path, hashKeys)
+	s.Require().NoError(err)
+
+	recorder.Record("alias", "user@example.org", StatusOK, 1500*time.Microsecond)
+	recorder.Record("domain", "example.com", StatusNoResult, time.Millisecond)
+	s.Require().NoError(recorder.Close())
+
+	file, err := os.Open(path)
+	s.Require().NoError(err)
+	defer file.Close()
+
+	var entries []RecordEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry RecordEntry
+		s.Require().NoError(json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestRecorder(t *testing.T) {
+	suite.Run(t, new(RecorderTestSuite))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// redactor masks the configured secrets in all log entries.
+var redactor = &RedactHook{}
+
+// RedactHook is a logrus hook replacing secrets in the message and the
+// fields of log entries with redactedValue. It has to be added before
+// the hooks sending entries elsewhere, as hooks are fired in order.
+type RedactHook struct {
+	once sync.Once
+
+	mu       sync.RWMutex
+	secrets  []string
+	replacer *strings.Replacer
+}
+
+// Register adds the hook to the standard logger once.
+func (h *RedactHook) Register() {
+	h.once.Do(func() {
+		log.AddHook(h)
+	})
+}
+
+// Add masks the secrets in future log entries. Empty secrets are ignored.
+func (h *RedactHook) Add(secrets ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := false
+	for _, secret := range secrets {
+		if secret == "" || slices.Contains(h.secrets, secret) {
+			continue
+		}
+		h.secrets = append(h.secrets, secret)
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	// longer secrets first, so a secret containing another one is
+	// replaced completely
+	sort.Slice(h.secrets, func(i, j int) bool {
+		return len(h.secrets[i]) > len(h.secrets[j])
+	})
+
+	pairs := make([]string, 0, 2*len(h.secrets))
+	for _, secret := range h.secrets {
+		pairs = append(pairs, secret, redactedValue)
+	}
+	h.replacer = strings.NewReplacer(pairs...)
+}
+
+// Levels implements log.Hook.
+func (h *RedactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements log.Hook.
+func (h *RedactHook) Fire(entry *log.Entry) error {
+	h.mu.RLock()
+	replacer := h.replacer
+	h.mu.RUnlock()
+
+	if replacer == nil {
+		return nil
+	}
+
+	entry.Message = replacer.Replace(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = replacer.Replace(v)
+		case error:
+			if message := replacer.Replace(v.Error()); message != v.Error() {
+				entry.Data[key] = message
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type RedactTestSuite struct {
+	suite.Suite
+}
+
+func (s *RedactTestSuite) TestFire() {
+	hook := &RedactHook{}
+	hook.Add("s3cr3t", "", "s3cr3t-longer", "s3cr3t")
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(hook)
+
+	logger.WithFields(log.Fields{
+		"token":   "Bearer s3cr3t-longer",
+		"error":   errors.New("rejected s3cr3t"),
+		"handler": "alias",
+		"count":   3,
+	}).Info("using s3cr3t")
+
+	output := buf.String()
+	s.NotContains(output, "s3cr3t")
+	s.Contains(output, `"msg":"using REDACTED"`)
+	s.Contains(output, `"token":"Bearer REDACTED"`)
+	s.Contains(output, `"error":"rejected REDACTED"`)
+	s.Contains(output, `"handler":"alias"`)
+	s.Contains(output, `"count":3`)
+}
+
+func (s *RedactTestSuite) TestNoSecrets() {
+	hook := &RedactHook{}
+
+	entry := log.NewEntry(log.New()).WithField("token", "s3cr3t")
+	entry.Message = "using s3cr3t"
+	s.NoError(hook.Fire(entry))
+
+	s.Equal("using s3cr3t", entry.Message)
+	s.Equal("s3cr3t", entry.Data["token"])
+}
+
+func (s *RedactTestSuite) TestSecrets() {
+	config := &Config{
+		UserliToken:    "userli-token",
+		MetricsToken:   "metrics-token",
+		UserliBackends: UserliBackendConfigs{{Name: "b", Token: "backend-token"}},
+		AdminTokens:    AdminTokens{{Name: "ops", Token: "admin-token"}},
+	}
+
+	secrets := config.Secrets()
+	s.Contains(secrets, "userli-token")
+	s.Contains(secrets, "metrics-token")
+	s.Contains(secrets, "backend-token")
+	s.Contains(secrets, "admin-token")
+}
+
+func TestRedact(t *testing.T) {
+	suite.Run(t, new(RedactTestSuite))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReplayReport summarizes a replay of recorded lookups.
+type ReplayReport struct {
+	Lookups    int
+	Skipped    int
+	Failed     int
+	Mismatched int
+	Total      time.Duration
+	Max        time.Duration
+}
+
+// runReplay sends the lookups recorded in a file to the lookup servers and
+// reports latencies and answers that differ from the recording. Lookups
+// recorded with hashed keys are skipped. It returns 1 if a lookup failed
+// or was answered differently and 2 if nothing could be replayed.
+func runReplay(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	path := flags.String("file", "", "File with the recorded lookups")
+	speed := flags.Float64("speed", 0, "Replay speed relative to the recording, 0 sends the lookups as fast as possible")
+	timeout := flags.Duration("timeout", 5*time.Second, "Timeout of each lookup")
+	addrs := lookupAddrFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	file, err := os.Open(*path)
+	if err != nil {
+		fmt.Fprintf(out, "error opening recording: %v\n", err)
+		return 2
+	}
+	defer file.Close()
+
+	var report ReplayReport
+	var first time.Time
+	start := time.Now()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry RecordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			fmt.Fprintf(out, "skipping invalid entry: %v\n", err)
+			continue
+		}
+
+		if strings.HasPrefix(entry.Key, hashedKeyPrefix) {
+			if report.Skipped == 0 {
+				fmt.Fprintln(out, "skipping lookups with hashed keys, record with RECORD_PLAIN_KEYS=true to replay them")
+			}
+			report.Skipped++
+			continue
+		}
+
+		addr, ok := addrs[entry.Map]
+		if !ok {
+			fmt.Fprintf(out, "skipping entry of unknown map %q\n", entry.Map)
+			continue
+		}
+		if *addr == "" {
+			fmt.Fprintf(out, "skipping entry of map %q without address, set -%s to replay it\n", entry.Map, entry.Map)
+			continue
+		}
+
+		if *speed > 0 {
+			if first.IsZero() {
+				first = entry.Time
+			}
+			time.Sleep(time.Until(start.Add(time.Duration(float64(entry.Time.Sub(first)) / *speed))))
+		}
+
+		report.Lookups++
+		begin := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		status, err := sendLookup(ctx, *addr, entry.Key)
+		cancel()
+		latency := time.Since(begin)
+		report.Total += latency
+		report.Max = max(report.Max, latency)
+
+		switch {
+		case err != nil:
+			report.Failed++
+			fmt.Fprintf(out, "%s %s: %v\n", entry.Map, entry.Key, err)
+		case status != entry.Status:
+			report.Mismatched++
+			fmt.Fprintf(out, "%s %s: status %d, recorded %d\n", entry.Map, entry.Key, status, entry.Status)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(out, "error reading recording: %v\n", err)
+		return 2
+	}
+
+	var mean time.Duration
+	if report.Lookups > 0 {
+		mean = report.Total / time.Duration(report.Lookups)
+	}
+	fmt.Fprintf(out, "lookups: %d, skipped: %d, failed: %d, mismatched: %d, mean latency: %s, max latency: %s\n", report.Lookups, report.Skipped, report.Failed, report.Mismatched, mean, report.Max)
+
+	if report.Lookups == 0 && report.Skipped > 0 {
+		fmt.Fprintln(out, "error: the recording has only hashed keys")
+		return 2
+	}
+
+	if report.Failed > 0 || report.Mismatched > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type ReplayTestSuite struct {
+	suite.Suite
+
+	addr   string
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (s *ReplayTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+
+	server, err := NewTCPServer(ctx, TCPServerConfig{
+		Name:  "alias",
+		Addrs: []string{"127.0.0.1:0"},
+		Handler: func(conn net.Conn) {
+			_, _ = conn.Read(make([]byte, 4096))
+			_, _ = conn.Write([]byte("200 user@example.org\n"))
+		},
+	})
+	s.Require().NoError(err)
+	s.addr = server.listeners[0].Addr().String()
+
+	s.wg.Add(1)
+	go server.Serve(ctx, &s.wg)
+}
+
+func (s *ReplayTestSuite) TearDownTest() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// record writes the lookups to a new recording and returns its path.
+func (s *ReplayTestSuite) record(hashKeys bool) string {
+	path := filepath.Join(s.T().TempDir(), "record.jsonl")
+	recorder, err := NewRecorder(path, hashKeys)
+	s.Require().NoError(err)
+	recorder.Record("alias", "alias@example.org", StatusOK, time.Millisecond)
+	recorder.Record("alias", "none@example.org", StatusNoResult, time.Millisecond)
+	s.Require().NoError(recorder.Close())
+
+	return path
+}
+
+func (s *ReplayTestSuite) TestPlainKeys() {
+	var out bytes.Buffer
+	s.Equal(1, runReplay([]string{"-file", s.record(false), "-alias", s.addr}, &out))
+	s.Contains(out.String(), "alias none@example.org: status 200, recorded 500")
+	s.Contains(out.String(), "lookups: 2, skipped: 0, failed: 0, mismatched: 1")
+}
+
+func (s *ReplayTestSuite) TestHashedKeys() {
+	var out bytes.Buffer
+	s.Equal(2, runReplay([]string{"-file", s.record(true), "-alias", s.addr}, &out))
+	s.Contains(out.String(), "record with RECORD_PLAIN_KEYS=true")
+	s.Contains(out.String(), "lookups: 0, skipped: 2, failed: 0, mismatched: 0")
+	s.Contains(out.String(), "the recording has only hashed keys")
+}
+
+func (s *ReplayTestSuite) TestMissingFile() {
+	var out bytes.Buffer
+	s.Equal(2, runReplay([]string{"-file", filepath.Join(s.T().TempDir(), "missing.jsonl")}, &out))
+}
+
+func TestReplay(t *testing.T) {
+	suite.Run(t, new(ReplayTestSuite))
+}
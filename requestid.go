@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type requestIDKey struct{}
+
+// NewRequestID returns a random identifier for a single lookup.
+func NewRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+
+	var id [16]byte
+	hex.Encode(id[:], b[:])
+	return string(id[:])
+}
+
+// WithRequestID returns a copy of ctx carrying the given request id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request id stored in ctx or an empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestContext creates a context and a logger sharing a fresh request id
+// for a lookup of handler.
+func newRequestContext(handler string) (context.Context, *log.Entry) {
+	id := NewRequestID()
+
+	return WithRequestID(context.Background(), id), log.WithFields(log.Fields{"request_id": id, "handler": handler})
+}
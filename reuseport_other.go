@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// reusePortSupported reports whether multiple sockets can listen on the
+// same address.
+const reusePortSupported = false
+
+// reusePortControl is a no-op on platforms without SO_REUSEPORT support.
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// UserliBackend is an additional userli instance serving some domains.
+type UserliBackend struct {
+	Name    string
+	Domains []string
+	Service UserliService
+}
+
+// UserliRouter sends each lookup to the userli instance serving the
+// domain of the key. Lookups of other domains go to the default instance.
+type UserliRouter struct {
+	fallback UserliService
+	domains  map[string]UserliService
+}
+
+// NewUserliRouter returns a router for the backends. Domains are matched
+// case-insensitively.
+func NewUserliRouter(fallback UserliService, backends []UserliBackend) *UserliRouter {
+	domains := make(map[string]UserliService)
+	for _, backend := range backends {
+		for _, domain := range backend.Domains {
+			domains[strings.ToLower(domain)] = backend.Service
+		}
+	}
+
+	return &UserliRouter{fallback: fallback, domains: domains}
+}
+
+// GetAliases implements UserliService.
+func (r *UserliRouter) GetAliases(ctx context.Context, email string) ([]string, error) {
+	return r.route(domainOf(email)).GetAliases(ctx, email)
+}
+
+// GetDomain implements UserliService.
+func (r *UserliRouter) GetDomain(ctx context.Context, domain string) (bool, error) {
+	return r.route(domain).GetDomain(ctx, domain)
+}
+
+// GetMailbox implements UserliService.
+func (r *UserliRouter) GetMailbox(ctx context.Context, email string) (bool, error) {
+	return r.route(domainOf(email)).GetMailbox(ctx, email)
+}
+
+// GetSenders implements UserliService.
+func (r *UserliRouter) GetSenders(ctx context.Context, email string) ([]string, error) {
+	return r.route(domainOf(email)).GetSenders(ctx, email)
+}
+
+// route returns the instance serving domain.
+func (r *UserliRouter) route(domain string) UserliService {
+	if service, ok := r.domains[strings.ToLower(domain)]; ok {
+		return service
+	}
+
+	return r.fallback
+}
+
+// domainOf returns the domain part of an address.
+func domainOf(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return email[i+1:]
+	}
+
+	return ""
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RouterTestSuite struct {
+	suite.Suite
+}
+
+func (s *RouterTestSuite) TestRoute() {
+	ctx := context.Background()
+	fallback := new(MockUserliService)
+	other := new(MockUserliService)
+	fallback.On("GetMailbox", ctx, "user@example.com").Return(true, nil)
+	fallback.On("GetDomain", ctx, "example.com").Return(true, nil)
+	other.On("GetMailbox", ctx, "user@other.org").Return(true, nil)
+	other.On("GetAliases", ctx, "alias@OTHER.org").Return([]string{"user@other.org"}, nil)
+	other.On("GetSenders", ctx, "user@other.org").Return([]string{"user@other.org"}, nil)
+	other.On("GetDomain", ctx, "other.org").Return(true, nil)
+
+	router := NewUserliRouter(fallback, []UserliBackend{{Name: "other", Domains: []string{"Other.org"}, Service: other}})
+
+	ok, err := router.GetMailbox(ctx, "user@example.com")
+	s.NoError(err)
+	s.True(ok)
+
+	ok, err = router.GetDomain(ctx, "example.com")
+	s.NoError(err)
+	s.True(ok)
+
+	ok, err = router.GetMailbox(ctx, "user@other.org")
+	s.NoError(err)
+	s.True(ok)
+
+	aliases, err := router.GetAliases(ctx, "alias@OTHER.org")
+	s.NoError(err)
+	s.Equal([]string{"user@other.org"}, aliases)
+
+	senders, err := router.GetSenders(ctx, "user@other.org")
+	s.NoError(err)
+	s.Equal([]string{"user@other.org"}, senders)
+
+	ok, err = router.GetDomain(ctx, "other.org")
+	s.NoError(err)
+	s.True(ok)
+
+	fallback.AssertExpectations(s.T())
+	other.AssertExpectations(s.T())
+}
+
+func TestRouter(t *testing.T) {
+	suite.Run(t, new(RouterTestSuite))
+}
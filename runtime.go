@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// memoryLimitRatio is the share of the container memory limit used as
+// soft memory limit for the Go runtime.
+const memoryLimitRatio = 0.9
+
+// TuneRuntime sets GOMAXPROCS and the soft memory limit from the cgroup
+// limits found below cgroupRoot. Explicit GOMAXPROCS and GOMEMLIMIT
+// environment variables take precedence.
+func TuneRuntime(cgroupRoot string) {
+	if os.Getenv("GOMAXPROCS") == "" {
+		if procs, ok := cgroupCPULimit(cgroupRoot); ok {
+			runtime.GOMAXPROCS(procs)
+		}
+	}
+
+	if os.Getenv("GOMEMLIMIT") == "" {
+		if limit, ok := cgroupMemoryLimit(cgroupRoot); ok {
+			debug.SetMemoryLimit(int64(float64(limit) * memoryLimitRatio))
+		}
+	}
+
+	procs := runtime.GOMAXPROCS(0)
+	memoryLimit := debug.SetMemoryLimit(-1)
+
+	runtimeGOMAXPROCS.Set(float64(procs))
+	runtimeMemoryLimit.Set(float64(memoryLimit))
+
+	log.WithFields(log.Fields{"gomaxprocs": procs, "memory_limit": memoryLimit}).Info("Runtime configured")
+}
+
+// cgroupCPULimit returns the number of CPUs available to the cgroup,
+// rounded up. It supports cgroup v2 and v1.
+func cgroupCPULimit(root string) (int, bool) {
+	var quota, period float64
+
+	if data, err := os.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		quota, _ = strconv.ParseFloat(fields[0], 64)
+		period, _ = strconv.ParseFloat(fields[1], 64)
+	} else {
+		quota = readCgroupFloat(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+		period = readCgroupFloat(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	}
+
+	if quota <= 0 || period <= 0 {
+		return 0, false
+	}
+
+	return int(math.Max(1, math.Ceil(quota/period))), true
+}
+
+// cgroupMemoryLimit returns the memory limit of the cgroup in bytes.
+// It supports cgroup v2 and v1.
+func cgroupMemoryLimit(root string) (int64, bool) {
+	limit := readCgroupFloat(filepath.Join(root, "memory.max"))
+	if limit <= 0 {
+		limit = readCgroupFloat(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	}
+
+	// cgroup v1 reports a huge number if no limit is set
+	if limit <= 0 || limit >= math.MaxInt64/2 {
+		return 0, false
+	}
+
+	return int64(limit), true
+}
+
+// readCgroupFloat reads a single number from a cgroup file. It returns 0
+// if the file does not exist or contains "max".
+func readCgroupFloat(path string) float64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
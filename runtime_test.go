@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RuntimeTestSuite struct {
+	suite.Suite
+}
+
+func (s *RuntimeTestSuite) write(root, name, content string) {
+	path := filepath.Join(root, name)
+	s.Require().NoError(os.MkdirAll(filepath.Dir(path), 0755))
+	s.Require().NoError(os.WriteFile(path, []byte(content), 0644))
+}
+
+func (s *RuntimeTestSuite) TestCgroupCPULimit() {
+	s.Run("cgroup v2", func() {
+		root := s.T().TempDir()
+		s.write(root, "cpu.max", "150000 100000\n")
+
+		procs, ok := cgroupCPULimit(root)
+		s.True(ok)
+		s.Equal(2, procs)
+	})
+
+	s.Run("cgroup v2 unlimited", func() {
+		root := s.T().TempDir()
+		s.write(root, "cpu.max", "max 100000\n")
+
+		_, ok := cgroupCPULimit(root)
+		s.False(ok)
+	})
+
+	s.Run("cgroup v1", func() {
+		root := s.T().TempDir()
+		s.write(root, "cpu/cpu.cfs_quota_us", "50000\n")
+		s.write(root, "cpu/cpu.cfs_period_us", "100000\n")
+
+		procs, ok := cgroupCPULimit(root)
+		s.True(ok)
+		s.Equal(1, procs)
+	})
+
+	s.Run("no cgroup", func() {
+		_, ok := cgroupCPULimit(s.T().TempDir())
+		s.False(ok)
+	})
+}
+
+func (s *RuntimeTestSuite) TestCgroupMemoryLimit() {
+	s.Run("cgroup v2", func() {
+		root := s.T().TempDir()
+		s.write(root, "memory.max", "536870912\n")
+
+		limit, ok := cgroupMemoryLimit(root)
+		s.True(ok)
+		s.Equal(int64(536870912), limit)
+	})
+
+	s.Run("cgroup v2 unlimited", func() {
+		root := s.T().TempDir()
+		s.write(root, "memory.max", "max\n")
+
+		_, ok := cgroupMemoryLimit(root)
+		s.False(ok)
+	})
+
+	s.Run("cgroup v1 unlimited", func() {
+		root := s.T().TempDir()
+		s.write(root, "memory/memory.limit_in_bytes", "9223372036854771712\n")
+
+		_, ok := cgroupMemoryLimit(root)
+		s.False(ok)
+	})
+}
+
+func TestRuntime(t *testing.T) {
+	suite.Run(t, new(RuntimeTestSuite))
+}
@@ -0,0 +1,63 @@
+#!/bin/sh
+# Compares the output of `go test -bench -benchmem` with a baseline and
+# fails if a benchmark got slower than THRESHOLD percent or allocates more
+# often. The fastest run of every benchmark is compared.
+#
+# Usage: bench-compare.sh baseline.txt current.txt
+set -eu
+
+baseline=$1
+current=$2
+threshold=${THRESHOLD:-20}
+
+awk -v threshold="$threshold" '
+function record(file, name, ns, allocs) {
+	sub(/-[0-9]+$/, "", name)
+	if (!((file, name) in best) || ns < best[file, name]) {
+		best[file, name] = ns
+	}
+	if (!((file, name) in mallocs) || allocs < mallocs[file, name]) {
+		mallocs[file, name] = allocs
+	}
+	if (file == 2 && !(name in seen)) {
+		seen[name] = 1
+		names[++count] = name
+	}
+}
+
+FNR == 1 { file++ }
+
+/^Benchmark/ {
+	ns = ""; allocs = 0
+	for (i = 3; i < NF; i++) {
+		if ($(i + 1) == "ns/op") ns = $i
+		if ($(i + 1) == "allocs/op") allocs = $i
+	}
+	if (ns != "") record(file, $1, ns, allocs)
+}
+
+END {
+	failed = 0
+	printf "%-40s %14s %14s %8s %12s\n", "benchmark", "baseline", "current", "delta", "allocs"
+	for (i = 1; i <= count; i++) {
+		name = names[i]
+		if (!((1, name) in best)) {
+			printf "%-40s %14s %11.1fns %8s %12s\n", name, "-", best[2, name], "new", mallocs[2, name]
+			continue
+		}
+
+		delta = (best[2, name] - best[1, name]) / best[1, name] * 100
+		status = ""
+		if (delta > threshold) {
+			status = " slower"
+			failed = 1
+		}
+		if (mallocs[2, name] > mallocs[1, name]) {
+			status = status " allocs"
+			failed = 1
+		}
+		printf "%-40s %11.1fns %11.1fns %+7.1f%% %5d -> %-4d%s\n", name, best[1, name], best[2, name], delta, mallocs[1, name], mallocs[2, name], status
+	}
+	exit failed
+}
+' "$baseline" "$current"
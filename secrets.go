@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SecretProvider fetches the userli token from an external source.
+type SecretProvider interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// FileSecretProvider reads the token from a file, e.g. a mounted
+// Kubernetes secret.
+type FileSecretProvider struct {
+	Path string
+}
+
+// Token returns the trimmed content of the file.
+func (f *FileSecretProvider) Token(_ context.Context) (string, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", f.Path)
+	}
+
+	return token, nil
+}
+
+// VaultSecretProvider reads the token from a HashiCorp Vault KV secret.
+// Both KV version 1 and version 2 secrets are supported.
+type VaultSecretProvider struct {
+	addr  string
+	token string
+	path  string
+	field string
+
+	Client *http.Client
+}
+
+// NewVaultSecretProvider creates a new VaultSecretProvider.
+func NewVaultSecretProvider(addr, token, path, field string) *VaultSecretProvider {
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	return &VaultSecretProvider{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		path:   strings.TrimPrefix(path, "/"),
+		field:  field,
+		Client: client,
+	}
+}
+
+// Token fetches the secret and returns the configured field.
+func (v *VaultSecretProvider) Token(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/%s", v.addr, v.path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned status %d", resp.StatusCode)
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+
+	data := secret.Data
+	// KV version 2 nests the secret in data.data
+	if nested, ok := data["data"]; ok {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return "", err
+		}
+	}
+
+	raw, ok := data[v.field]
+	if !ok {
+		return "", fmt.Errorf("field %q not found in vault secret", v.field)
+	}
+
+	var token string
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", errors.New("vault secret is empty")
+	}
+
+	return token, nil
+}
+
+// NewSecretProvider returns the secret provider configured in config or
+// nil if the token is configured directly.
+func NewSecretProvider(config *Config) SecretProvider {
+	switch {
+	case config.VaultAddr != "":
+		return NewVaultSecretProvider(config.VaultAddr, config.VaultToken, config.VaultSecretPath, config.VaultSecretField)
+	case config.UserliTokenFile != "":
+		return &FileSecretProvider{Path: config.UserliTokenFile}
+	default:
+		return nil
+	}
+}
+
+// WatchSecret periodically fetches the token from the provider and
+// updates the userli client. Errors keep the previous token.
+func WatchSecret(ctx context.Context, provider SecretProvider, interval time.Duration, userli *Userli) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			token, err := provider.Token(ctx)
+			if err != nil {
+				log.WithError(err).Error("Error refreshing userli token")
+				continue
+			}
+			redactor.Add(token)
+			userli.SetToken(token)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/suite"
+)
+
+type SecretsTestSuite struct {
+	suite.Suite
+}
+
+func (s *SecretsTestSuite) SetupTest() {
+	gock.DisableNetworking()
+	defer gock.Off()
+}
+
+func (s *SecretsTestSuite) TestFileSecretProvider() {
+	s.Run("success", func() {
+		path := filepath.Join(s.T().TempDir(), "token")
+		s.Require().NoError(os.WriteFile(path, []byte("secret\n"), 0600))
+
+		token, err := (&FileSecretProvider{Path: path}).Token(context.Background())
+		s.NoError(err)
+		s.Equal("secret", token)
+	})
+
+	s.Run("empty file", func() {
+		path := filepath.Join(s.T().TempDir(), "token")
+		s.Require().NoError(os.WriteFile(path, []byte("\n"), 0600))
+
+		_, err := (&FileSecretProvider{Path: path}).Token(context.Background())
+		s.Error(err)
+	})
+}
+
+func (s *SecretsTestSuite) TestVaultSecretProvider() {
+	s.Run("kv v2", func() {
+		gock.New("http://vault:8200").
+			Get("/v1/secret/data/userli").
+			MatchHeader("X-Vault-Token", "root").
+			Reply(200).
+			JSON(map[string]interface{}{"data": map[string]interface{}{"data": map[string]string{"token": "secret"}}})
+
+		provider := NewVaultSecretProvider("http://vault:8200", "root", "secret/data/userli", "token")
+		token, err := provider.Token(context.Background())
+		s.NoError(err)
+		s.Equal("secret", token)
+		s.True(gock.IsDone())
+	})
+
+	s.Run("kv v1", func() {
+		gock.New("http://vault:8200").
+			Get("/v1/secret/userli").
+			Reply(200).
+			JSON(map[string]interface{}{"data": map[string]string{"token": "secret"}})
+
+		provider := NewVaultSecretProvider("http://vault:8200", "root", "secret/userli", "token")
+		token, err := provider.Token(context.Background())
+		s.NoError(err)
+		s.Equal("secret", token)
+	})
+
+	s.Run("missing field", func() {
+		gock.New("http://vault:8200").
+			Get("/v1/secret/userli").
+			Reply(200).
+			JSON(map[string]interface{}{"data": map[string]string{"other": "secret"}})
+
+		provider := NewVaultSecretProvider("http://vault:8200", "root", "secret/userli", "token")
+		_, err := provider.Token(context.Background())
+		s.Error(err)
+	})
+
+	s.Run("forbidden", func() {
+		gock.New("http://vault:8200").
+			Get("/v1/secret/userli").
+			Reply(403)
+
+		provider := NewVaultSecretProvider("http://vault:8200", "root", "secret/userli", "token")
+		_, err := provider.Token(context.Background())
+		s.Error(err)
+	})
+}
+
+func TestSecrets(t *testing.T) {
+	suite.Run(t, new(SecretsTestSuite))
+}
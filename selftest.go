@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// selftestCheck is a single check of the selftest against a lookup server.
+type selftestCheck struct {
+	name string
+	run  func(ctx context.Context, mapName, addr, key string) error
+}
+
+// selftestChecks are run against every lookup server in order.
+var selftestChecks = []selftestCheck{
+	{"lookup", selftestLookup},
+	{"invalid command", selftestInvalidCommand},
+	{"oversized request", selftestOversizedRequest},
+	{"lookup after oversized request", selftestLookup},
+}
+
+// lookupAddrFlags defines the flags with the addresses of the lookup
+// servers by map name.
+func lookupAddrFlags(flags *flag.FlagSet) map[string]*string {
+	return map[string]*string{
+		"alias":     flags.String("alias", "127.0.0.1:10001", "Address of the alias lookup server"),
+		"domain":    flags.String("domain", "127.0.0.1:10002", "Address of the domain lookup server"),
+		"mailbox":   flags.String("mailbox", "127.0.0.1:10003", "Address of the mailbox lookup server"),
+		"senders":   flags.String("senders", "127.0.0.1:10004", "Address of the senders lookup server"),
+		"recipient": flags.String("recipient", "", "Address of the recipient lookup server, empty to skip it"),
+	}
+}
+
+// runSelftest talks to the running lookup servers like Postfix does and
+// verifies their answers. It returns 1 if any check fails.
+func runSelftest(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 5*time.Second, "Timeout of each check")
+	key := flags.String("key", healthCheckDomain, "Key looked up in every map, e.g. the HEALTH_CHECK_KEY")
+	addrs := lookupAddrFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	failed := 0
+	for _, mapName := range []string{"alias", "domain", "mailbox", "senders", "recipient"} {
+		if *addrs[mapName] == "" {
+			continue
+		}
+
+		for _, check := range selftestChecks {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			err := check.run(ctx, mapName, *addrs[mapName], *key)
+			cancel()
+
+			if err != nil {
+				failed++
+				fmt.Fprintf(out, "FAIL %s %s: %v\n", mapName, check.name, err)
+				continue
+			}
+			fmt.Fprintf(out, "ok   %s %s\n", mapName, check.name)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(out, "%d checks failed\n", failed)
+		return 1
+	}
+
+	return 0
+}
+
+// selftestLookup looks up key and expects a valid answer from userli. A
+// domain is turned into an address in the maps looking up addresses.
+func selftestLookup(ctx context.Context, mapName, addr, key string) error {
+	if mapName != "domain" && !strings.Contains(key, "@") {
+		key = "selftest@" + key
+	}
+
+	status, err := sendLookup(ctx, addr, key)
+	if err != nil {
+		return err
+	}
+	if status != StatusOK && status != StatusNoResult {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+
+	return nil
+}
+
+// selftestInvalidCommand sends an unsupported command and expects a
+// temporary error.
+func selftestInvalidCommand(ctx context.Context, _, addr, key string) error {
+	line, err := exchange(ctx, addr, "put "+key+"\n")
+	if err != nil {
+		return err
+	}
+
+	expected := (&Response{Status: StatusError, Response: ResponsePayloadError}).String()
+	if line != expected {
+		return fmt.Errorf("expected %q, got %q", expected, line)
+	}
+
+	return nil
+}
+
+// selftestOversizedRequest sends a request larger than the read buffer and
+// expects the server to answer or close the connection without hanging.
+func selftestOversizedRequest(ctx context.Context, _, addr, _ string) error {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	line, err := send(conn, "get "+strings.Repeat("a", 2*readBufferSize)+"\n")
+
+	var netErr net.Error
+	switch {
+	case err == nil:
+		status, _, _ := strings.Cut(line, " ")
+		if status != StatusOK.String() && status != StatusError.String() && status != StatusNoResult.String() {
+			return fmt.Errorf("unexpected answer %q", line)
+		}
+		return nil
+	case errors.Is(err, io.EOF) && line == "",
+		// closing the connection with unread request data resets it
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return nil
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errors.New("no answer")
+	}
+
+	return err
+}
+
+// exchange sends request to addr and returns the first line of the
+// response.
+func exchange(ctx context.Context, addr, request string) (string, error) {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	return send(conn, request)
+}
+
+// dial connects to addr with the deadline of ctx.
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	return conn, nil
+}
+
+// send writes request to conn and returns the first line of the response.
+func send(conn net.Conn, request string) (string, error) {
+	if _, err := io.WriteString(conn, request); err != nil {
+		return "", err
+	}
+
+	return bufio.NewReader(conn).ReadString('\n')
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type SelftestTestSuite struct {
+	suite.Suite
+}
+
+func (s *SelftestTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *SelftestTestSuite) TestRunSelftest() {
+	s.Run("healthy", func() {
+		userli := new(MockUserliService)
+		userli.On("GetAliases", mock.Anything, mock.Anything).Return([]string{}, nil)
+		userli.On("GetDomain", mock.Anything, mock.Anything).Return(false, nil)
+		userli.On("GetMailbox", mock.Anything, mock.Anything).Return(false, nil)
+		userli.On("GetSenders", mock.Anything, mock.Anything).Return([]string{}, nil)
+
+		var out bytes.Buffer
+		s.Equal(0, runSelftest(s.serve(userli), &out))
+		s.NotContains(out.String(), "FAIL")
+	})
+
+	s.Run("userli unavailable", func() {
+		userli := new(MockUserliService)
+		userli.On("GetAliases", mock.Anything, mock.Anything).Return([]string{}, nil)
+		userli.On("GetDomain", mock.Anything, mock.Anything).Return(false, errors.New("unavailable"))
+		userli.On("GetMailbox", mock.Anything, mock.Anything).Return(false, nil)
+		userli.On("GetSenders", mock.Anything, mock.Anything).Return([]string{}, nil)
+
+		var out bytes.Buffer
+		s.Equal(1, runSelftest(s.serve(userli), &out))
+		s.Contains(out.String(), "FAIL domain lookup: unexpected status 400")
+		s.Contains(out.String(), "ok   alias lookup")
+	})
+
+	s.Run("configured key", func() {
+		userli := new(MockUserliService)
+		userli.On("GetAliases", mock.Anything, "selftest@example.org").Return([]string{}, nil)
+		userli.On("GetDomain", mock.Anything, "example.org").Return(true, nil)
+		userli.On("GetMailbox", mock.Anything, "selftest@example.org").Return(false, nil)
+		userli.On("GetSenders", mock.Anything, "selftest@example.org").Return([]string{}, nil)
+
+		var out bytes.Buffer
+		s.Equal(0, runSelftest(append(s.serve(userli), "-key", "example.org"), &out))
+		s.NotContains(out.String(), "FAIL")
+	})
+
+	s.Run("server not running", func() {
+		var out bytes.Buffer
+		s.Equal(1, runSelftest([]string{"-alias", "127.0.0.1:1", "-domain", "127.0.0.1:1", "-mailbox", "127.0.0.1:1", "-senders", "127.0.0.1:1", "-recipient", "127.0.0.1:1"}, &out))
+	})
+}
+
+func (s *SelftestTestSuite) TestOversizedRequest() {
+	s.Run("server not running", func() {
+		s.Error(selftestOversizedRequest(context.Background(), "alias", "127.0.0.1:1", healthCheckDomain))
+	})
+
+	s.Run("answer", func() {
+		addr := s.listen(func(conn net.Conn) {
+			_, _ = conn.Read(make([]byte, readBufferSize))
+			_, _ = conn.Write([]byte("500 NO%20RESULT\n"))
+		})
+		s.NoError(selftestOversizedRequest(context.Background(), "alias", addr, healthCheckDomain))
+	})
+
+	s.Run("close", func() {
+		addr := s.listen(func(conn net.Conn) {})
+		s.NoError(selftestOversizedRequest(context.Background(), "alias", addr, healthCheckDomain))
+	})
+
+	s.Run("unexpected answer", func() {
+		addr := s.listen(func(conn net.Conn) {
+			_, _ = conn.Read(make([]byte, readBufferSize))
+			_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\n"))
+		})
+		s.ErrorContains(selftestOversizedRequest(context.Background(), "alias", addr, healthCheckDomain), "unexpected answer")
+	})
+}
+
+// listen starts a TCP server calling handler for every connection until
+// the test ends and returns its address.
+func (s *SelftestTestSuite) listen(handler func(conn net.Conn)) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	s.T().Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	server, err := NewTCPServer(ctx, TCPServerConfig{Name: "alias", Addrs: []string{"127.0.0.1:0"}, Handler: handler})
+	s.Require().NoError(err)
+
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+
+	return server.listeners[0].Addr().String()
+}
+
+// serve starts the lookup servers for userli until the test ends and
+// returns the selftest arguments with their addresses.
+func (s *SelftestTestSuite) serve(userli UserliService) []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	s.T().Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	var args []string
+	for name, handler := range lookupHandlers(NewPostfixAdapter(userli)) {
+		server, err := NewTCPServer(ctx, TCPServerConfig{Name: name, Addrs: []string{"127.0.0.1:0"}, Handler: handler})
+		s.Require().NoError(err)
+
+		wg.Add(1)
+		go server.Serve(ctx, &wg)
+
+		args = append(args, "-"+name, server.listeners[0].Addr().String())
+	}
+
+	return args
+}
+
+func TestSelftest(t *testing.T) {
+	suite.Run(t, new(SelftestTestSuite))
+}
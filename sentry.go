@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sentryThrottle is the minimum interval between two events with the
+	// same fingerprint.
+	sentryThrottle = time.Minute
+
+	sentryQueueSize = 100
+
+	// sentryFatalTimeout bounds sending fatal events, which happens
+	// synchronously because the process exits right afterwards.
+	sentryFatalTimeout = 2 * time.Second
+)
+
+// sentryAddressPattern matches email addresses, which are hashed before
+// they are sent to sentry.
+var sentryAddressPattern = regexp.MustCompile(`[^\s@/"':]+@[^\s@/"':]+`)
+
+// SentryHook is a logrus hook sending error entries to Sentry. Events are
+// fingerprinted by subsystem and message and sent asynchronously.
+type SentryHook struct {
+	storeURL    string
+	auth        string
+	environment string
+	client      *http.Client
+
+	events chan map[string]interface{}
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewSentryHook creates a hook for the given DSN, e.g.
+// "https://public@sentry.example.org/1".
+func NewSentryHook(dsn, environment string) (*SentryHook, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("sentry dsn has no public key")
+	}
+
+	projectID := strings.Trim(u.Path, "/")
+	if projectID == "" {
+		return nil, fmt.Errorf("sentry dsn has no project id")
+	}
+
+	return &SentryHook{
+		storeURL:    fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, projectID),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=userli-postfix-adapter/%s", u.User.Username(), version),
+		environment: environment,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		events:      make(chan map[string]interface{}, sentryQueueSize),
+		seen:        make(map[string]time.Time),
+	}, nil
+}
+
+// Levels implements log.Hook.
+func (h *SentryHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+// Fire implements log.Hook.
+func (h *SentryHook) Fire(entry *log.Entry) error {
+	subsystem := sentrySubsystem(entry.Data)
+	fingerprint := []string{subsystem, scrubAddresses(entry.Message)}
+
+	if !h.allow(strings.Join(fingerprint, "\x00")) {
+		return nil
+	}
+
+	tags := map[string]string{"subsystem": subsystem}
+	extra := make(map[string]interface{})
+	for key, value := range entry.Data {
+		if key == log.ErrorKey {
+			continue
+		}
+		extra[key] = scrubAddresses(fmt.Sprint(value))
+	}
+
+	message := entry.Message
+	if err, ok := entry.Data[log.ErrorKey].(error); ok {
+		message = fmt.Sprintf("%s: %s", entry.Message, err)
+	}
+	message = scrubAddresses(message)
+
+	event := map[string]interface{}{
+		"event_id":    sentryEventID(),
+		"timestamp":   entry.Time.UTC().Format(time.RFC3339),
+		"level":       sentryLevel(entry.Level),
+		"logger":      "logrus",
+		"platform":    "go",
+		"release":     version,
+		"environment": h.environment,
+		"message":     map[string]string{"formatted": message},
+		"fingerprint": fingerprint,
+		"tags":        tags,
+		"extra":       extra,
+	}
+
+	if entry.Level <= log.FatalLevel {
+		ctx, cancel := context.WithTimeout(context.Background(), sentryFatalTimeout)
+		defer cancel()
+
+		// do not return the error to avoid logrus printing it on stderr
+		// in the middle of the fatal log entry
+		_ = h.send(ctx, event)
+		return nil
+	}
+
+	select {
+	case h.events <- event:
+	default:
+		// drop the event if sentry can not keep up
+	}
+
+	return nil
+}
+
+// Run sends queued events until the context is canceled.
+func (h *SentryHook) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-h.events:
+			if err := h.send(ctx, event); err != nil {
+				// do not log on error level to avoid a feedback loop
+				log.WithError(err).Warn("Error sending event to sentry")
+			}
+		}
+	}
+}
+
+func (h *SentryHook) send(ctx context.Context, event map[string]interface{}) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.storeURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", h.auth)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// allow reports whether an event with the fingerprint may be sent.
+func (h *SentryHook) allow(fingerprint string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := h.seen[fingerprint]; ok && now.Sub(last) < sentryThrottle {
+		return false
+	}
+	h.seen[fingerprint] = now
+
+	return true
+}
+
+// sentrySubsystem derives the subsystem from the log fields.
+func sentrySubsystem(fields log.Fields) string {
+	for _, key := range []string{"handler", "server"} {
+		if value, ok := fields[key]; ok {
+			return fmt.Sprint(value)
+		}
+	}
+
+	return "adapter"
+}
+
+// scrubAddresses replaces email addresses in s with a short hash, so
+// events can still be correlated without sending the address.
+func scrubAddresses(s string) string {
+	return sentryAddressPattern.ReplaceAllStringFunc(s, hashKey)
+}
+
+func sentryLevel(level log.Level) string {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return "fatal"
+	default:
+		return "error"
+	}
+}
+
+func sentryEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
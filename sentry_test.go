@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type SentryTestSuite struct {
+	suite.Suite
+}
+
+func (s *SentryTestSuite) TestNewSentryHook() {
+	s.Run("valid dsn", func() {
+		hook, err := NewSentryHook("https://public@sentry.example.org/42", "production")
+		s.NoError(err)
+		s.Equal("https://sentry.example.org/api/42/store/", hook.storeURL)
+		s.Contains(hook.auth, "sentry_key=public")
+	})
+
+	s.Run("missing key", func() {
+		_, err := NewSentryHook("https://sentry.example.org/42", "")
+		s.Error(err)
+	})
+
+	s.Run("missing project", func() {
+		_, err := NewSentryHook("https://public@sentry.example.org/", "")
+		s.Error(err)
+	})
+}
+
+func (s *SentryTestSuite) TestFire() {
+	received := make(chan map[string]interface{}, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.True(strings.HasPrefix(r.Header.Get("X-Sentry-Auth"), "Sentry sentry_version=7"))
+
+		var event map[string]interface{}
+		s.NoError(json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+	}))
+	defer server.Close()
+
+	hook, err := NewSentryHook(strings.Replace(server.URL, "http://", "http://public@", 1)+"/1", "test")
+	s.Require().NoError(err)
+	hook.client = server.Client()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hook.Run(ctx)
+
+	entry := log.WithFields(log.Fields{"handler": "alias", log.ErrorKey: errors.New("timeout")})
+	entry.Message = "Error fetching data"
+	entry.Level = log.ErrorLevel
+	entry.Time = time.Now()
+
+	s.NoError(hook.Fire(entry))
+	// the same fingerprint is throttled
+	s.NoError(hook.Fire(entry))
+
+	select {
+	case event := <-received:
+		s.Equal([]interface{}{"alias", "Error fetching data"}, event["fingerprint"])
+		s.Equal(map[string]interface{}{"formatted": "Error fetching data: timeout"}, event["message"])
+		s.Equal(version, event["release"])
+	case <-time.After(time.Second):
+		s.Fail("no event received")
+	}
+
+	select {
+	case <-received:
+		s.Fail("throttled event was sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *SentryTestSuite) TestFireFatal() {
+	received := make(chan map[string]interface{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		s.NoError(json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+	}))
+	defer server.Close()
+
+	hook, err := NewSentryHook(strings.Replace(server.URL, "http://", "http://public@", 1)+"/1", "test")
+	s.Require().NoError(err)
+	hook.client = server.Client()
+
+	// no Run loop, fatal events are sent before Fire returns
+	entry := log.WithFields(log.Fields{"email": "user@example.org"})
+	entry.Message = "Error fetching data for user@example.org"
+	entry.Level = log.FatalLevel
+	entry.Time = time.Now()
+
+	s.NoError(hook.Fire(entry))
+
+	select {
+	case event := <-received:
+		s.Equal("fatal", event["level"])
+		s.Equal(map[string]interface{}{"formatted": "Error fetching data for " + scrubAddresses("user@example.org")}, event["message"])
+		s.Equal(scrubAddresses("user@example.org"), event["extra"].(map[string]interface{})["email"])
+		s.NotContains(fmt.Sprint(event), "user@example.org")
+	default:
+		s.Fail("fatal event was not sent synchronously")
+	}
+}
+
+func (s *SentryTestSuite) TestScrubAddresses() {
+	scrubbed := scrubAddresses(`Get "http://localhost:8000/api/postfix/alias/user@example.org": timeout`)
+
+	s.NotContains(scrubbed, "user@example.org")
+	s.Contains(scrubbed, "/api/postfix/alias/sha256:")
+	s.Equal("no address", scrubAddresses("no address"))
+}
+
+func TestSentry(t *testing.T) {
+	suite.Run(t, new(SentryTestSuite))
+}
@@ -2,53 +2,606 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func StartTCPServer(ctx context.Context, wg *sync.WaitGroup, addr string, handler func(net.Conn)) {
-	defer wg.Done()
+// TCPServerConfig is the configuration for a single tcp_table server.
+type TCPServerConfig struct {
+	// Name identifies the server in logs and metrics.
+	Name string
+
+	// Network is the network to listen on ("tcp", "tcp4" or "tcp6").
+	Network string
+
+	// Addrs are the addresses to listen on.
+	Addrs []string
+
+	// Handler is called for every accepted connection.
+	Handler func(net.Conn)
+
+	// MaxConnections is the maximum number of concurrent connections.
+	// Further connections are closed immediately. Zero means unlimited.
+	MaxConnections int
+
+	// OnConnectionPoolFull is called with the server name for every
+	// connection rejected because MaxConnections is reached.
+	OnConnectionPoolFull func(server string)
+
+	// AllowedNets are the client networks allowed to connect. Empty
+	// allows all.
+	AllowedNets []netip.Prefix
+
+	// MaxConnectionsPerIP is the maximum number of concurrent connections
+	// per client address. Zero means unlimited.
+	MaxConnectionsPerIP int
+
+	// AcceptLoops is the number of goroutines accepting connections per
+	// address. Zero means one.
+	AcceptLoops int
+
+	// ReadTimeout is the maximum time to receive a request, measured from
+	// accepting the connection. Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the maximum time to write a response. Zero means no
+	// timeout.
+	WriteTimeout time.Duration
+
+	// IdleTimeout is the maximum time a connection may stay open without
+	// receiving data. Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// KeepAlive is the interval of TCP keep-alive probes on accepted
+	// connections. Zero disables keep-alive.
+	KeepAlive time.Duration
+
+	// DisableNoDelay enables Nagle's algorithm on accepted connections.
+	DisableNoDelay bool
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the socket
+	// buffers of accepted connections. Zero keeps the system default.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// AcceptRate is the maximum number of accepted connections per second
+	// across all addresses. Further connections wait in the listen
+	// backlog. Zero means unlimited.
+	AcceptRate float64
+
+	// AcceptBurst is the number of connections accepted at once before
+	// AcceptRate applies.
+	AcceptBurst int
+
+	// ReusePort opens one socket with SO_REUSEPORT per accept loop, so the
+	// kernel distributes new connections between them. Only supported on
+	// Linux, elsewhere all accept loops share one socket.
+	ReusePort bool
+
+	// Workers runs the handlers if set. Connections that find no idle
+	// worker and no room in its queue are passed to OnOverload instead.
+	Workers *WorkerPool
+
+	// OnOverload is called with the server name for every connection
+	// rejected by Workers. The connection is closed afterwards.
+	OnOverload func(server string, conn net.Conn)
+
+	// OnConnectionDenied is called with the server name and the reason
+	// for every connection rejected because of AllowedNets or
+	// MaxConnectionsPerIP.
+	OnConnectionDenied func(server, reason string)
+
+	// Health receives the state of the listeners if set.
+	Health *Health
+
+	// Handover provides the sockets inherited from a previous process and
+	// passes them on upgrade if set.
+	Handover *Handover
+
+	// ShutdownTimeout is the maximum time to wait for active connections
+	// on shutdown before they are closed forcefully. Zero waits forever.
+	ShutdownTimeout time.Duration
+}
+
+// TCPServer serves tcp_table connections on one or more listeners.
+type TCPServer struct {
+	config    TCPServerConfig
+	listeners []net.Listener
+	limiter   *acceptLimiter
+
+	mu       sync.Mutex
+	conns    map[uint64]*trackedConn
+	perIP    map[netip.Addr]int
+	activeWg sync.WaitGroup
+}
+
+const (
+	// acceptBackoffMin and acceptBackoffMax bound the delay after a
+	// failed accept.
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+
+	denyReasonNetwork    = "network"
+	denyReasonPerIPLimit = "per_ip_limit"
+)
+
+var (
+	errConnectionPoolFull = errors.New("connection pool full")
+	errPerIPLimit         = errors.New("connection limit per client address reached")
+)
+
+// connectionID is the last assigned connection id. Ids are unique across
+// all servers.
+var connectionID atomic.Uint64
+
+// trackedConn is an accepted connection with the information exposed by
+// the connections endpoint.
+type trackedConn struct {
+	net.Conn
+
+	id       uint64
+	addr     netip.Addr
+	server   string
+	listener string
+	since    time.Time
+	requests atomic.Int64
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	// writeDeadline is the deadline set by the handler, if any.
+	writeDeadline time.Time
+}
+
+// Read applies the read and idle timeouts before reading.
+func (c *trackedConn) Read(b []byte) (int, error) {
+	var deadline time.Time
+	if c.idleTimeout > 0 {
+		deadline = time.Now().Add(c.idleTimeout)
+	}
+	if c.readTimeout > 0 {
+		if d := c.since.Add(c.readTimeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if !deadline.IsZero() {
+		_ = c.Conn.SetReadDeadline(deadline)
+	}
+
+	n, err := c.Conn.Read(b)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		log.WithFields(log.Fields{"server": c.server, "remote_addr": c.RemoteAddr().String()}).Warn("Closing slow client")
+		addCounter(slowClients.WithLabelValues(c.server), "slow_clients", 1, map[string]string{"server": c.server})
+	}
+
+	return n, err
+}
+
+// NetConn returns the underlying connection.
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// SetWriteDeadline sets a deadline that takes precedence over a later
+// one derived from the write timeout.
+func (c *trackedConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Write applies the write timeout and counts every response written as a
+// served request.
+func (c *trackedConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if d := time.Now().Add(c.writeTimeout); c.writeDeadline.IsZero() || d.Before(c.writeDeadline) {
+			_ = c.Conn.SetWriteDeadline(d)
+		}
+	}
+
+	n, err := c.Conn.Write(b)
+	if err == nil {
+		c.requests.Add(1)
+	}
+	return n, err
+}
+
+// ConnectionInfo describes an active connection.
+type ConnectionInfo struct {
+	ID         string  `json:"id"`
+	Server     string  `json:"server"`
+	Listener   string  `json:"listener"`
+	RemoteAddr string  `json:"remote_addr"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Requests   int64   `json:"requests"`
+}
+
+// NewTCPServer binds all configured addresses. The listeners are not
+// accepting connections until Serve is called.
+func NewTCPServer(ctx context.Context, config TCPServerConfig) (*TCPServer, error) {
+	network := config.Network
+	if network == "" {
+		network = "tcp"
+	}
 
 	lc := net.ListenConfig{
 		KeepAlive: -1,
 	}
+	if config.KeepAlive > 0 {
+		lc.KeepAlive = config.KeepAlive
+	}
+
+	sockets := 1
+	if config.ReusePort && reusePortSupported {
+		lc.Control = reusePortControl
+		sockets = max(config.AcceptLoops, 1)
+	}
+
+	listeners := make([]net.Listener, 0, len(config.Addrs)*sockets)
+	for _, configAddr := range config.Addrs {
+		addr := configAddr
+		for i := 0; i < sockets; i++ {
+			key := fmt.Sprintf("%s/%s/%d", config.Name, configAddr, i)
+			listener, err := config.Handover.Listen(ctx, lc, network, key, addr)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, fmt.Errorf("listen on %s: %w", addr, err)
+			}
+			listeners = append(listeners, listener)
+
+			// further sockets bind the port chosen for the first one
+			addr = listener.Addr().String()
+		}
+	}
+
+	for _, listener := range listeners {
+		config.Health.SetListener(config.Name, listener.Addr().String(), false)
+	}
+
+	return &TCPServer{
+		config:    config,
+		listeners: listeners,
+		limiter:   newAcceptLimiter(config.AcceptRate, config.AcceptBurst),
+		conns:     make(map[uint64]*trackedConn),
+		perIP:     make(map[netip.Addr]int),
+	}, nil
+}
+
+// Serve accepts connections on all listeners until the context is canceled.
+func (s *TCPServer) Serve(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	loops := max(s.config.AcceptLoops, 1)
+	if s.config.ReusePort && reusePortSupported {
+		loops = 1
+	}
+
+	var serverWg sync.WaitGroup
+	for _, listener := range s.listeners {
+		serverWg.Add(1)
+		go func() {
+			defer serverWg.Done()
+			s.serve(ctx, listener, loops)
+		}()
+	}
+
+	serverWg.Wait()
+	s.drain()
+}
+
+// drain waits for active connections to finish. Connections still open
+// after the shutdown timeout are closed.
+func (s *TCPServer) drain() {
+	done := make(chan struct{})
+	go func() {
+		s.activeWg.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if s.config.ShutdownTimeout > 0 {
+		timer := time.NewTimer(s.config.ShutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-done:
+		return
+	case <-timeout:
+	}
+
+	s.mu.Lock()
+	closed := len(s.conns)
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
 
-	listener, err := lc.Listen(ctx, "tcp", addr)
+	log.WithFields(log.Fields{"server": s.config.Name, "connections": closed}).Warn("Shutdown timeout reached, closed remaining connections")
+	addCounter(connectionsForceClosed.WithLabelValues(s.config.Name), "connections_force_closed", closed, map[string]string{"server": s.config.Name})
+
+	<-done
+}
+
+// track registers a connection accepted on listener. It returns an error
+// if the connection pool or the limit for the client address is full.
+func (s *TCPServer) track(conn net.Conn, listener string) (*trackedConn, error) {
+	addr := remoteAddr(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config.MaxConnections > 0 && len(s.conns) >= s.config.MaxConnections {
+		return nil, errConnectionPoolFull
+	}
+
+	if s.config.MaxConnectionsPerIP > 0 && s.perIP[addr] >= s.config.MaxConnectionsPerIP {
+		return nil, errPerIPLimit
+	}
+
+	tracked := &trackedConn{
+		Conn:         conn,
+		id:           connectionID.Add(1),
+		addr:         addr,
+		server:       s.config.Name,
+		listener:     listener,
+		since:        time.Now(),
+		readTimeout:  s.config.ReadTimeout,
+		writeTimeout: s.config.WriteTimeout,
+		idleTimeout:  s.config.IdleTimeout,
+	}
+	s.conns[tracked.id] = tracked
+	s.perIP[addr]++
+	s.activeWg.Add(1)
+
+	return tracked, nil
+}
+
+func (s *TCPServer) untrack(conn *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn.id)
+	if s.perIP[conn.addr]--; s.perIP[conn.addr] <= 0 {
+		delete(s.perIP, conn.addr)
+	}
+}
+
+// remoteAddr returns the address of the client without port.
+func remoteAddr(conn net.Conn) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return addrPort.Addr().Unmap()
+}
+
+// deny closes a rejected connection and reports it.
+func (s *TCPServer) deny(conn net.Conn, reason string) {
+	log.WithFields(log.Fields{"server": s.config.Name, "remote_addr": conn.RemoteAddr().String(), "reason": reason}).Warn("Connection denied")
+	if s.config.OnConnectionDenied != nil {
+		s.config.OnConnectionDenied(s.config.Name, reason)
+	}
+	conn.Close()
+}
+
+// Connections returns the active connections ordered by id.
+func (s *TCPServer) Connections() []ConnectionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*trackedConn, 0, len(s.conns))
+	for _, conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].id < conns[j].id
+	})
+
+	now := time.Now()
+	infos := make([]ConnectionInfo, 0, len(conns))
+	for _, conn := range conns {
+		infos = append(infos, ConnectionInfo{
+			ID:         strconv.FormatUint(conn.id, 10),
+			Server:     s.config.Name,
+			Listener:   conn.listener,
+			RemoteAddr: conn.RemoteAddr().String(),
+			AgeSeconds: now.Sub(conn.since).Seconds(),
+			Requests:   conn.requests.Load(),
+		})
+	}
+
+	return infos
+}
+
+// CloseConnection closes the active connection with the id. It returns
+// false if there is no such connection.
+func (s *TCPServer) CloseConnection(id uint64) bool {
+	s.mu.Lock()
+	conn, ok := s.conns[id]
+	s.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	_ = conn.Conn.Close()
+
+	return true
+}
+
+// StartTCPServer listens on all configured addresses and serves
+// connections until the context is canceled.
+func StartTCPServer(ctx context.Context, wg *sync.WaitGroup, config TCPServerConfig) {
+	server, err := NewTCPServer(ctx, config)
 	if err != nil {
 		log.WithError(err).Error("Error creating listener")
+		wg.Done()
 		return
 	}
+
+	server.Serve(ctx, wg)
+}
+
+// serve accepts connections on the listener in loops goroutines and passes
+// them to the handler.
+func (s *TCPServer) serve(ctx context.Context, listener net.Listener, loops int) {
 	defer listener.Close()
 
+	addr := listener.Addr().String()
+
 	go func() {
 		<-ctx.Done()
 		listener.Close()
 	}()
 
 	log.Info("Server started on ", addr)
+	s.config.Health.SetListener(s.config.Name, addr, true)
+	defer s.config.Health.SetListener(s.config.Name, addr, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < loops; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.accept(ctx, listener, addr)
+		}()
+	}
+	wg.Wait()
+
+	log.Info("Server stopped on port ", addr)
+}
 
+// accept accepts connections on the listener until the context is canceled.
+func (s *TCPServer) accept(ctx context.Context, listener net.Listener, addr string) {
+	var delay time.Duration
 	for {
+		throttled, ok := s.limiter.wait(ctx)
+		if !ok {
+			return
+		}
+		if throttled > 0 {
+			addCounter(acceptsThrottled.WithLabelValues(s.config.Name), "accepts_throttled", 1, map[string]string{"server": s.config.Name})
+		}
+
 		conn, err := listener.Accept()
 		if err != nil {
 			if ctx.Err() != nil {
-				log.Info("Server stopped on port ", addr)
 				return
 			}
-			log.WithError(err).Error("Error accepting connection")
+
+			// back off on errors like EMFILE instead of spinning
+			if delay == 0 {
+				delay = acceptBackoffMin
+			} else {
+				delay = min(delay*2, acceptBackoffMax)
+			}
+			log.WithError(err).WithFields(log.Fields{"server": s.config.Name, "retry_in": delay}).Error("Error accepting connection")
+			addCounter(acceptErrors.WithLabelValues(s.config.Name), "accept_errors", 1, map[string]string{"server": s.config.Name})
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
 			continue
 		}
+		delay = 0
 
-		go func() {
-			defer func() {
-				log.Debug("Closing connection")
-				if err := conn.Close(); err != nil {
-					log.WithError(err).Error("Error closing connection")
-				}
-			}()
+		s.tune(conn)
 
-			handler(conn)
-		}()
+		if len(s.config.AllowedNets) > 0 && !remoteAllowed(conn.RemoteAddr().String(), s.config.AllowedNets) {
+			s.deny(conn, denyReasonNetwork)
+			continue
+		}
+
+		tracked, err := s.track(conn, addr)
+		if errors.Is(err, errPerIPLimit) {
+			s.deny(conn, denyReasonPerIPLimit)
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"server": s.config.Name, "remote_addr": conn.RemoteAddr().String()}).Warn("Connection pool full, rejecting connection")
+			if s.config.OnConnectionPoolFull != nil {
+				s.config.OnConnectionPoolFull(s.config.Name)
+			}
+			conn.Close()
+			continue
+		}
+
+		if s.config.Workers == nil {
+			go s.handle(tracked, s.config.Handler)
+			continue
+		}
+
+		if !s.config.Workers.Submit(func() { s.handle(tracked, s.config.Handler) }) {
+			log.WithFields(log.Fields{"server": s.config.Name, "remote_addr": conn.RemoteAddr().String()}).Warn("No worker available, shedding connection")
+			s.handle(tracked, s.overload)
+		}
+	}
+}
+
+// tune applies the socket options to an accepted connection.
+func (s *TCPServer) tune(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if s.config.DisableNoDelay {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			log.WithError(err).WithField("server", s.config.Name).Debug("Error disabling TCP_NODELAY")
+		}
+	}
+	if s.config.ReadBufferSize > 0 {
+		if err := tcpConn.SetReadBuffer(s.config.ReadBufferSize); err != nil {
+			log.WithError(err).WithField("server", s.config.Name).Debug("Error setting SO_RCVBUF")
+		}
+	}
+	if s.config.WriteBufferSize > 0 {
+		if err := tcpConn.SetWriteBuffer(s.config.WriteBufferSize); err != nil {
+			log.WithError(err).WithField("server", s.config.Name).Debug("Error setting SO_SNDBUF")
+		}
+	}
+}
+
+// handle runs handler for the connection and releases it afterwards.
+func (s *TCPServer) handle(conn *trackedConn, handler func(net.Conn)) {
+	defer s.activeWg.Done()
+	defer s.untrack(conn)
+	defer func() {
+		log.Debug("Closing connection")
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.WithError(err).Error("Error closing connection")
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{"server": s.config.Name, "panic": r, "stack": string(debug.Stack())}).Error("Panic in connection handler")
+		}
+	}()
+
+	handler(conn)
+}
+
+// overload passes a connection rejected by the worker pool to OnOverload.
+func (s *TCPServer) overload(conn net.Conn) {
+	if s.config.OnOverload != nil {
+		s.config.OnOverload(s.config.Name, conn)
 	}
 }
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type ServerTestSuite struct {
+	suite.Suite
+}
+
+func (s *ServerTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *ServerTestSuite) TestShutdownTimeout() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	server, err := NewTCPServer(ctx, TCPServerConfig{
+		Name:            "test",
+		Addrs:           []string{"127.0.0.1:0"},
+		ShutdownTimeout: 100 * time.Millisecond,
+		Handler: func(conn net.Conn) {
+			<-block
+		},
+	})
+	s.Require().NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+
+	conn, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	s.Require().NoError(err)
+	defer conn.Close()
+
+	s.Eventually(func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.conns) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	// the handler is still blocked, so Serve only returns after the
+	// connection was closed and the handler gets unblocked.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	s.Error(err)
+
+	block <- struct{}{}
+	s.Eventually(func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (s *ServerTestSuite) TestConnectionPoolFull() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	rejected := make(chan string, 1)
+
+	server, err := NewTCPServer(ctx, TCPServerConfig{
+		Name:                 "test",
+		Addrs:                []string{"127.0.0.1:0"},
+		MaxConnections:       1,
+		OnConnectionPoolFull: func(server string) { rejected <- server },
+		Handler: func(conn net.Conn) {
+			<-block
+		},
+	})
+	s.Require().NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+
+	addr := server.listeners[0].Addr().String()
+
+	first, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer first.Close()
+
+	s.Eventually(func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.conns) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	second, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer second.Close()
+
+	select {
+	case name := <-rejected:
+		s.Equal("test", name)
+	case <-time.After(time.Second):
+		s.Fail("connection was not rejected")
+	}
+
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	s.ErrorIs(err, io.EOF)
+}
+
+func (s *ServerTestSuite) TestReusePort() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := NewTCPServer(ctx, TCPServerConfig{
+		Name:        "test",
+		Addrs:       []string{"127.0.0.1:0"},
+		AcceptLoops: 2,
+		ReusePort:   true,
+		Handler: func(conn net.Conn) {
+			_, _ = conn.Write([]byte("200 1\n"))
+		},
+	})
+	s.Require().NoError(err)
+
+	if reusePortSupported {
+		s.Require().Len(server.listeners, 2)
+		s.Equal(server.listeners[0].Addr().String(), server.listeners[1].Addr().String())
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", server.listeners[0].Addr().String())
+		s.Require().NoError(err)
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		response, err := io.ReadAll(conn)
+		s.NoError(err)
+		s.Equal("200 1\n", string(response))
+		conn.Close()
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func (s *ServerTestSuite) TestReadTimeout() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	readErr := make(chan error, 1)
+
+	before := testutil.ToFloat64(slowClients.WithLabelValues("slow"))
+
+	server, err := NewTCPServer(ctx, TCPServerConfig{
+		Name:        "slow",
+		Addrs:       []string{"127.0.0.1:0"},
+		ReadTimeout: 50 * time.Millisecond,
+		IdleTimeout: time.Hour,
+		Handler: func(conn net.Conn) {
+			_, err := conn.Read(make([]byte, 1))
+			readErr <- err
+		},
+	})
+	s.Require().NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+
+	conn, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	s.Require().NoError(err)
+	defer conn.Close()
+
+	select {
+	case err := <-readErr:
+		var netErr net.Error
+		s.Require().ErrorAs(err, &netErr)
+		s.True(netErr.Timeout())
+	case <-time.After(time.Second):
+		s.Fail("read did not time out")
+	}
+	s.Equal(before+1, testutil.ToFloat64(slowClients.WithLabelValues("slow")))
+
+	cancel()
+	wg.Wait()
+}
+
+func (s *ServerTestSuite) TestConnectionDenied() {
+	s.Run("network", func() {
+		denied := s.serveDenied(TCPServerConfig{
+			AllowedNets: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		}, 1)
+		s.Equal(denyReasonNetwork, denied)
+	})
+
+	s.Run("per ip limit", func() {
+		denied := s.serveDenied(TCPServerConfig{
+			AllowedNets:         []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+			MaxConnectionsPerIP: 1,
+		}, 2)
+		s.Equal(denyReasonPerIPLimit, denied)
+	})
+}
+
+// serveDenied opens n connections to a server with config and returns the
+// reason the last connection was denied for.
+func (s *ServerTestSuite) serveDenied(config TCPServerConfig, n int) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	denied := make(chan string, 1)
+
+	config.Name = "test"
+	config.Addrs = []string{"127.0.0.1:0"}
+	config.OnConnectionDenied = func(_, reason string) { denied <- reason }
+	config.Handler = func(conn net.Conn) {
+		<-block
+	}
+
+	server, err := NewTCPServer(ctx, config)
+	s.Require().NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+
+	var conn net.Conn
+	for i := 0; i < n; i++ {
+		conn, err = net.Dial("tcp", server.listeners[0].Addr().String())
+		s.Require().NoError(err)
+		defer conn.Close()
+	}
+
+	select {
+	case reason := <-denied:
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		s.ErrorIs(err, io.EOF)
+		return reason
+	case <-time.After(time.Second):
+		s.Fail("connection was not denied")
+		return ""
+	}
+}
+
+func (s *ServerTestSuite) TestAcceptBackoff() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener := &failingListener{failures: 3, closed: make(chan struct{})}
+	server := &TCPServer{config: TCPServerConfig{Name: "backoff"}}
+	before := testutil.ToFloat64(acceptErrors.WithLabelValues("backoff"))
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		server.accept(ctx, listener, "127.0.0.1:0")
+		close(done)
+	}()
+
+	s.Eventually(func() bool {
+		return testutil.ToFloat64(acceptErrors.WithLabelValues("backoff")) == before+3
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	close(listener.closed)
+	<-done
+
+	// 5ms + 10ms between the failures, 20ms until canceled at the earliest
+	s.GreaterOrEqual(time.Since(start), 15*time.Millisecond)
+}
+
+// failingListener fails the first accepts and blocks until closed.
+type failingListener struct {
+	net.Listener
+
+	failures int
+	closed   chan struct{}
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, errors.New("too many open files")
+	}
+
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
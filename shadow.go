@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shadowMaxInFlight limits the lookups waiting for the secondary userli.
+// Further lookups are not mirrored until one of them returns.
+const shadowMaxInFlight = 64
+
+// ShadowUserli answers lookups from the primary userli and mirrors a share
+// of them to a secondary userli. The answers are compared in the
+// background, so the secondary never delays or changes a response.
+type ShadowUserli struct {
+	primary   UserliService
+	secondary UserliService
+	rate      float64
+	inFlight  chan struct{}
+}
+
+// NewShadowUserli mirrors the given share of lookups between 0 and 1 from
+// primary to secondary.
+func NewShadowUserli(primary, secondary UserliService, rate float64) *ShadowUserli {
+	return &ShadowUserli{
+		primary:   primary,
+		secondary: secondary,
+		rate:      rate,
+		inFlight:  make(chan struct{}, shadowMaxInFlight),
+	}
+}
+
+// GetAliases implements UserliService.
+func (s *ShadowUserli) GetAliases(ctx context.Context, email string) ([]string, error) {
+	aliases, err := s.primary.GetAliases(ctx, email)
+	if err == nil {
+		shadowCompare(s, ctx, "alias", aliases, func(ctx context.Context) ([]string, error) {
+			return s.secondary.GetAliases(ctx, email)
+		}, equalUnordered)
+	}
+
+	return aliases, err
+}
+
+// GetDomain implements UserliService.
+func (s *ShadowUserli) GetDomain(ctx context.Context, domain string) (bool, error) {
+	exists, err := s.primary.GetDomain(ctx, domain)
+	if err == nil {
+		shadowCompare(s, ctx, "domain", exists, func(ctx context.Context) (bool, error) {
+			return s.secondary.GetDomain(ctx, domain)
+		}, equalBool)
+	}
+
+	return exists, err
+}
+
+// GetMailbox implements UserliService.
+func (s *ShadowUserli) GetMailbox(ctx context.Context, email string) (bool, error) {
+	exists, err := s.primary.GetMailbox(ctx, email)
+	if err == nil {
+		shadowCompare(s, ctx, "mailbox", exists, func(ctx context.Context) (bool, error) {
+			return s.secondary.GetMailbox(ctx, email)
+		}, equalBool)
+	}
+
+	return exists, err
+}
+
+// GetSenders implements UserliService.
+func (s *ShadowUserli) GetSenders(ctx context.Context, email string) ([]string, error) {
+	senders, err := s.primary.GetSenders(ctx, email)
+	if err == nil {
+		shadowCompare(s, ctx, "senders", senders, func(ctx context.Context) ([]string, error) {
+			return s.secondary.GetSenders(ctx, email)
+		}, equalUnordered)
+	}
+
+	return senders, err
+}
+
+// shadowCompare looks up the secondary answer in the background and counts
+// whether it matches the primary one. Lookups are skipped when too many
+// are in flight.
+func shadowCompare[T any](s *ShadowUserli, ctx context.Context, handler string, primary T, lookup func(context.Context) (T, error), equal func(a, b T) bool) {
+	if s.rate < 1 && rand.Float64() >= s.rate {
+		return
+	}
+
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		addCounter(shadowLookups.WithLabelValues(handler, "skipped"), "shadow_lookups", 1, map[string]string{"handler": handler, "result": "skipped"})
+		return
+	}
+
+	// the secondary lookup must outlive the connection of the primary one
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		defer func() { <-s.inFlight }()
+
+		secondary, err := lookup(ctx)
+		result := "match"
+		switch {
+		case err != nil:
+			result = "error"
+			log.WithError(err).WithField("handler", handler).Debug("Error in shadow lookup")
+		case !equal(primary, secondary):
+			result = "mismatch"
+			log.WithFields(log.Fields{"handler": handler, "primary": primary, "secondary": secondary}).Debug("Shadow lookup does not match")
+		}
+
+		addCounter(shadowLookups.WithLabelValues(handler, result), "shadow_lookups", 1, map[string]string{"handler": handler, "result": result})
+	}()
+}
+
+// equalUnordered reports whether a and b contain the same addresses in any
+// order.
+func equalUnordered(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(a, b)
+}
+
+func equalBool(a, b bool) bool {
+	return a == b
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type ShadowTestSuite struct {
+	suite.Suite
+}
+
+func (s *ShadowTestSuite) TestCompare() {
+	ctx, cancel := context.WithCancel(context.Background())
+	primary := new(MockUserliService)
+	secondary := new(MockUserliService)
+	primary.On("GetAliases", mock.Anything, "alias@example.com").Return([]string{"a@example.com", "b@example.com"}, nil)
+	secondary.On("GetAliases", mock.Anything, "alias@example.com").Return([]string{"b@example.com", "a@example.com"}, nil)
+	primary.On("GetMailbox", mock.Anything, "user@example.com").Return(true, nil)
+	secondary.On("GetMailbox", mock.Anything, "user@example.com").Return(false, nil)
+	primary.On("GetDomain", mock.Anything, "example.com").Return(true, nil)
+	secondary.On("GetDomain", mock.Anything, "example.com").Return(false, errors.New("error"))
+
+	match := testutil.ToFloat64(shadowLookups.WithLabelValues("alias", "match"))
+	mismatch := testutil.ToFloat64(shadowLookups.WithLabelValues("mailbox", "mismatch"))
+	failed := testutil.ToFloat64(shadowLookups.WithLabelValues("domain", "error"))
+
+	shadow := NewShadowUserli(primary, secondary, 1)
+
+	aliases, err := shadow.GetAliases(ctx, "alias@example.com")
+	s.NoError(err)
+	s.Equal([]string{"a@example.com", "b@example.com"}, aliases)
+
+	exists, err := shadow.GetMailbox(ctx, "user@example.com")
+	s.NoError(err)
+	s.True(exists)
+
+	exists, err = shadow.GetDomain(ctx, "example.com")
+	s.NoError(err)
+	s.True(exists)
+
+	// the secondary lookups continue after the primary request is done
+	cancel()
+
+	s.Eventually(func() bool {
+		return testutil.ToFloat64(shadowLookups.WithLabelValues("alias", "match")) == match+1 &&
+			testutil.ToFloat64(shadowLookups.WithLabelValues("mailbox", "mismatch")) == mismatch+1 &&
+			testutil.ToFloat64(shadowLookups.WithLabelValues("domain", "error")) == failed+1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (s *ShadowTestSuite) TestPrimaryError() {
+	primary := new(MockUserliService)
+	secondary := new(MockUserliService)
+	primary.On("GetSenders", mock.Anything, "user@example.com").Return([]string{}, errors.New("error"))
+
+	shadow := NewShadowUserli(primary, secondary, 1)
+
+	_, err := shadow.GetSenders(context.Background(), "user@example.com")
+	s.Error(err)
+
+	secondary.AssertNotCalled(s.T(), "GetSenders", mock.Anything, mock.Anything)
+}
+
+func (s *ShadowTestSuite) TestRate() {
+	primary := new(MockUserliService)
+	secondary := new(MockUserliService)
+	primary.On("GetDomain", mock.Anything, "example.com").Return(true, nil)
+
+	shadow := NewShadowUserli(primary, secondary, 0)
+
+	for i := 0; i < 10; i++ {
+		_, err := shadow.GetDomain(context.Background(), "example.com")
+		s.NoError(err)
+	}
+
+	secondary.AssertNotCalled(s.T(), "GetDomain", mock.Anything, mock.Anything)
+}
+
+func TestShadow(t *testing.T) {
+	suite.Run(t, new(ShadowTestSuite))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sloBuckets is the number of buckets the SLO window is divided into.
+const sloBuckets = 60
+
+// slo is the global SLO tracker. It is nil if no tracker was configured.
+var slo *SLOTracker
+
+var successRatioDesc = prometheus.NewDesc(
+	"userli_postfix_adapter_success_ratio",
+	"Share of requests without userli error within the SLO window",
+	[]string{"handler"}, nil,
+)
+
+// SLOTracker keeps a rolling success ratio per map and counts requests
+// exceeding the latency objective. It implements prometheus.Collector to
+// export the success ratio at scrape time.
+type SLOTracker struct {
+	window           time.Duration
+	latencyObjective time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*rollingWindow
+}
+
+// rollingWindow counts requests in fixed size buckets covering the window.
+type rollingWindow struct {
+	buckets [sloBuckets]sloBucket
+}
+
+type sloBucket struct {
+	index  int64
+	total  uint64
+	failed uint64
+}
+
+// NewSLOTracker creates a tracker with the given rolling window and
+// latency objective.
+func NewSLOTracker(window, latencyObjective time.Duration) *SLOTracker {
+	return &SLOTracker{
+		window:           window,
+		latencyObjective: latencyObjective,
+		windows:          make(map[string]*rollingWindow),
+	}
+}
+
+// Observe records a request of the handler. Requests answered with a
+// temporary error because of a userli error count as failed, invalid
+// requests do not. It is safe to call on a nil tracker.
+func (t *SLOTracker) Observe(handler string, response Response, duration time.Duration) {
+	if t == nil {
+		return
+	}
+
+	if duration > t.latencyObjective {
+		addCounter(slowRequests.WithLabelValues(handler), "slow_requests", 1, map[string]string{"handler": handler})
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.windows[handler]
+	if !ok {
+		w = &rollingWindow{}
+		t.windows[handler] = w
+	}
+
+	index := t.bucketIndex(time.Now())
+	bucket := &w.buckets[index%sloBuckets]
+	if bucket.index != index {
+		*bucket = sloBucket{index: index}
+	}
+	bucket.total++
+	if response.Status == StatusError && response.Response != ResponsePayloadError {
+		bucket.failed++
+	}
+}
+
+// SuccessRatio returns the success ratio of the handler within the window.
+// It returns false if there were no requests.
+func (t *SLOTracker) SuccessRatio(handler string) (float64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.windows[handler]
+	if !ok {
+		return 0, false
+	}
+
+	return w.ratio(t.bucketIndex(time.Now()))
+}
+
+func (t *SLOTracker) bucketIndex(now time.Time) int64 {
+	width := t.window.Nanoseconds() / sloBuckets
+	return now.UnixNano() / max(width, 1)
+}
+
+func (w *rollingWindow) ratio(current int64) (float64, bool) {
+	var total, failed uint64
+	for _, bucket := range w.buckets {
+		if bucket.index > current-sloBuckets && bucket.index <= current {
+			total += bucket.total
+			failed += bucket.failed
+		}
+	}
+
+	if total == 0 {
+		return 0, false
+	}
+
+	return float64(total-failed) / float64(total), true
+}
+
+// Describe implements prometheus.Collector.
+func (t *SLOTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- successRatioDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *SLOTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	handlers := make([]string, 0, len(t.windows))
+	for handler := range t.windows {
+		handlers = append(handlers, handler)
+	}
+	t.mu.Unlock()
+
+	for _, handler := range handlers {
+		if ratio, ok := t.SuccessRatio(handler); ok {
+			ch <- prometheus.MustNewConstMetric(successRatioDesc, prometheus.GaugeValue, ratio, handler)
+		}
+	}
+}
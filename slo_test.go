@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type SLOTrackerTestSuite struct {
+	suite.Suite
+}
+
+func (s *SLOTrackerTestSuite) TestSuccessRatio() {
+	tracker := NewSLOTracker(time.Minute, time.Second)
+
+	_, ok := tracker.SuccessRatio("alias")
+	s.False(ok)
+
+	tracker.Observe("alias", Response{Status: StatusOK}, time.Millisecond)
+	tracker.Observe("alias", Response{Status: StatusNoResult}, time.Millisecond)
+	tracker.Observe("alias", Response{Status: StatusOK}, time.Millisecond)
+	tracker.Observe("alias", Response{Status: StatusError}, time.Millisecond)
+	tracker.Observe("alias", Response{Status: StatusError, Response: ResponsePayloadError}, time.Millisecond)
+
+	ratio, ok := tracker.SuccessRatio("alias")
+	s.True(ok)
+	s.Equal(0.8, ratio)
+
+	s.Equal(1, testutil.CollectAndCount(tracker))
+}
+
+func (s *SLOTrackerTestSuite) TestSlowRequests() {
+	tracker := NewSLOTracker(time.Minute, 10*time.Millisecond)
+	before := testutil.ToFloat64(slowRequests.WithLabelValues("senders"))
+
+	tracker.Observe("senders", Response{Status: StatusOK}, time.Millisecond)
+	tracker.Observe("senders", Response{Status: StatusOK}, 20*time.Millisecond)
+
+	s.Equal(before+1, testutil.ToFloat64(slowRequests.WithLabelValues("senders")))
+}
+
+func (s *SLOTrackerTestSuite) TestWindowExpires() {
+	w := &rollingWindow{}
+	w.buckets[0] = sloBucket{index: 0, total: 2, failed: 2}
+	w.buckets[1] = sloBucket{index: 1, total: 2}
+
+	ratio, ok := w.ratio(1)
+	s.True(ok)
+	s.Equal(0.5, ratio)
+
+	ratio, ok = w.ratio(sloBuckets)
+	s.True(ok)
+	s.Equal(1.0, ratio)
+
+	_, ok = w.ratio(sloBuckets + 1)
+	s.False(ok)
+}
+
+func TestSLOTracker(t *testing.T) {
+	suite.Run(t, new(SLOTrackerTestSuite))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Punycode parameters from RFC 3492.
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+var errPunycodeOverflow = errors.New("punycode overflow")
+
+// normalizeKey validates an internationalized address or domain as
+// allowed by RFC 6531 and converts the domain to its ASCII form, so userli
+// receives the same domain whether Postfix passes the U-label or the
+// A-label. It returns false for invalid keys.
+func normalizeKey(key string) (string, bool) {
+	if !utf8.ValidString(key) {
+		return "", false
+	}
+
+	local, domain, isAddress := "", key, false
+	if i := strings.LastIndex(key, "@"); i >= 0 {
+		local, domain, isAddress = key[:i], key[i+1:], true
+	}
+
+	if isAddress && !validLocalPart(local) {
+		return "", false
+	}
+
+	domain, ok := domainToASCII(domain)
+	if !ok {
+		return "", false
+	}
+
+	if isAddress {
+		return local + "@" + domain, true
+	}
+
+	return domain, true
+}
+
+// validLocalPart reports whether local is a local part of at most 64
+// octets without spaces or control characters.
+func validLocalPart(local string) bool {
+	if local == "" || len(local) > 64 {
+		return false
+	}
+
+	for _, r := range local {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// domainToASCII lowercases domain and encodes each label with non-ASCII
+// characters as punycode with the "xn--" prefix.
+func domainToASCII(domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return "", false
+	}
+
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			encoded, err := punycodeEncode(label)
+			if err != nil {
+				return "", false
+			}
+			label = "xn--" + encoded
+		}
+
+		if label == "" || len(label) > 63 || strings.ContainsFunc(label, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r) || r == '@'
+		}) {
+			return "", false
+		}
+		labels[i] = label
+	}
+
+	domain = strings.Join(labels, ".")
+	if len(domain) > 253 {
+		return "", false
+	}
+
+	return domain, true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// punycodeEncode encodes s as described in RFC 3492.
+func punycodeEncode(s string) (string, error) {
+	runes := []rune(s)
+	output := make([]byte, 0, len(s)+8)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			output = append(output, byte(r))
+		}
+	}
+
+	basic := len(output)
+	handled := basic
+	if basic > 0 {
+		output = append(output, '-')
+	}
+
+	n, delta, bias := punycodeInitialN, 0, punycodeInitialBias
+	for handled < len(runes) {
+		next := int(unicode.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < next {
+				next = int(r)
+			}
+		}
+
+		if next-n > (math.MaxInt32-delta)/(handled+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += (next - n) * (handled + 1)
+		n = next
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := k - bias
+				if t < punycodeTMin {
+					t = punycodeTMin
+				} else if t > punycodeTMax {
+					t = punycodeTMax
+				}
+				if q < t {
+					break
+				}
+				output = append(output, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			output = append(output, punycodeDigit(q))
+
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+
+		delta++
+		n++
+	}
+
+	return string(output), nil
+}
+
+func punycodeAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+
+	return byte('0' + d - 26)
+}
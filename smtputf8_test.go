@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SMTPUTF8TestSuite struct {
+	suite.Suite
+}
+
+func (s *SMTPUTF8TestSuite) TestPunycodeEncode() {
+	for input, expected := range map[string]string{
+		"bücher":  "bcher-kva",
+		"münchen": "mnchen-3ya",
+		"例え":      "r8jz45g",
+		"ü":       "tda",
+	} {
+		encoded, err := punycodeEncode(input)
+		s.NoError(err)
+		s.Equal(expected, encoded, input)
+	}
+}
+
+func (s *SMTPUTF8TestSuite) TestNormalizeKey() {
+	for input, expected := range map[string]string{
+		"user@example.com":             "user@example.com",
+		"User@Example.COM":             "User@example.com",
+		"jürgen@bücher.example":        "jürgen@xn--bcher-kva.example",
+		"jürgen@xn--bcher-kva.example": "jürgen@xn--bcher-kva.example",
+		"Bücher.example.":              "xn--bcher-kva.example",
+	} {
+		normalized, ok := normalizeKey(input)
+		s.True(ok, input)
+		s.Equal(expected, normalized, input)
+	}
+
+	for _, input := range []string{
+		"",
+		"@example.com",
+		"user@",
+		"us er@example.com",
+		"user@exa\x00mple.com",
+		"user@example..com",
+		"\xffuser@example.com",
+	} {
+		_, ok := normalizeKey(input)
+		s.False(ok, input)
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	suite.Run(t, new(SMTPUTF8TestSuite))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	BackendUserli = "userli"
+	BackendStatic = "static"
+)
+
+// StaticUserli answers lookups from records loaded at startup instead of
+// asking userli, e.g. for test setups or as a stand-in during a userli
+// maintenance. Keys are matched case-insensitively.
+type StaticUserli struct {
+	domains   map[string]bool
+	mailboxes map[string]bool
+	aliases   map[string][]string
+	senders   map[string][]string
+}
+
+// NewStaticUserli returns a service answering from the records of
+// fixtures, which have the format of the mockserver fixtures.
+func NewStaticUserli(fixtures *MockUserliFixtures) *StaticUserli {
+	s := &StaticUserli{
+		domains:   make(map[string]bool, len(fixtures.Domains)),
+		mailboxes: make(map[string]bool, len(fixtures.Mailboxes)),
+		aliases:   make(map[string][]string, len(fixtures.Aliases)),
+		senders:   make(map[string][]string, len(fixtures.Senders)),
+	}
+
+	for _, domain := range fixtures.Domains {
+		s.domains[strings.ToLower(domain)] = true
+	}
+	for _, mailbox := range fixtures.Mailboxes {
+		s.mailboxes[strings.ToLower(mailbox)] = true
+	}
+	for alias, destinations := range fixtures.Aliases {
+		s.aliases[strings.ToLower(alias)] = destinations
+	}
+	for email, senders := range fixtures.Senders {
+		s.senders[strings.ToLower(email)] = senders
+	}
+
+	return s
+}
+
+// GetAliases implements UserliService.
+func (s *StaticUserli) GetAliases(_ context.Context, email string) ([]string, error) {
+	return listOrEmpty(s.aliases[strings.ToLower(email)]), nil
+}
+
+// GetDomain implements UserliService.
+func (s *StaticUserli) GetDomain(_ context.Context, domain string) (bool, error) {
+	return s.domains[strings.ToLower(domain)], nil
+}
+
+// GetMailbox implements UserliService.
+func (s *StaticUserli) GetMailbox(_ context.Context, email string) (bool, error) {
+	return s.mailboxes[strings.ToLower(email)], nil
+}
+
+// GetSenders implements UserliService.
+func (s *StaticUserli) GetSenders(_ context.Context, email string) ([]string, error) {
+	return listOrEmpty(s.senders[strings.ToLower(email)]), nil
+}
+
+// listOrEmpty returns an empty list for missing entries like userli.
+func listOrEmpty(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+
+	return list
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type StaticTestSuite struct {
+	suite.Suite
+}
+
+func (s *StaticTestSuite) TestLookups() {
+	ctx := context.Background()
+	static := NewStaticUserli(&MockUserliFixtures{
+		Domains:   []string{"Example.org"},
+		Mailboxes: []string{"user@example.org"},
+		Aliases:   map[string][]string{"Alias@example.org": {"user@example.org"}},
+		Senders:   map[string][]string{"user@example.org": {"user@example.org", "alias@example.org"}},
+	})
+
+	exists, err := static.GetDomain(ctx, "example.ORG")
+	s.NoError(err)
+	s.True(exists)
+
+	exists, err = static.GetMailbox(ctx, "User@example.org")
+	s.NoError(err)
+	s.True(exists)
+
+	exists, err = static.GetMailbox(ctx, "unknown@example.org")
+	s.NoError(err)
+	s.False(exists)
+
+	aliases, err := static.GetAliases(ctx, "alias@example.org")
+	s.NoError(err)
+	s.Equal([]string{"user@example.org"}, aliases)
+
+	senders, err := static.GetSenders(ctx, "user@example.org")
+	s.NoError(err)
+	s.Equal([]string{"user@example.org", "alias@example.org"}, senders)
+
+	senders, err = static.GetSenders(ctx, "unknown@example.org")
+	s.NoError(err)
+	s.Equal([]string{}, senders)
+}
+
+func TestStatic(t *testing.T) {
+	suite.Run(t, new(StaticTestSuite))
+}
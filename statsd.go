@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StatsdFormatStatsd    = "statsd"
+	StatsdFormatDogStatsd = "dogstatsd"
+
+	statsdPrefix = "userli_postfix_adapter"
+)
+
+// statsd mirrors metrics to a statsd server. It is nil if disabled.
+var statsd *StatsdClient
+
+// StatsdClient sends metrics to a statsd or dogstatsd server via UDP.
+// All methods are safe to call on a nil client.
+type StatsdClient struct {
+	conn   net.Conn
+	format string
+}
+
+// NewStatsdClient creates a new client sending to addr. Format is either
+// StatsdFormatStatsd, which encodes tags into the metric name, or
+// StatsdFormatDogStatsd, which sends them as dogstatsd tags.
+func NewStatsdClient(addr, format string) (*StatsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsdClient{conn: conn, format: format}, nil
+}
+
+// Timing sends a duration in milliseconds.
+func (c *StatsdClient) Timing(name string, d time.Duration, tags map[string]string) {
+	if c == nil {
+		return
+	}
+
+	c.send(name, fmt.Sprintf("%g|ms", float64(d.Microseconds())/1000), tags)
+}
+
+// Count sends a counter increment.
+func (c *StatsdClient) Count(name string, n int, tags map[string]string) {
+	if c == nil {
+		return
+	}
+
+	c.send(name, fmt.Sprintf("%d|c", n), tags)
+}
+
+// Gauge sends a gauge value.
+func (c *StatsdClient) Gauge(name string, value float64, tags map[string]string) {
+	if c == nil {
+		return
+	}
+
+	c.send(name, fmt.Sprintf("%g|g", value), tags)
+}
+
+func (c *StatsdClient) send(name, value string, tags map[string]string) {
+	if c == nil {
+		return
+	}
+
+	if _, err := c.conn.Write([]byte(c.encode(name, value, tags))); err != nil {
+		log.WithError(err).Debug("Error sending statsd metric")
+	}
+}
+
+// encode encodes a single metric line.
+func (c *StatsdClient) encode(name, value string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if c.format == StatsdFormatDogStatsd {
+		line := fmt.Sprintf("%s.%s:%s", statsdPrefix, name, value)
+		if len(keys) == 0 {
+			return line
+		}
+
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, key+":"+tags[key])
+		}
+
+		return line + "|#" + strings.Join(pairs, ",")
+	}
+
+	parts := []string{statsdPrefix, name}
+	for _, key := range keys {
+		parts = append(parts, strings.ReplaceAll(tags[key], ".", "_"))
+	}
+
+	return fmt.Sprintf("%s:%s", strings.Join(parts, "."), value)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type StatsdTestSuite struct {
+	suite.Suite
+}
+
+func (s *StatsdTestSuite) TestEncode() {
+	tags := map[string]string{"status": "success", "handler": "alias"}
+
+	s.Run("statsd", func() {
+		client := &StatsdClient{format: StatsdFormatStatsd}
+		s.Equal("userli_postfix_adapter.request_duration.alias.success:1.5|ms", client.encode("request_duration", "1.5|ms", tags))
+	})
+
+	s.Run("dogstatsd", func() {
+		client := &StatsdClient{format: StatsdFormatDogStatsd}
+		s.Equal("userli_postfix_adapter.request_duration:1.5|ms|#handler:alias,status:success", client.encode("request_duration", "1.5|ms", tags))
+	})
+}
+
+func (s *StatsdTestSuite) TestSend() {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer server.Close()
+
+	client, err := NewStatsdClient(server.LocalAddr().String(), StatsdFormatDogStatsd)
+	s.Require().NoError(err)
+
+	client.Count("connections_force_closed", 2, map[string]string{"server": "alias"})
+
+	buf := make([]byte, 512)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buf)
+	s.NoError(err)
+	s.Equal("userli_postfix_adapter.connections_force_closed:2|c|#server:alias", string(buf[:n]))
+}
+
+func (s *StatsdTestSuite) TestNilClient() {
+	var client *StatsdClient
+	client.Gauge("test", 1, nil)
+}
+
+func TestStatsd(t *testing.T) {
+	suite.Run(t, new(StatsdTestSuite))
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// syslogIdentifier is the name of the application in syslog messages.
+	syslogIdentifier = "userli-postfix-adapter"
+
+	syslogQueueSize = 1000
+
+	syslogDialTimeout  = 5 * time.Second
+	syslogWriteTimeout = 5 * time.Second
+
+	// syslogSDID is the id of the structured data element holding the log
+	// fields. 32473 is the enterprise number reserved for documentation.
+	syslogSDID = "fields@32473"
+)
+
+// syslogFacilities are the facilities that can be configured.
+var syslogFacilities = map[string]int{
+	"mail":   2,
+	"daemon": 3,
+	"local0": 16,
+	"local1": 17,
+	"local2": 18,
+	"local3": 19,
+	"local4": 20,
+	"local5": 21,
+	"local6": 22,
+	"local7": 23,
+}
+
+// SyslogHook is a logrus hook sending entries as RFC 5424 messages with
+// the fields as structured data to a syslog server via UDP, TCP or TLS.
+// Messages are sent asynchronously and dropped if the server can not keep
+// up.
+type SyslogHook struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+
+	messages chan []byte
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogHook creates a hook for the address, e.g. "udp://localhost:514",
+// "tcp://syslog.example.org:601" or "tls://syslog.example.org:6514".
+func NewSyslogHook(address, facility string) (*SyslogHook, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("syslog address has no host")
+	}
+
+	h := &SyslogHook{network: u.Scheme, addr: u.Host, messages: make(chan []byte, syslogQueueSize)}
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		h.network = "tcp"
+		h.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("unsupported syslog protocol %q", u.Scheme)
+	}
+
+	var ok bool
+	if h.facility, ok = syslogFacilities[facility]; !ok {
+		return nil, fmt.Errorf("unsupported syslog facility %q", facility)
+	}
+
+	h.hostname, err = os.Hostname()
+	if err != nil || h.hostname == "" {
+		h.hostname = "-"
+	}
+
+	return h, nil
+}
+
+// Levels implements log.Hook.
+func (h *SyslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements log.Hook.
+func (h *SyslogHook) Fire(entry *log.Entry) error {
+	message := h.format(entry)
+
+	if entry.Level <= log.FatalLevel {
+		// the process exits right afterwards
+		_ = h.send(message)
+		return nil
+	}
+
+	select {
+	case h.messages <- message:
+	default:
+		// drop the message if the server can not keep up
+	}
+
+	return nil
+}
+
+// Run sends queued messages until the context is canceled.
+func (h *SyslogHook) Run(ctx context.Context) {
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if h.conn != nil {
+			h.conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-h.messages:
+			if err := h.send(message); err != nil {
+				// logging would queue another message for the failing server
+				fmt.Fprintf(os.Stderr, "Error sending log message to syslog: %s\n", err)
+			}
+		}
+	}
+}
+
+// send writes a message, connecting first if necessary. Messages sent via
+// TCP are framed by octet counting as in RFC 6587.
+func (h *SyslogHook) send(message []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn == nil {
+		dialer := &net.Dialer{Timeout: syslogDialTimeout}
+
+		var err error
+		if h.tlsConfig != nil {
+			h.conn, err = tls.DialWithDialer(dialer, h.network, h.addr, h.tlsConfig)
+		} else {
+			h.conn, err = dialer.Dial(h.network, h.addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.network == "tcp" {
+		message = append([]byte(strconv.Itoa(len(message))+" "), message...)
+	}
+
+	_ = h.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := h.conn.Write(message); err != nil {
+		h.conn.Close()
+		h.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// format encodes entry as RFC 5424 message.
+func (h *SyslogHook) format(entry *log.Entry) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ",
+		h.facility*8+syslogSeverity(entry.Level),
+		entry.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		h.hostname,
+		syslogIdentifier,
+		os.Getpid(),
+	)
+
+	if len(entry.Data) == 0 {
+		b.WriteString("-")
+	} else {
+		keys := make([]string, 0, len(entry.Data))
+		for key := range entry.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		b.WriteString("[" + syslogSDID)
+		for _, key := range keys {
+			value := entry.Data[key]
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			fmt.Fprintf(&b, ` %s="%s"`, syslogParamName(key), syslogParamEscaper.Replace(fmt.Sprint(value)))
+		}
+		b.WriteString("]")
+	}
+
+	b.WriteString(" ")
+	b.WriteString(entry.Message)
+
+	return []byte(b.String())
+}
+
+// syslogParamName replaces the characters not allowed in parameter names
+// and truncates them to 32 characters.
+func syslogParamName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	return name[:min(len(name), 32)]
+}
+
+// syslogParamEscaper escapes '"', '\' and ']' in parameter values.
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogSeverity returns the syslog severity of level.
+func syslogSeverity(level log.Level) int {
+	switch level {
+	case log.PanicLevel:
+		return 0
+	case log.FatalLevel:
+		return 2
+	case log.ErrorLevel:
+		return 3
+	case log.WarnLevel:
+		return 4
+	case log.InfoLevel:
+		return 6
+	}
+
+	return 7
+}
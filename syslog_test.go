@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type SyslogTestSuite struct {
+	suite.Suite
+}
+
+func (s *SyslogTestSuite) TestNewSyslogHook() {
+	hook, err := NewSyslogHook("tls://syslog.example.org:6514", "local3")
+	s.NoError(err)
+	s.Equal("tcp", hook.network)
+	s.Equal("syslog.example.org", hook.tlsConfig.ServerName)
+	s.Equal(19, hook.facility)
+
+	_, err = NewSyslogHook("http://syslog.example.org", "mail")
+	s.Error(err)
+
+	_, err = NewSyslogHook("udp://", "mail")
+	s.Error(err)
+
+	_, err = NewSyslogHook("udp://localhost:514", "user")
+	s.Error(err)
+}
+
+func (s *SyslogTestSuite) TestFormat() {
+	hook, err := NewSyslogHook("udp://localhost:514", "mail")
+	s.Require().NoError(err)
+	hook.hostname = "mx1"
+
+	entry := log.NewEntry(log.New()).WithFields(log.Fields{"handler": "alias", "error": errors.New(`bad "key"]`), "remote addr": "127.0.0.1"})
+	entry.Time = time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	entry.Level = log.ErrorLevel
+	entry.Message = "Error fetching aliases"
+
+	s.Equal(
+		`<19>1 2024-01-02T03:04:05.000006Z mx1 userli-postfix-adapter `+strconv.Itoa(os.Getpid())+` - [fields@32473 error="bad \"key\"\]" handler="alias" remote_addr="127.0.0.1"] Error fetching aliases`,
+		string(hook.format(entry)),
+	)
+
+	entry = log.NewEntry(log.New())
+	entry.Level = log.InfoLevel
+	entry.Message = "Started"
+	s.Contains(string(hook.format(entry)), " - - Started")
+}
+
+func (s *SyslogTestSuite) TestRunTCP() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer listener.Close()
+
+	hook, err := NewSyslogHook("tcp://"+listener.Addr().String(), "mail")
+	s.Require().NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hook.Run(ctx)
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(hook)
+	logger.WithField("handler", "alias").Warn("first")
+	logger.Info("second")
+
+	conn, err := listener.Accept()
+	s.Require().NoError(err)
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{`[fields@32473 handler="alias"] first`, "- second"} {
+		length, err := reader.ReadString(' ')
+		s.Require().NoError(err)
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		s.Require().NoError(err)
+
+		message := make([]byte, n)
+		_, err = io.ReadFull(reader, message)
+		s.Require().NoError(err)
+		s.True(strings.HasSuffix(string(message), expected), string(message))
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	suite.Run(t, new(SyslogTestSuite))
+}
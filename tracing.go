@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// tracer is the global tracer. It is nil if tracing is disabled.
+var tracer *Tracer
+
+// Tracer records spans and exports them to an OTLP/HTTP endpoint using
+// the JSON encoding.
+type Tracer struct {
+	endpoint    string
+	sampleRatio float64
+	client      *http.Client
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// Span is a single traced operation. All methods are safe to call on a
+// nil Span.
+type Span struct {
+	tracer *Tracer
+
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+type spanKey struct{}
+
+// NewTracer creates a tracer exporting to the OTLP/HTTP endpoint, e.g.
+// "http://collector:4318". sampleRatio is the share of traces recorded.
+func NewTracer(endpoint string, sampleRatio float64) *Tracer {
+	return &Tracer{
+		endpoint:    endpoint,
+		sampleRatio: sampleRatio,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// StartSpan starts a span as child of the span in ctx. It returns ctx
+// unchanged and a nil span if tracing is disabled.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: tracer, name: name, kind: kind, start: time.Now(), attributes: make(map[string]string)}
+	_, _ = rand.Read(span.spanID[:])
+
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.sampled = parent.sampled
+	} else {
+		_, _ = rand.Read(span.traceID[:])
+		span.sampled = tracer.sample()
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the current span or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SetAttribute adds an attribute to the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.err = err
+}
+
+// End finishes the span and queues it for export if it is sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.sampled {
+		s.tracer.add(s)
+	}
+}
+
+// TraceParent returns the W3C traceparent header value for the span.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// Run exports queued spans periodically until the context is canceled.
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.flush(context.Background())
+			return
+		case <-ticker.C:
+			t.flush(ctx)
+		}
+	}
+}
+
+func (t *Tracer) sample() bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < t.sampleRatio
+}
+
+func (t *Tracer) add(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// drop spans if the exporter can not keep up
+	if len(t.spans) >= traceBatchSize*4 {
+		return
+	}
+	t.spans = append(t.spans, span)
+}
+
+func (t *Tracer) flush(ctx context.Context) {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+
+	for len(spans) > 0 {
+		n := min(len(spans), traceBatchSize)
+		if err := t.export(ctx, spans[:n]); err != nil {
+			log.WithError(err).Warn("Error exporting traces")
+		}
+		spans = spans[n:]
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func newOTLPAttribute(key, value string) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	attribute.Value.StringValue = value
+	return attribute
+}
+
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		if span.parentID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		for key, value := range span.attributes {
+			s.Attributes = append(s.Attributes, newOTLPAttribute(key, value))
+		}
+		s.Status.Code = spanStatusOK
+		if span.err != nil {
+			s.Status.Code = spanStatusError
+			s.Status.Message = span.err.Error()
+		}
+		encoded = append(encoded, s)
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						newOTLPAttribute("service.name", "userli-postfix-adapter"),
+						newOTLPAttribute("service.version", version),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "userli-postfix-adapter"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint+"/v1/traces", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TracingTestSuite struct {
+	suite.Suite
+}
+
+func (s *TracingTestSuite) TearDownTest() {
+	tracer = nil
+}
+
+func (s *TracingTestSuite) TestDisabled() {
+	ctx, span := StartSpan(context.Background(), "test", spanKindServer)
+	s.Nil(span)
+	s.Nil(SpanFromContext(ctx))
+
+	// methods on a nil span are no-ops
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.End()
+	s.Empty(span.TraceParent())
+}
+
+func (s *TracingTestSuite) TestExport() {
+	var received struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("/v1/traces", r.URL.Path)
+		s.NoError(json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer collector.Close()
+
+	tracer = NewTracer(collector.URL, 1)
+	tracer.client = collector.Client()
+
+	ctx, parent := StartSpan(context.Background(), "lookup alias", spanKindServer)
+	_, child := StartSpan(ctx, "userli GET", spanKindClient)
+	child.SetError(errors.New("timeout"))
+
+	s.Regexp(regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`), child.TraceParent())
+
+	child.End()
+	parent.End()
+	tracer.flush(context.Background())
+
+	s.Require().Len(received.ResourceSpans, 1)
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	s.Require().Len(spans, 2)
+	s.Equal("userli GET", spans[0].Name)
+	s.Equal(spanStatusError, spans[0].Status.Code)
+	s.Equal(spans[1].TraceID, spans[0].TraceID)
+	s.Equal(spans[1].SpanID, spans[0].ParentSpanID)
+	s.Empty(spans[1].ParentSpanID)
+}
+
+func (s *TracingTestSuite) TestSampling() {
+	tracer = NewTracer("http://localhost", 0)
+
+	_, span := StartSpan(context.Background(), "test", spanKindServer)
+	span.End()
+
+	s.Empty(tracer.spans)
+	s.Regexp(regexp.MustCompile(`-00$`), span.TraceParent())
+}
+
+func TestTracing(t *testing.T) {
+	suite.Run(t, new(TracingTestSuite))
+}
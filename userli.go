@@ -1,23 +1,67 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// ErrTooManyValues is returned if userli responds with more aliases or
+// senders than the configured maximum.
+var ErrTooManyValues = errors.New("too many values in userli response")
+
+// UserliStatusError is returned if userli responds with a status other
+// than 200.
+type UserliStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *UserliStatusError) Error() string {
+	return "unexpected response from userli: " + e.Status
+}
+
 type UserliService interface {
-	GetAliases(email string) ([]string, error)
-	GetDomain(domain string) (bool, error)
-	GetMailbox(email string) (bool, error)
-	GetSenders(email string) ([]string, error)
+	GetAliases(ctx context.Context, email string) ([]string, error)
+	GetDomain(ctx context.Context, domain string) (bool, error)
+	GetMailbox(ctx context.Context, email string) (bool, error)
+	GetSenders(ctx context.Context, email string) ([]string, error)
 }
 
 type Userli struct {
-	token   string
-	baseURL string
+	mu             sync.RWMutex
+	token          string
+	secondaryToken string
+	baseURL        string
+
+	// preferSecondary is set once userli accepted the secondary token
+	// after rejecting the primary one, until the next rotation.
+	preferSecondary bool
+
+	// SMTPUTF8 enables internationalized addresses. Keys are validated,
+	// their domain is converted to punycode and they are escaped in the URL.
+	SMTPUTF8 bool
+
+	// MaxValues is the maximum number of aliases or senders accepted in a
+	// response. Zero means unlimited.
+	MaxValues int
+
+	// Backend is the name of the instance in the backend label of the
+	// userli metrics.
+	Backend string
 
 	Client *http.Client
 }
@@ -27,97 +71,358 @@ func NewUserli(token, baseURL string) *Userli {
 		Timeout: time.Second * 10,
 	}
 
-	return &Userli{token: token, baseURL: baseURL, Client: client}
+	return &Userli{token: token, baseURL: baseURL, Backend: "default", Client: client}
+}
+
+// SetToken replaces the token used to authenticate against userli.
+func (u *Userli) SetToken(token string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.token = token
+	u.preferSecondary = false
 }
 
-func (u *Userli) GetAliases(email string) ([]string, error) {
+// SetSecondaryToken sets the token that is tried when userli rejects the
+// primary one, so the token can be rotated without a synchronized restart.
+func (u *Userli) SetSecondaryToken(token string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.secondaryToken = token
+	u.preferSecondary = false
+}
+
+func (u *Userli) GetAliases(ctx context.Context, email string) ([]string, error) {
 	if !strings.Contains(email, "@") {
 		return []string{}, nil
 	}
 
-	resp, err := u.call(fmt.Sprintf("%s/api/postfix/alias/%s", u.baseURL, email))
+	endpoint, ok := u.endpointURL("alias", email)
+	if !ok {
+		return []string{}, nil
+	}
+
+	resp, err := u.call(ctx, endpoint)
 	if err != nil {
 		return []string{}, err
 	}
+	defer resp.Body.Close()
 
-	var aliases []string
-	err = json.NewDecoder(resp.Body).Decode(&aliases)
+	aliases, err := decodeList(resp.Body, u.MaxValues)
 	if err != nil {
+		u.countError("decode")
 		return []string{}, err
 	}
 
 	return aliases, nil
 }
 
-func (u *Userli) GetDomain(domain string) (bool, error) {
-	resp, err := u.call(fmt.Sprintf("%s/api/postfix/domain/%s", u.baseURL, domain))
+func (u *Userli) GetDomain(ctx context.Context, domain string) (bool, error) {
+	endpoint, ok := u.endpointURL("domain", domain)
+	if !ok {
+		return false, nil
+	}
+
+	resp, err := u.call(ctx, endpoint)
 	if err != nil {
 		return false, err
 	}
+	defer resp.Body.Close()
 
 	var result bool
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
+		u.countError("decode")
 		return false, err
 	}
 
 	return result, nil
 }
 
-func (u *Userli) GetMailbox(email string) (bool, error) {
+func (u *Userli) GetMailbox(ctx context.Context, email string) (bool, error) {
 	if !strings.Contains(email, "@") {
 		return false, nil
 	}
 
-	resp, err := u.call(fmt.Sprintf("%s/api/postfix/mailbox/%s", u.baseURL, email))
+	endpoint, ok := u.endpointURL("mailbox", email)
+	if !ok {
+		return false, nil
+	}
+
+	resp, err := u.call(ctx, endpoint)
 	if err != nil {
 		return false, err
 	}
+	defer resp.Body.Close()
 
 	var result bool
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
+		u.countError("decode")
 		return false, err
 	}
 
 	return result, nil
 }
 
-func (u *Userli) GetSenders(email string) ([]string, error) {
+func (u *Userli) GetSenders(ctx context.Context, email string) ([]string, error) {
 	if !strings.Contains(email, "@") {
 		return []string{}, nil
 	}
 
-	resp, err := u.call(fmt.Sprintf("%s/api/postfix/senders/%s", u.baseURL, email))
+	endpoint, ok := u.endpointURL("senders", email)
+	if !ok {
+		return []string{}, nil
+	}
+
+	resp, err := u.call(ctx, endpoint)
 	if err != nil {
 		return []string{}, err
 	}
+	defer resp.Body.Close()
 
-	var senders []string
-	err = json.NewDecoder(resp.Body).Decode(&senders)
+	senders, err := decodeList(resp.Body, u.MaxValues)
 	if err != nil {
+		u.countError("decode")
 		return []string{}, err
 	}
 
 	return senders, nil
 }
 
-func (u *Userli) call(url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// Check verifies that userli is reachable and accepts the token by looking
+// up key in mapName, one of alias, domain, mailbox or senders.
+func (u *Userli) Check(ctx context.Context, mapName, key string) error {
+	endpoint, ok := u.endpointURL(mapName, key)
+	if !ok {
+		return fmt.Errorf("invalid health check key %q", key)
+	}
+
+	resp, err := u.call(ctx, endpoint)
+	var statusErr *UserliStatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden) {
+		return fmt.Errorf("userli rejected the token: %s", statusErr.Status)
+	}
 	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch mapName {
+	case "alias", "senders":
+		_, err = decodeList(resp.Body, u.MaxValues)
+	default:
+		var result bool
+		err = json.NewDecoder(resp.Body).Decode(&result)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid response from userli: %w", err)
+	}
+
+	return nil
+}
+
+// decodeList decodes a JSON array of strings element by element, so a
+// response with more than limit elements is rejected without reading it
+// completely. Zero means unlimited. null is decoded as an empty list.
+func decodeList(r io.Reader, limit int) ([]string, error) {
+	decoder := json.NewDecoder(r)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("expected a JSON array, got %v", token)
+	}
+
+	values := []string{}
+	for decoder.More() {
+		if limit > 0 && len(values) >= limit {
+			return nil, fmt.Errorf("%w: more than %d", ErrTooManyValues, limit)
+		}
+
+		var value string
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	if _, err := decoder.Token(); err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", u.token))
+	return values, nil
+}
 
+// endpointURL returns the URL of the endpoint for key. In SMTPUTF8 mode
+// it returns false for invalid keys.
+func (u *Userli) endpointURL(endpoint, key string) (string, bool) {
+	if u.SMTPUTF8 {
+		var ok bool
+		if key, ok = normalizeKey(key); !ok {
+			return "", false
+		}
+		key = url.PathEscape(key)
+	}
+
+	return fmt.Sprintf("%s/api/postfix/%s/%s", u.baseURL, endpoint, key), true
+}
+
+// call sends a request to userli. Responses other than 200 are returned
+// as UserliStatusError.
+func (u *Userli) call(ctx context.Context, url string) (*http.Response, error) {
+	resp, err := u.authenticatedCall(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+
+		errorType := "http_4xx"
+		if resp.StatusCode >= http.StatusInternalServerError {
+			errorType = "http_5xx"
+		}
+		u.countError(errorType)
+
+		return nil, &UserliStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return resp, nil
+}
+
+// authenticatedCall sends a request with the preferred token and retries
+// with the other one if userli rejects it. Once userli accepts the
+// secondary token, it is preferred until the tokens are rotated.
+func (u *Userli) authenticatedCall(ctx context.Context, url string) (*http.Response, error) {
+	ctx, span := StartSpan(ctx, "userli GET", spanKindClient)
+	defer span.End()
+
+	u.mu.RLock()
+	primary, secondary, preferSecondary := u.token, u.secondaryToken, u.preferSecondary
+	u.mu.RUnlock()
+
+	token, fallback := primary, secondary
+	if preferSecondary {
+		token, fallback = secondary, primary
+	}
+
+	resp, err := u.do(ctx, span, url, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || secondary == "" {
+		return resp, err
+	}
+
+	resp.Body.Close()
+	addCounter(userliTokenFallbacks, "userli_token_fallbacks", 1, nil)
+
+	resp, err = u.do(ctx, span, url, fallback)
+	if err == nil && resp.StatusCode != http.StatusUnauthorized {
+		u.switchToken(ctx, primary, secondary, !preferSecondary)
+	}
+
+	return resp, err
+}
+
+// switchToken prefers the secondary token or the primary one again and
+// logs the switch once. It does nothing if the tokens were rotated in
+// the meantime.
+func (u *Userli) switchToken(ctx context.Context, primary, secondary string, preferSecondary bool) {
+	u.mu.Lock()
+	if u.token != primary || u.secondaryToken != secondary || u.preferSecondary == preferSecondary {
+		u.mu.Unlock()
+		return
+	}
+	u.preferSecondary = preferSecondary
+	u.mu.Unlock()
+
+	logger := log.WithFields(log.Fields{"backend": u.Backend, "request_id": RequestIDFromContext(ctx)})
+	if preferSecondary {
+		logger.Warn("Userli rejected the primary token, using the secondary token until the next rotation")
+	} else {
+		logger.Warn("Userli rejected the secondary token, using the primary token again")
+	}
+}
+
+// do sends a single request to userli authenticated with token.
+func (u *Userli) do(ctx context.Context, span *Span, url, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "userli-postfix-adapter")
 
+	if id := RequestIDFromContext(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	if traceParent := span.TraceParent(); traceParent != "" {
+		req.Header.Set("traceparent", traceParent)
+	}
+
 	resp, err := u.Client.Do(req)
 	if err != nil {
+		span.SetError(err)
+		// the lookup was canceled because the client is gone, which says
+		// nothing about userli
+		if !errors.Is(err, context.Canceled) {
+			u.setUp(0)
+			u.countError(userliErrorType(err))
+		}
 		return nil, err
 	}
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		u.setUp(0)
+	} else {
+		u.setUp(1)
+	}
+
+	span.SetAttribute("http.response.status_code", strconv.Itoa(resp.StatusCode))
+
 	return resp, nil
 }
+
+// userliErrorType classifies an error of a request to userli for the
+// error_type label.
+func userliErrorType(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return "tls"
+	}
+
+	return "other"
+}
+
+// countError counts a failed request to userli by errorType.
+func (u *Userli) countError(errorType string) {
+	addCounter(userliErrors.WithLabelValues(u.Backend, errorType), "userli_errors", 1, map[string]string{"backend": u.Backend, "error_type": errorType})
+}
+
+// setUp records whether userli answered without a server error.
+func (u *Userli) setUp(value float64) {
+	userliUp.WithLabelValues(u.Backend).Set(value)
+	statsd.Gauge("userli_up", value, map[string]string{"backend": u.Backend})
+}
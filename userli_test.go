@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/h2non/gock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -31,14 +38,14 @@ func (s *UserliTestSuite) TestGetAliases() {
 			Reply(200).
 			JSON([]string{"source1@example.com", "source2@example.com"})
 
-		aliases, err := s.userli.GetAliases("alias@example.com")
+		aliases, err := s.userli.GetAliases(context.Background(), "alias@example.com")
 		s.NoError(err)
 		s.True(gock.IsDone())
 		s.Equal([]string{"source1@example.com", "source2@example.com"}, aliases)
 	})
 
 	s.Run("no email", func() {
-		aliases, err := s.userli.GetAliases("alias")
+		aliases, err := s.userli.GetAliases(context.Background(), "alias")
 		s.NoError(err)
 		s.Empty(aliases)
 	})
@@ -53,13 +60,131 @@ func (s *UserliTestSuite) TestGetAliases() {
 			Reply(500).
 			JSON(map[string]string{"error": "internal server error"})
 
-		aliases, err := s.userli.GetAliases("alias@example.com")
+		aliases, err := s.userli.GetAliases(context.Background(), "alias@example.com")
 		s.Error(err)
 		s.True(gock.IsDone())
 		s.Empty(aliases)
 	})
 }
 
+func (s *UserliTestSuite) TestMaxValues() {
+	gock.New("http://localhost:8000").
+		Get("/api/postfix/alias/alias@example.com").
+		Reply(200).
+		JSON([]string{"a@example.com", "b@example.com", "c@example.com"})
+
+	s.userli.MaxValues = 2
+	aliases, err := s.userli.GetAliases(context.Background(), "alias@example.com")
+	s.ErrorIs(err, ErrTooManyValues)
+	s.Empty(aliases)
+	s.True(gock.IsDone())
+}
+
+func (s *UserliTestSuite) TestCanceled() {
+	gock.New("http://localhost:8000").
+		Get("/api/postfix/domain/example.com").
+		Reply(200).
+		JSON("true")
+	defer gock.Off()
+
+	userliUp.WithLabelValues("default").Set(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.userli.GetDomain(ctx, "example.com")
+	s.ErrorIs(err, context.Canceled)
+	s.Equal(float64(1), testutil.ToFloat64(userliUp.WithLabelValues("default")))
+}
+
+func (s *UserliTestSuite) TestBackendLabel() {
+	gock.New("http://shadow:8000").
+		Get("/api/postfix/domain/example.com").
+		Reply(503)
+
+	s.userli.setUp(1)
+	shadow := NewUserli("insecure", "http://shadow:8000")
+	shadow.Backend = "shadow"
+	before := testutil.ToFloat64(userliErrors.WithLabelValues("default", "http_5xx"))
+
+	_, err := shadow.GetDomain(context.Background(), "example.com")
+	s.Error(err)
+	s.Equal(float64(0), testutil.ToFloat64(userliUp.WithLabelValues("shadow")))
+	s.Equal(float64(1), testutil.ToFloat64(userliUp.WithLabelValues("default")))
+	s.Equal(before, testutil.ToFloat64(userliErrors.WithLabelValues("default", "http_5xx")))
+}
+
+func (s *UserliTestSuite) TestErrorTypes() {
+	s.Run("server error", func() {
+		before := testutil.ToFloat64(userliErrors.WithLabelValues("default", "http_5xx"))
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/example.com").
+			Reply(503)
+
+		_, err := s.userli.GetDomain(context.Background(), "example.com")
+		var statusErr *UserliStatusError
+		s.Require().ErrorAs(err, &statusErr)
+		s.Equal(503, statusErr.StatusCode)
+		s.Equal(before+1, testutil.ToFloat64(userliErrors.WithLabelValues("default", "http_5xx")))
+	})
+
+	s.Run("decode", func() {
+		before := testutil.ToFloat64(userliErrors.WithLabelValues("default", "decode"))
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/mailbox/user@example.com").
+			Reply(200).
+			BodyString("<html>")
+
+		_, err := s.userli.GetMailbox(context.Background(), "user@example.com")
+		s.Error(err)
+		s.Equal(before+1, testutil.ToFloat64(userliErrors.WithLabelValues("default", "decode")))
+	})
+
+	s.Run("refused", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		s.Require().NoError(err)
+		addr := listener.Addr().String()
+		listener.Close()
+
+		gock.Off()
+		defer gock.DisableNetworking()
+
+		before := testutil.ToFloat64(userliErrors.WithLabelValues("default", "refused"))
+		_, err = NewUserli("insecure", "http://"+addr).GetDomain(context.Background(), "example.com")
+		s.Error(err)
+		s.Equal(before+1, testutil.ToFloat64(userliErrors.WithLabelValues("default", "refused")))
+	})
+}
+
+func (s *UserliTestSuite) TestUserliErrorType() {
+	s.Equal("timeout", userliErrorType(context.DeadlineExceeded))
+	s.Equal("refused", userliErrorType(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}))
+	s.Equal("dns", userliErrorType(&net.DNSError{Err: "no such host", Name: "userli.invalid"}))
+	s.Equal("tls", userliErrorType(&tls.CertificateVerificationError{Err: errors.New("unknown authority")}))
+	s.Equal("other", userliErrorType(errors.New("unexpected EOF")))
+}
+
+func (s *UserliTestSuite) TestDecodeList() {
+	values, err := decodeList(strings.NewReader(`["a@example.com", "b@example.com"]`), 2)
+	s.NoError(err)
+	s.Equal([]string{"a@example.com", "b@example.com"}, values)
+
+	values, err = decodeList(strings.NewReader(`[]`), 0)
+	s.NoError(err)
+	s.Empty(values)
+
+	values, err = decodeList(strings.NewReader(`null`), 0)
+	s.NoError(err)
+	s.Empty(values)
+
+	_, err = decodeList(strings.NewReader(`["a@example.com", "b@example.com", "c@example.com"`), 2)
+	s.ErrorIs(err, ErrTooManyValues)
+
+	for _, body := range []string{`{"error":"internal server error"}`, `["a@example.com", 1]`, `["a@example.com"`, ``} {
+		_, err = decodeList(strings.NewReader(body), 0)
+		s.Error(err, body)
+	}
+}
+
 func (s *UserliTestSuite) TestGetDomain() {
 	s.Run("success", func() {
 		gock.New("http://localhost:8000").
@@ -71,7 +196,7 @@ func (s *UserliTestSuite) TestGetDomain() {
 			Reply(200).
 			JSON("true")
 
-		active, err := s.userli.GetDomain("example.com")
+		active, err := s.userli.GetDomain(context.Background(), "example.com")
 		s.NoError(err)
 		s.True(active)
 	})
@@ -86,7 +211,7 @@ func (s *UserliTestSuite) TestGetDomain() {
 			Reply(200).
 			JSON("false")
 
-		active, err := s.userli.GetDomain("example.com")
+		active, err := s.userli.GetDomain(context.Background(), "example.com")
 		s.NoError(err)
 		s.True(gock.IsDone())
 		s.False(active)
@@ -102,7 +227,7 @@ func (s *UserliTestSuite) TestGetDomain() {
 			Reply(500).
 			JSON(map[string]string{"error": "internal server error"})
 
-		active, err := s.userli.GetDomain("example.com")
+		active, err := s.userli.GetDomain(context.Background(), "example.com")
 		s.Error(err)
 		s.True(gock.IsDone())
 		s.False(active)
@@ -120,14 +245,14 @@ func (s *UserliTestSuite) TestGetMailbox() {
 			Reply(200).
 			JSON("true")
 
-		active, err := s.userli.GetMailbox("user@example.org")
+		active, err := s.userli.GetMailbox(context.Background(), "user@example.org")
 		s.NoError(err)
 		s.True(active)
 		s.True(gock.IsDone())
 	})
 
 	s.Run("no email", func() {
-		active, err := s.userli.GetMailbox("user")
+		active, err := s.userli.GetMailbox(context.Background(), "user")
 		s.NoError(err)
 		s.False(active)
 	})
@@ -142,7 +267,7 @@ func (s *UserliTestSuite) TestGetMailbox() {
 			Reply(200).
 			JSON("false")
 
-		active, err := s.userli.GetMailbox("user@example.org")
+		active, err := s.userli.GetMailbox(context.Background(), "user@example.org")
 		s.NoError(err)
 		s.False(active)
 		s.True(gock.IsDone())
@@ -158,7 +283,7 @@ func (s *UserliTestSuite) TestGetMailbox() {
 			Reply(500).
 			JSON(map[string]string{"error": "internal server error"})
 
-		active, err := s.userli.GetMailbox("user@example.org")
+		active, err := s.userli.GetMailbox(context.Background(), "user@example.org")
 		s.Error(err)
 		s.False(active)
 		s.True(gock.IsDone())
@@ -176,14 +301,14 @@ func (s *UserliTestSuite) TestGetSenders() {
 			Reply(200).
 			JSON([]string{"user@example.com"})
 
-		senders, err := s.userli.GetSenders("user@example.com")
+		senders, err := s.userli.GetSenders(context.Background(), "user@example.com")
 		s.NoError(err)
 		s.Equal([]string{"user@example.com"}, senders)
 		s.True(gock.IsDone())
 	})
 
 	s.Run("no email", func() {
-		senders, err := s.userli.GetSenders("user")
+		senders, err := s.userli.GetSenders(context.Background(), "user")
 		s.NoError(err)
 		s.Empty(senders)
 	})
@@ -198,7 +323,7 @@ func (s *UserliTestSuite) TestGetSenders() {
 			Reply(200).
 			JSON([]string{"user1@example.com", "user2@example.com"})
 
-		senders, err := s.userli.GetSenders("alias@example.com")
+		senders, err := s.userli.GetSenders(context.Background(), "alias@example.com")
 		s.NoError(err)
 		s.Equal([]string{"user1@example.com", "user2@example.com"}, senders)
 		s.True(gock.IsDone())
@@ -214,13 +339,181 @@ func (s *UserliTestSuite) TestGetSenders() {
 			Reply(500).
 			JSON(map[string]string{"error": "internal server error"})
 
-		senders, err := s.userli.GetSenders("user@example.com")
+		senders, err := s.userli.GetSenders(context.Background(), "user@example.com")
 		s.Error(err)
 		s.Empty(senders)
 		s.True(gock.IsDone())
 	})
 }
 
+func (s *UserliTestSuite) TestRequestID() {
+	s.Run("header", func() {
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/example.com").
+			MatchHeader("X-Request-ID", "abc123").
+			Reply(200).
+			JSON("true")
+
+		ctx := WithRequestID(context.Background(), "abc123")
+		active, err := s.userli.GetDomain(ctx, "example.com")
+		s.NoError(err)
+		s.True(active)
+		s.True(gock.IsDone())
+	})
+}
+
+func (s *UserliTestSuite) TestSecondaryToken() {
+	s.Run("fallback", func() {
+		s.userli.SetSecondaryToken("rotated")
+		defer s.userli.SetSecondaryToken("")
+
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/example.com").
+			MatchHeader("Authorization", "Bearer insecure").
+			Reply(401)
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/example.com").
+			MatchHeader("Authorization", "Bearer rotated").
+			Reply(200).
+			JSON("true")
+
+		before := testutil.ToFloat64(userliTokenFallbacks)
+
+		active, err := s.userli.GetDomain(context.Background(), "example.com")
+		s.NoError(err)
+		s.True(active)
+		s.True(gock.IsDone())
+		s.Equal(before+1, testutil.ToFloat64(userliTokenFallbacks))
+	})
+
+	s.Run("prefers the accepted secondary token", func() {
+		s.userli.SetSecondaryToken("rotated")
+		defer s.userli.SetSecondaryToken("")
+
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/example.com").
+			MatchHeader("Authorization", "Bearer insecure").
+			Reply(401)
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/example.com").
+			MatchHeader("Authorization", "Bearer rotated").
+			Times(2).
+			Reply(200).
+			JSON("true")
+
+		before := testutil.ToFloat64(userliTokenFallbacks)
+
+		for i := 0; i < 2; i++ {
+			active, err := s.userli.GetDomain(context.Background(), "example.com")
+			s.NoError(err)
+			s.True(active)
+		}
+		s.True(gock.IsDone())
+		s.Equal(before+1, testutil.ToFloat64(userliTokenFallbacks))
+
+		// the rotation makes the new primary token preferred again
+		s.userli.SetToken("rotated")
+		defer s.userli.SetToken("insecure")
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/example.com").
+			MatchHeader("Authorization", "Bearer rotated").
+			Reply(200).
+			JSON("true")
+
+		_, err := s.userli.GetDomain(context.Background(), "example.com")
+		s.NoError(err)
+		s.True(gock.IsDone())
+		s.Equal(before+1, testutil.ToFloat64(userliTokenFallbacks))
+	})
+
+	s.Run("no secondary token", func() {
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/example.com").
+			MatchHeader("Authorization", "Bearer insecure").
+			Reply(401)
+
+		_, err := s.userli.GetDomain(context.Background(), "example.com")
+		s.Error(err)
+		s.True(gock.IsDone())
+	})
+}
+
+func (s *UserliTestSuite) TestCheck() {
+	s.Run("success", func() {
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/health-check.invalid").
+			MatchHeader("Authorization", "Bearer insecure").
+			Reply(200).
+			JSON("false")
+
+		s.NoError(s.userli.Check(context.Background(), "domain", healthCheckDomain))
+		s.True(gock.IsDone())
+	})
+
+	s.Run("invalid token", func() {
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/health-check.invalid").
+			Reply(401)
+
+		err := s.userli.Check(context.Background(), "domain", healthCheckDomain)
+		s.ErrorContains(err, "userli rejected the token")
+		s.True(gock.IsDone())
+	})
+
+	s.Run("server error", func() {
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/health-check.invalid").
+			Reply(502)
+
+		err := s.userli.Check(context.Background(), "domain", healthCheckDomain)
+		s.ErrorContains(err, "unexpected response from userli: 502")
+		s.True(gock.IsDone())
+	})
+
+	s.Run("invalid response", func() {
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/domain/health-check.invalid").
+			Reply(200).
+			BodyString("<html>")
+
+		s.ErrorContains(s.userli.Check(context.Background(), "domain", healthCheckDomain), "invalid response from userli")
+		s.True(gock.IsDone())
+	})
+
+	s.Run("configured map and key", func() {
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/alias/postmaster@example.org").
+			Reply(200).
+			JSON([]string{"admin@example.org"})
+
+		s.NoError(s.userli.Check(context.Background(), "alias", "postmaster@example.org"))
+		s.True(gock.IsDone())
+	})
+}
+
+func (s *UserliTestSuite) TestSMTPUTF8() {
+	s.userli.SMTPUTF8 = true
+	defer func() { s.userli.SMTPUTF8 = false }()
+
+	s.Run("normalized", func() {
+		gock.New("http://localhost:8000").
+			Get("/api/postfix/mailbox/jürgen@xn--bcher-kva.example").
+			Reply(200).
+			JSON("true")
+
+		active, err := s.userli.GetMailbox(context.Background(), "jürgen@Bücher.example")
+		s.NoError(err)
+		s.True(active)
+		s.True(gock.IsDone())
+	})
+
+	s.Run("invalid", func() {
+		aliases, err := s.userli.GetAliases(context.Background(), "j rgen@example.com")
+		s.NoError(err)
+		s.Empty(aliases)
+	})
+}
+
 func TestUserl(t *testing.T) {
 	suite.Run(t, new(UserliTestSuite))
 }
@@ -0,0 +1,15 @@
+package main
+
+import "fmt"
+
+// These variables are set at build time via -ldflags.
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// versionString returns a human readable version string.
+func versionString() string {
+	return fmt.Sprintf("userli-postfix-adapter %s (commit %s, built %s)", version, commit, date)
+}
@@ -0,0 +1,52 @@
+package main
+
+// WorkerPool runs connection handlers on a fixed number of goroutines.
+// Handlers that find neither an idle worker nor room in the queue are
+// rejected instead of piling up.
+type WorkerPool struct {
+	tasks chan func()
+
+	// slots limits the tasks running or waiting to workers + queueSize.
+	slots chan struct{}
+}
+
+// NewWorkerPool starts workers goroutines. Up to queueSize tasks wait for
+// a worker if all of them are busy.
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	size := workers + queueSize
+	pool := &WorkerPool{
+		tasks: make(chan func(), size),
+		slots: make(chan struct{}, size),
+	}
+
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+// Submit queues task for a worker. It returns false without running task
+// if all workers are busy and the queue is full.
+func (w *WorkerPool) Submit(task func()) bool {
+	select {
+	case w.slots <- struct{}{}:
+	default:
+		return false
+	}
+
+	workerQueueDepth.Inc()
+	w.tasks <- task
+	statsd.Gauge("worker_queue_depth", float64(len(w.tasks)), nil)
+
+	return true
+}
+
+func (w *WorkerPool) work() {
+	for task := range w.tasks {
+		workerQueueDepth.Dec()
+		statsd.Gauge("worker_queue_depth", float64(len(w.tasks)), nil)
+		task()
+		<-w.slots
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type WorkerPoolTestSuite struct {
+	suite.Suite
+}
+
+func (s *WorkerPoolTestSuite) SetupTest() {
+	log.SetOutput(io.Discard)
+}
+
+func (s *WorkerPoolTestSuite) TestSubmit() {
+	pool := NewWorkerPool(1, 0)
+
+	done := make(chan struct{})
+	s.True(pool.Submit(func() { close(done) }))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		s.Fail("task did not run")
+	}
+}
+
+func (s *WorkerPoolTestSuite) TestQueueFull() {
+	pool := NewWorkerPool(1, 1)
+
+	block := make(chan struct{})
+	s.True(pool.Submit(func() { <-block }))
+	s.True(pool.Submit(func() { <-block }))
+	s.False(pool.Submit(func() {}))
+
+	close(block)
+	s.Eventually(func() bool {
+		return pool.Submit(func() {})
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (s *WorkerPoolTestSuite) TestServerShedsConnections() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	adapter := NewPostfixAdapter(new(MockUserliService))
+	server, err := NewTCPServer(ctx, TCPServerConfig{
+		Name:       "alias",
+		Addrs:      []string{"127.0.0.1:0"},
+		Workers:    NewWorkerPool(1, 0),
+		OnOverload: adapter.Shed,
+		Handler: func(conn net.Conn) {
+			<-block
+		},
+	})
+	s.Require().NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Serve(ctx, &wg)
+
+	addr := server.listeners[0].Addr().String()
+
+	first, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer first.Close()
+
+	s.Eventually(func() bool {
+		return len(server.Connections()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	second, err := net.Dial("tcp", addr)
+	s.Require().NoError(err)
+	defer second.Close()
+
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := io.ReadAll(second)
+	s.NoError(err)
+	s.Equal("400 OVERLOADED\n", string(response))
+}
+
+func TestWorkerPool(t *testing.T) {
+	suite.Run(t, new(WorkerPoolTestSuite))
+}